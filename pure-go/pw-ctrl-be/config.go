@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.bug.st/serial"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the backend configuration read from a YAML file
+// (pwctl-be --config <file>) or built from the positional arguments.
+// Environment variables PWCTL_* override the values of both.
+type Config struct {
+	Listen        string `yaml:"listen"`
+	BasePath      string `yaml:"basePath"`
+	SwaggerHost   string `yaml:"swaggerHost"`
+	ReadTimeOut   int    `yaml:"readTimeOut"`
+	ReadMinByte   int    `yaml:"readMinByte"`
+	SettleDelayMs int    `yaml:"settleDelayMs"`
+	// NOTE : With adaptiveSettle, settleDelayMs is the upper bound of the wait
+	AdaptiveSettle bool `yaml:"adaptiveSettle"`
+
+	ReadDeadline DeadlineConfig `yaml:"readDeadline"`
+
+	Queue struct {
+		Size           int `yaml:"size"`
+		CommandTimeOut int `yaml:"commandTimeOut"`
+		StatusEvery    int `yaml:"statusEvery"`
+	} `yaml:"queue"`
+
+	Verify struct {
+		PollIntervalMs int `yaml:"pollIntervalMs"`
+		TimeOut        int `yaml:"timeOut"`
+	} `yaml:"verify"`
+
+	Reconnect struct {
+		InitialMs  int     `yaml:"initialMs"`
+		MaxMs      int     `yaml:"maxMs"`
+		Multiplier float64 `yaml:"multiplier"`
+		Jitter     float64 `yaml:"jitter"`
+	} `yaml:"reconnect"`
+
+	// NOTE : Active-passive replicas sharing the lease file, see leader.go
+	HA struct {
+		Enabled   bool   `yaml:"enabled"`
+		LeaseFile string `yaml:"leaseFile"`
+		// Replica id, the host name by default
+		Id string `yaml:"id"`
+		// URL of this replica for the standby to proxy to, ex) http://10.0.0.1:8080
+		Advertise string `yaml:"advertise"`
+		LeaseMs   int    `yaml:"leaseMs"`
+		RenewMs   int    `yaml:"renewMs"`
+		// proxy : proxy the requests to the leader, unavailable : answer 503
+		Standby string `yaml:"standby"`
+	} `yaml:"ha"`
+
+	Hotplug struct {
+		Enabled bool `yaml:"enabled"`
+		// NOTE : Allows synthetic uevents over the admin API, for testing
+		AllowInject bool `yaml:"allowInject"`
+	} `yaml:"hotplug"`
+
+	Discovery struct {
+		FirstId int `yaml:"firstId"`
+		LastId  int `yaml:"lastId"`
+	} `yaml:"discovery"`
+
+	Serial      SerialConfig       `yaml:"serial"`
+	Controllers []ControllerConfig `yaml:"controllers"`
+}
+
+// DeadlineConfig is the read deadline per command type in milliseconds.
+// Zero status or power deadlines are the read timeout,
+// a zero initialize deadline keeps the boot output of the MCU.
+type DeadlineConfig struct {
+	StatusMs     int `yaml:"statusMs"`
+	PowerMs      int `yaml:"powerMs"`
+	InitializeMs int `yaml:"initializeMs"`
+}
+
+// SerialConfig is the line setting of a serial port.
+// Zero values are taken from the defaults of Config.Serial.
+type SerialConfig struct {
+	BaudRate int    `yaml:"baudRate"`
+	Parity   string `yaml:"parity"`
+	DataBits int    `yaml:"dataBits"`
+	StopBits string `yaml:"stopBits"`
+}
+
+type ControllerConfig struct {
+	Name string `yaml:"name"`
+	// ttyACM0, usb:<vid>:<pid>[:<serial>], /dev/serial/by-id/<name>,
+	// tcp://<host>:<port> or rfc2217://<host>:<port>
+	Port string `yaml:"port"`
+	// Port name prefixes used when no port is given, ex) [ttyACM, ttyUSB]
+	Prefix       []string       `yaml:"prefix"`
+	Routes       []string       `yaml:"routes"`
+	ReadTimeOut  int            `yaml:"readTimeOut"`
+	ReadDeadline DeadlineConfig `yaml:"readDeadline"`
+	Serial       SerialConfig   `yaml:"serial"`
+	// mcu (default), modbus, wol, ipmi, redfish or snmp
+	Driver string       `yaml:"driver"`
+	Modbus ModbusConfig `yaml:"modbus"`
+	Snmp   SnmpConfig   `yaml:"snmp"`
+	// Inventory of the network drivers (wol, ipmi, redfish, snmp), no port is opened for them
+	Workstations []WorkstationConfig `yaml:"workstations"`
+}
+
+var config_ *Config
+
+// NOTE : The arguments are kept to read the configuration again on reload
+var configArgs_ []string
+var settleDelay_ = 200 * time.Millisecond
+
+func defaultConfig() *Config {
+	cfg := &Config{
+		Listen:         ":8080",
+		BasePath:       "/api/v1/infra-external/power",
+		SwaggerHost:    "localhost",
+		ReadTimeOut:    10,
+		ReadMinByte:    0,
+		SettleDelayMs:  200,
+		AdaptiveSettle: true,
+		Serial: SerialConfig{
+			BaudRate: 9600,
+			Parity:   "none",
+			DataBits: 8,
+			StopBits: "1",
+		},
+	}
+	cfg.Queue.Size = 32
+	cfg.Queue.CommandTimeOut = 15
+	cfg.Queue.StatusEvery = 4
+	cfg.Verify.PollIntervalMs = 1000
+	cfg.Verify.TimeOut = 60
+	cfg.Reconnect.InitialMs = 1000
+	cfg.Reconnect.MaxMs = 60000
+	cfg.Reconnect.Multiplier = 2
+	cfg.Reconnect.Jitter = 0.2
+	cfg.HA.Enabled = false
+	cfg.HA.LeaseFile = "/var/lib/pwctl/leader.lease"
+	cfg.HA.Id, _ = os.Hostname()
+	cfg.HA.LeaseMs = 15000
+	cfg.HA.RenewMs = 5000
+	cfg.HA.Standby = "proxy"
+	cfg.Hotplug.Enabled = true
+	cfg.Hotplug.AllowInject = false
+	cfg.Discovery.FirstId = 0
+	cfg.Discovery.LastId = 127
+	return cfg
+}
+
+// readConfig reads the configuration from the config file or the
+// positional arguments and applies the environment variables
+func readConfig(args []string) (*Config, error) {
+	var cfg *Config
+	var err error
+	if args[1] == "--config" || args[1] == "-config" {
+		cfg, err = loadConfigFile(args[2])
+	} else {
+		cfg, err = argsConfig(args)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate rejects the values the queue and the verification cannot run with
+func (cfg *Config) validate() error {
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"queue.size", cfg.Queue.Size},
+		{"queue.commandTimeOut", cfg.Queue.CommandTimeOut},
+		{"queue.statusEvery", cfg.Queue.StatusEvery},
+		{"verify.pollIntervalMs", cfg.Verify.PollIntervalMs},
+		{"verify.timeOut", cfg.Verify.TimeOut},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return errors.New(p.name + " must be positive : " + strconv.Itoa(p.value))
+		}
+	}
+	return nil
+}
+
+// loadConfigFile reads the YAML file over the defaults
+func loadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := defaultConfig()
+	err = yaml.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, errors.New(path + " : " + err.Error())
+	}
+
+	if len(cfg.Controllers) == 0 {
+		cfg.Controllers = []ControllerConfig{defaultControllerConfig()}
+	}
+
+	// NOTE : The routes of a controller with an inventory default to its workstation ids
+	for i, cc := range cfg.Controllers {
+		if len(cc.Routes) == 0 {
+			for _, ws := range cc.Workstations {
+				cfg.Controllers[i].Routes = append(cfg.Controllers[i].Routes, strconv.Itoa(ws.Id))
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// argsConfig builds the configuration from the positional arguments
+// <read timeout> <min bytes> [<port prefix> | <port>=<routes> ...]
+func argsConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	var err error
+	cfg.ReadTimeOut, err = strconv.Atoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ReadMinByte, err = strconv.Atoi(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	specs := args[3:]
+	if len(specs) == 0 {
+		cfg.Controllers = []ControllerConfig{defaultControllerConfig()}
+		return cfg, nil
+	}
+
+	if len(specs) == 1 && !strings.Contains(specs[0], "=") {
+		cfg.Controllers = []ControllerConfig{{Name: specs[0], Port: specs[0], Routes: []string{"*"}}}
+		return cfg, nil
+	}
+
+	for _, spec := range specs {
+		name, routeSpecs, err := parseControllerSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Controllers = append(cfg.Controllers, ControllerConfig{Name: name, Port: name, Routes: routeSpecs})
+	}
+	return cfg, nil
+}
+
+// defaultControllerConfig is the single controller on ttyACM* or ttyUSB*
+func defaultControllerConfig() ControllerConfig {
+	return ControllerConfig{
+		Name:   "default",
+		Prefix: []string{"ttyACM", "ttyUSB"},
+		Routes: []string{"*"},
+	}
+}
+
+// applyEnv overrides the configuration with the environment variables
+func (cfg *Config) applyEnv() error {
+	envString := func(name string, value *string) {
+		if env, found := os.LookupEnv(name); found {
+			*value = env
+		}
+	}
+
+	var err error
+	envInt := func(name string, value *int) {
+		if env, found := os.LookupEnv(name); found && err == nil {
+			*value, err = strconv.Atoi(env)
+			if err != nil {
+				err = errors.New(name + " : " + err.Error())
+			}
+		}
+	}
+
+	envBool := func(name string, value *bool) {
+		if env, found := os.LookupEnv(name); found && err == nil {
+			*value, err = strconv.ParseBool(env)
+			if err != nil {
+				err = errors.New(name + " : " + err.Error())
+			}
+		}
+	}
+
+	envFloat := func(name string, value *float64) {
+		if env, found := os.LookupEnv(name); found && err == nil {
+			*value, err = strconv.ParseFloat(env, 64)
+			if err != nil {
+				err = errors.New(name + " : " + err.Error())
+			}
+		}
+	}
+
+	envString("PWCTL_LISTEN", &cfg.Listen)
+	envString("PWCTL_BASE_PATH", &cfg.BasePath)
+	envString("PWCTL_SWAGGER_HOST", &cfg.SwaggerHost)
+	envInt("PWCTL_READ_TIMEOUT", &cfg.ReadTimeOut)
+	envInt("PWCTL_READ_MIN_BYTE", &cfg.ReadMinByte)
+	envInt("PWCTL_SETTLE_DELAY_MS", &cfg.SettleDelayMs)
+	envBool("PWCTL_ADAPTIVE_SETTLE", &cfg.AdaptiveSettle)
+	envInt("PWCTL_STATUS_DEADLINE_MS", &cfg.ReadDeadline.StatusMs)
+	envInt("PWCTL_POWER_DEADLINE_MS", &cfg.ReadDeadline.PowerMs)
+	envInt("PWCTL_INITIALIZE_DEADLINE_MS", &cfg.ReadDeadline.InitializeMs)
+	envInt("PWCTL_QUEUE_SIZE", &cfg.Queue.Size)
+	envInt("PWCTL_COMMAND_TIMEOUT", &cfg.Queue.CommandTimeOut)
+	envInt("PWCTL_STATUS_EVERY", &cfg.Queue.StatusEvery)
+	envInt("PWCTL_VERIFY_POLL_INTERVAL_MS", &cfg.Verify.PollIntervalMs)
+	envInt("PWCTL_VERIFY_TIMEOUT", &cfg.Verify.TimeOut)
+	envInt("PWCTL_RECONNECT_INITIAL_MS", &cfg.Reconnect.InitialMs)
+	envInt("PWCTL_RECONNECT_MAX_MS", &cfg.Reconnect.MaxMs)
+	envFloat("PWCTL_RECONNECT_MULTIPLIER", &cfg.Reconnect.Multiplier)
+	envFloat("PWCTL_RECONNECT_JITTER", &cfg.Reconnect.Jitter)
+	envBool("PWCTL_HA", &cfg.HA.Enabled)
+	envString("PWCTL_HA_LEASE_FILE", &cfg.HA.LeaseFile)
+	envString("PWCTL_HA_ID", &cfg.HA.Id)
+	envString("PWCTL_HA_ADVERTISE", &cfg.HA.Advertise)
+	envInt("PWCTL_HA_LEASE_MS", &cfg.HA.LeaseMs)
+	envInt("PWCTL_HA_RENEW_MS", &cfg.HA.RenewMs)
+	envString("PWCTL_HA_STANDBY", &cfg.HA.Standby)
+	envBool("PWCTL_HOTPLUG", &cfg.Hotplug.Enabled)
+	envBool("PWCTL_HOTPLUG_ALLOW_INJECT", &cfg.Hotplug.AllowInject)
+	envInt("PWCTL_DISCOVERY_FIRST_ID", &cfg.Discovery.FirstId)
+	envInt("PWCTL_DISCOVERY_LAST_ID", &cfg.Discovery.LastId)
+	envInt("PWCTL_BAUD_RATE", &cfg.Serial.BaudRate)
+	envString("PWCTL_PARITY", &cfg.Serial.Parity)
+	envInt("PWCTL_DATA_BITS", &cfg.Serial.DataBits)
+	envString("PWCTL_STOP_BITS", &cfg.Serial.StopBits)
+
+	// NOTE : The port prefix only applies to a single controller
+	if prefix, found := os.LookupEnv("PWCTL_PORT_PREFIX"); found && len(cfg.Controllers) == 1 {
+		cfg.Controllers[0].Port = ""
+		cfg.Controllers[0].Prefix = strings.Split(prefix, ",")
+	}
+
+	return err
+}
+
+// applyGlobals sets the global parameters from the configuration
+func (cfg *Config) applyGlobals() {
+	readTimeOut_ = cfg.ReadTimeOut
+	readMinByte_ = cfg.ReadMinByte
+	settleDelay_ = time.Duration(cfg.SettleDelayMs) * time.Millisecond
+	adaptiveSettle_ = cfg.AdaptiveSettle
+	queueSize_ = cfg.Queue.Size
+	commandTimeOut_ = time.Duration(cfg.Queue.CommandTimeOut) * time.Second
+	statusEvery_ = cfg.Queue.StatusEvery
+	verifyPollInterval_ = time.Duration(cfg.Verify.PollIntervalMs) * time.Millisecond
+	verifyTimeOut_ = time.Duration(cfg.Verify.TimeOut) * time.Second
+	reconnectInitial_ = time.Duration(cfg.Reconnect.InitialMs) * time.Millisecond
+	reconnectMax_ = time.Duration(cfg.Reconnect.MaxMs) * time.Millisecond
+	reconnectMultiplier_ = max(cfg.Reconnect.Multiplier, 1)
+	reconnectJitter_ = min(max(cfg.Reconnect.Jitter, 0), 1)
+	hotplugEnabled_ = cfg.Hotplug.Enabled
+	hotplugAllowInject_ = cfg.Hotplug.AllowInject
+	discoveryFirstId_ = cfg.Discovery.FirstId
+	discoveryLastId_ = cfg.Discovery.LastId
+}
+
+// applyHA sets the leader election parameters. They are only
+// applied at startup, a reload reports them as restart required.
+func (cfg *Config) applyHA() error {
+	if !cfg.HA.Enabled {
+		return nil
+	}
+
+	if cfg.HA.LeaseFile == "" || cfg.HA.Id == "" {
+		return errors.New("ha : leaseFile and id are required")
+	}
+	if cfg.HA.RenewMs <= 0 || cfg.HA.RenewMs*2 > cfg.HA.LeaseMs {
+		return errors.New("ha : renewMs must be positive and at most half of leaseMs")
+	}
+	if cfg.HA.Standby != "proxy" && cfg.HA.Standby != "unavailable" {
+		return errors.New("ha : invalid standby : " + cfg.HA.Standby + " (proxy or unavailable)")
+	}
+
+	haEnabled_ = true
+	haLeaseFile_ = cfg.HA.LeaseFile
+	haId_ = cfg.HA.Id
+	haAdvertise_ = cfg.HA.Advertise
+	haLeaseDuration_ = time.Duration(cfg.HA.LeaseMs) * time.Millisecond
+	haRenewInterval_ = time.Duration(cfg.HA.RenewMs) * time.Millisecond
+	haStandbyProxy_ = cfg.HA.Standby == "proxy"
+	return nil
+}
+
+// portSelector returns the port selector of the controller
+func (cc ControllerConfig) portSelector() (PortSelector, error) {
+	if cc.Port != "" {
+		return parsePortSelector(cc.Port)
+	}
+
+	if len(cc.Prefix) == 0 {
+		return PortSelector{}, errors.New("no port or prefix for controller " + cc.Name)
+	}
+
+	selector := PortSelector{}
+	for _, prefix := range cc.Prefix {
+		selector.prefix = append(selector.prefix, "/dev/"+prefix)
+	}
+	return selector, nil
+}
+
+// newPwCtrl creates the PwCtrl of the controller
+func (cc ControllerConfig) newPwCtrl(cfg *Config) (*PwCtrl, error) {
+	driver, err := cc.newDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	selector := PortSelector{}
+	if driver.UsesPort() {
+		selector, err = cc.portSelector()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mode, err := cc.Serial.serialMode(cfg.Serial)
+	if err != nil {
+		return nil, errors.New(cc.Name + " : " + err.Error())
+	}
+
+	readTimeOut := cc.ReadTimeOut
+	if readTimeOut == 0 {
+		readTimeOut = cfg.ReadTimeOut
+	}
+
+	pwctl := NewPwCtrl(selector, mode, readTimeOut, cfg.ReadMinByte)
+	pwctl.readDeadlines = cc.ReadDeadline.readDeadlines(cfg.ReadDeadline, pwctl.readDeadlines)
+	pwctl.driver = driver
+	return pwctl, nil
+}
+
+// readDeadlines merges the controller deadlines over the default deadlines,
+// zero values are taken from the read timeout
+func (dc DeadlineConfig) readDeadlines(defaults DeadlineConfig, timeout ReadDeadlines) ReadDeadlines {
+	milliseconds := func(values ...int) time.Duration {
+		for _, value := range values {
+			if value > 0 {
+				return time.Duration(value) * time.Millisecond
+			}
+		}
+		return 0
+	}
+
+	deadlines := ReadDeadlines{
+		status:     milliseconds(dc.StatusMs, defaults.StatusMs),
+		power:      milliseconds(dc.PowerMs, defaults.PowerMs),
+		initialize: milliseconds(dc.InitializeMs, defaults.InitializeMs),
+	}
+	if deadlines.status == 0 {
+		deadlines.status = timeout.status
+	}
+	if deadlines.power == 0 {
+		deadlines.power = timeout.power
+	}
+	return deadlines
+}
+
+// serialMode merges the controller setting over the default setting
+func (sc SerialConfig) serialMode(defaults SerialConfig) (*serial.Mode, error) {
+	if sc.BaudRate == 0 {
+		sc.BaudRate = defaults.BaudRate
+	}
+	if sc.Parity == "" {
+		sc.Parity = defaults.Parity
+	}
+	if sc.DataBits == 0 {
+		sc.DataBits = defaults.DataBits
+	}
+	if sc.StopBits == "" {
+		sc.StopBits = defaults.StopBits
+	}
+
+	mode := &serial.Mode{
+		BaudRate: sc.BaudRate,
+		DataBits: sc.DataBits,
+	}
+
+	switch strings.ToLower(sc.Parity) {
+	case "none", "n":
+		mode.Parity = serial.NoParity
+	case "odd", "o":
+		mode.Parity = serial.OddParity
+	case "even", "e":
+		mode.Parity = serial.EvenParity
+	case "mark", "m":
+		mode.Parity = serial.MarkParity
+	case "space", "s":
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, errors.New("invalid parity : " + sc.Parity)
+	}
+
+	switch sc.StopBits {
+	case "1":
+		mode.StopBits = serial.OneStopBit
+	case "1.5":
+		mode.StopBits = serial.OnePointFiveStopBits
+	case "2":
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, errors.New("invalid stop bits : " + sc.StopBits)
+	}
+
+	return mode, nil
+}
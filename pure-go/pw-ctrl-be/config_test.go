@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArgsConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		readTimeOut int
+		readMinByte int
+		controllers []ControllerConfig
+		selectors   []string
+		err         string
+	}{
+		{"defaults", []string{"pwctl", "5", "0"}, 5, 0,
+			[]ControllerConfig{{Name: "default", Prefix: []string{"ttyACM", "ttyUSB"}, Routes: []string{"*"}}},
+			[]string{"/dev/ttyACM /dev/ttyUSB"}, ""},
+		{"port prefix", []string{"pwctl", "5", "0", "ttyACM"}, 5, 0,
+			[]ControllerConfig{{Name: "ttyACM", Port: "ttyACM", Routes: []string{"*"}}},
+			[]string{"/dev/ttyACM"}, ""},
+		{"usb selector", []string{"pwctl", "3", "4", "usb:2341:0043:A1B2"}, 3, 4,
+			[]ControllerConfig{{Name: "usb:2341:0043:A1B2", Port: "usb:2341:0043:A1B2", Routes: []string{"*"}}},
+			[]string{"usb:2341:0043:A1B2"}, ""},
+		{"controllers", []string{"pwctl", "5", "0", "ttyACM0=0-63", "usb:2341:0043=64-127,rack:2"}, 5, 0,
+			[]ControllerConfig{
+				{Name: "ttyACM0", Port: "ttyACM0", Routes: []string{"0-63"}},
+				{Name: "usb:2341:0043", Port: "usb:2341:0043", Routes: []string{"64-127", "rack:2"}},
+			},
+			[]string{"/dev/ttyACM0", "usb:2341:0043"}, ""},
+		{"auto routes", []string{"pwctl", "5", "0", "rfc2217://10.0.0.5:4001=auto"}, 5, 0,
+			[]ControllerConfig{{Name: "rfc2217://10.0.0.5:4001", Port: "rfc2217://10.0.0.5:4001", Routes: []string{"auto"}}},
+			[]string{"rfc2217://10.0.0.5:4001"}, ""},
+		{"invalid read timeout", []string{"pwctl", "x", "0"}, 0, 0, nil, nil, "invalid syntax"},
+		{"invalid min bytes", []string{"pwctl", "5", "x"}, 0, 0, nil, nil, "invalid syntax"},
+		{"no routes", []string{"pwctl", "5", "0", "ttyACM0=0-63", "ttyACM1="}, 0, 0, nil, nil, "invalid controller : ttyACM1="},
+		{"no port", []string{"pwctl", "5", "0", "=0-63", "ttyACM1=64"}, 0, 0, nil, nil, "invalid controller : =0-63"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := argsConfig(tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.ReadTimeOut != tt.readTimeOut || cfg.ReadMinByte != tt.readMinByte {
+				t.Errorf("readTimeOut = %v, readMinByte = %v, want %v, %v", cfg.ReadTimeOut, cfg.ReadMinByte, tt.readTimeOut, tt.readMinByte)
+			}
+			if !reflect.DeepEqual(cfg.Controllers, tt.controllers) {
+				t.Errorf("controllers = %+v, want %+v", cfg.Controllers, tt.controllers)
+			}
+			for i, cc := range cfg.Controllers {
+				selector, err := cc.portSelector()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if selector.String() != tt.selectors[i] {
+					t.Errorf("%v : selector = %q, want %q", cc.Name, selector.String(), tt.selectors[i])
+				}
+			}
+			if err := cfg.validate(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReadConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+listen: ":9090"
+readTimeOut: 3
+queue:
+  size: 16
+  statusEvery: 2
+reconnect:
+  maxMs: 30000
+serial:
+  baudRate: 115200
+controllers:
+  - name: rack1
+    port: ttyACM0
+    routes: [rack:1]
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PWCTL_LISTEN", ":7070")
+	t.Setenv("PWCTL_QUEUE_SIZE", "8")
+	t.Setenv("PWCTL_RECONNECT_JITTER", "0.5")
+	t.Setenv("PWCTL_HA", "true")
+	t.Setenv("PWCTL_PORT_PREFIX", "ttyUSB,ttyACM")
+
+	cfg, err := readConfig([]string{"pwctl", "--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment wins over the file, the file over the defaults
+	checks := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"listen", cfg.Listen, ":7070"},
+		{"queue.size", cfg.Queue.Size, 8},
+		{"reconnect.jitter", cfg.Reconnect.Jitter, 0.5},
+		{"ha.enabled", cfg.HA.Enabled, true},
+		{"readTimeOut", cfg.ReadTimeOut, 3},
+		{"queue.statusEvery", cfg.Queue.StatusEvery, 2},
+		{"reconnect.maxMs", cfg.Reconnect.MaxMs, 30000},
+		{"serial.baudRate", cfg.Serial.BaudRate, 115200},
+		{"queue.commandTimeOut", cfg.Queue.CommandTimeOut, 15},
+		{"reconnect.initialMs", cfg.Reconnect.InitialMs, 1000},
+		{"serial.parity", cfg.Serial.Parity, "none"},
+		{"controllers[0].port", cfg.Controllers[0].Port, ""},
+		{"controllers[0].prefix", cfg.Controllers[0].Prefix, []string{"ttyUSB", "ttyACM"}},
+		{"controllers[0].routes", cfg.Controllers[0].Routes, []string{"rack:1"}},
+	}
+	for _, check := range checks {
+		if !reflect.DeepEqual(check.got, check.want) {
+			t.Errorf("%v = %v, want %v", check.name, check.got, check.want)
+		}
+	}
+
+	envErrors := []struct {
+		name  string
+		value string
+		err   string
+	}{
+		{"PWCTL_QUEUE_SIZE", "many", "PWCTL_QUEUE_SIZE"},
+		{"PWCTL_ADAPTIVE_SETTLE", "maybe", "PWCTL_ADAPTIVE_SETTLE"},
+		{"PWCTL_RECONNECT_MULTIPLIER", "x2", "PWCTL_RECONNECT_MULTIPLIER"},
+		{"PWCTL_STATUS_EVERY", "0", "queue.statusEvery must be positive"},
+		{"PWCTL_VERIFY_TIMEOUT", "-1", "verify.timeOut must be positive"},
+	}
+	for _, tt := range envErrors {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+
+			_, err := readConfig([]string{"pwctl", "--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"zero queue size", func(cfg *Config) { cfg.Queue.Size = 0 }, "queue.size must be positive : 0"},
+		{"negative command timeout", func(cfg *Config) { cfg.Queue.CommandTimeOut = -1 }, "queue.commandTimeOut must be positive : -1"},
+		{"zero status every", func(cfg *Config) { cfg.Queue.StatusEvery = 0 }, "queue.statusEvery must be positive"},
+		{"zero poll interval", func(cfg *Config) { cfg.Verify.PollIntervalMs = 0 }, "verify.pollIntervalMs must be positive"},
+		{"zero verify timeout", func(cfg *Config) { cfg.Verify.TimeOut = 0 }, "verify.timeOut must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(cfg)
+
+			err := cfg.validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
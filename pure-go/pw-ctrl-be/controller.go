@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Controller is one power-controller board with its own port and queue
+type Controller struct {
+	name  string
+	pwctl *PwCtrl
+	queue *CommandQueue
+
+	// NOTE : Routes are discovered by probing at startup ("<port>=auto")
+	autoDiscover bool
+
+	cancel context.CancelFunc
+}
+
+// Route maps the workstation ids first~last to a controller
+type Route struct {
+	spec       string
+	first      int
+	last       int
+	controller *Controller
+}
+
+// RoutingTable finds the controller of a workstation id.
+// The first matching route wins.
+type RoutingTable struct {
+	mutex  sync.RWMutex
+	routes []Route
+}
+
+type ControllerState struct {
+	Name      string   `json:"name"`
+	PortName  string   `json:"portName"`
+	Driver    string   `json:"driver"`
+	Connected bool     `json:"connected"`
+	Routes    []string `json:"routes"`
+}
+
+// Workstation ids per rack, "rack:2" is 0200~0299
+const RACK_SIZE = 100
+
+// NOTE : controllers_ is replaced as a whole on reload, read it with controllerList()
+var controllers_ []*Controller
+var controllersMutex sync.RWMutex
+var routes_ = &RoutingTable{}
+
+func NewController(name string, pwctl *PwCtrl) *Controller {
+	return &Controller{
+		name:  name,
+		pwctl: pwctl,
+		queue: NewCommandQueue(pwctl, queueSize_),
+	}
+}
+
+func (ctrl *Controller) start(ctx context.Context) {
+	ctx, ctrl.cancel = context.WithCancel(ctx)
+	ctrl.queue.start(ctx)
+}
+
+// stop fails the queued commands, stops the worker and closes the port
+func (ctrl *Controller) stop() {
+	ctrl.queue.close()
+	if ctrl.cancel != nil {
+		ctrl.cancel()
+	}
+
+	ctrl.pwctl.portMutex.Lock()
+	ctrl.pwctl.closed = true
+	ctrl.pwctl.reconnect.closed()
+	ctrl.pwctl.connectInitialized = false
+	if ctrl.pwctl.transport != nil {
+		ctrl.pwctl.transport.Close()
+		ctrl.pwctl.transport = nil
+	}
+	ctrl.pwctl.portMutex.Unlock()
+}
+
+// activateControllers opens the ports and discovers the routes of the
+// "auto" controllers. With HA it runs when this replica becomes the leader.
+func activateControllers() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	autoControllers := make([]*Controller, 0)
+	for _, controller := range controllerList() {
+		pwctl := controller.pwctl
+
+		pwctl.portMutex.Lock()
+		pwctl.standby = false
+		_, err := pwctl.intializeConnection()
+		if err != nil {
+			fmt.Println(controller.name, " : ", err.Error())
+			pwctl.startReIntializing(err)
+		}
+		pwctl.portMutex.Unlock()
+
+		if controller.autoDiscover {
+			autoControllers = append(autoControllers, controller)
+		}
+	}
+
+	if len(autoControllers) > 0 && beginDiscovery(discoveryFirstId_, discoveryLastId_) {
+		go discoverRoutes(context.Background(), autoControllers, discoveryFirstId_, discoveryLastId_)
+	}
+}
+
+// deactivateControllers closes the ports for the leader replica to open them.
+// The running command completes first.
+func deactivateControllers() {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	for _, controller := range controllerList() {
+		pwctl := controller.pwctl
+
+		pwctl.portMutex.Lock()
+		pwctl.standby = true
+		pwctl.connectInitialized = false
+		if pwctl.transport != nil {
+			pwctl.transport.Close()
+			pwctl.transport = nil
+		}
+		pwctl.reconnect.standby()
+		pwctl.portMutex.Unlock()
+	}
+}
+
+func controllerList() []*Controller {
+	controllersMutex.RLock()
+	defer controllersMutex.RUnlock()
+
+	return controllers_
+}
+
+func setControllerList(controllers []*Controller) {
+	controllersMutex.Lock()
+	defer controllersMutex.Unlock()
+
+	controllers_ = controllers
+}
+
+// parseControllerSpec parses "<port>=<route>,<route>,..." given in argv,
+// ex) ttyACM0=0-63,rack:2 or ttyACM0=auto to discover the routes
+func parseControllerSpec(spec string) (string, []string, error) {
+	name, routeSpecs, found := strings.Cut(spec, "=")
+	if !found || name == "" || routeSpecs == "" {
+		return "", nil, errors.New("invalid controller : " + spec + " (ex: ttyACM0=0-63,rack:2)")
+	}
+	return name, strings.Split(routeSpecs, ","), nil
+}
+
+// parseRoute parses one route
+//   - "*"        : all workstation ids
+//   - "7"        : a single id
+//   - "0-63"     : an id range
+//   - "rack:2"   : ids of a rack (0200~0299)
+func parseRoute(spec string) (int, int, error) {
+	if spec == "*" {
+		return 0, 9999, nil
+	}
+
+	if rack, found := strings.CutPrefix(spec, "rack:"); found {
+		n, err := strconv.Atoi(rack)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid rack : " + spec)
+		}
+		return n * RACK_SIZE, n*RACK_SIZE + RACK_SIZE - 1, nil
+	}
+
+	firstStr, lastStr, isRange := strings.Cut(spec, "-")
+	first, err := strconv.Atoi(firstStr)
+	if err != nil {
+		return 0, 0, errors.New("invalid route : " + spec)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+
+	last, err := strconv.Atoi(lastStr)
+	if err != nil || last < first {
+		return 0, 0, errors.New("invalid route : " + spec)
+	}
+	return first, last, nil
+}
+
+// validateControllers rejects a duplicate controller name, an invalid route
+// and a route overlapping the route of another controller, which would
+// shadow it. The routes of an "auto" controller are checked by discovery.
+func validateControllers(cfg *Config) error {
+	names := make(map[string]bool)
+	routes := make([]Route, 0)
+	owners := make([]string, 0)
+	for _, cc := range cfg.Controllers {
+		if names[cc.Name] {
+			return errors.New("duplicate controller : " + cc.Name)
+		}
+		names[cc.Name] = true
+
+		if len(cc.Routes) == 1 && cc.Routes[0] == "auto" {
+			continue
+		}
+
+		for _, spec := range cc.Routes {
+			first, last, err := parseRoute(spec)
+			if err != nil {
+				return err
+			}
+
+			for i, route := range routes {
+				if owners[i] != cc.Name && first <= route.last && route.first <= last {
+					return errors.New("route " + spec + " of controller " + cc.Name +
+						" overlaps route " + route.spec + " of controller " + owners[i])
+				}
+			}
+			routes = append(routes, Route{spec: spec, first: first, last: last})
+			owners = append(owners, cc.Name)
+		}
+	}
+	return nil
+}
+
+func (r *RoutingTable) add(spec string, controller *Controller) error {
+	first, last, err := parseRoute(spec)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.routes = append(r.routes, Route{spec, first, last, controller})
+	return nil
+}
+
+// replace drops the routes of the controllers and puts the new routes first
+func (r *RoutingTable) replace(controllers []*Controller, newRoutes []Route) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	replaced := make(map[*Controller]bool)
+	for _, controller := range controllers {
+		replaced[controller] = true
+	}
+
+	routes := append([]Route{}, newRoutes...)
+	for _, route := range r.routes {
+		if !replaced[route.controller] {
+			routes = append(routes, route)
+		}
+	}
+	r.routes = routes
+}
+
+// reset replaces all routes
+func (r *RoutingTable) reset(routes []Route) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.routes = routes
+}
+
+func (r *RoutingTable) lookup(id int) *Controller {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, route := range r.routes {
+		if id >= route.first && id <= route.last {
+			return route.controller
+		}
+	}
+	return nil
+}
+
+func (r *RoutingTable) routesOf(controller *Controller) []Route {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	routes := make([]Route, 0)
+	for _, route := range r.routes {
+		if route.controller == controller {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (r *RoutingTable) routeSpecs(controller *Controller) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	specs := make([]string, 0)
+	for _, route := range r.routes {
+		if route.controller == controller {
+			specs = append(specs, route.spec)
+		}
+	}
+	return specs
+}
+
+// allConnected is true if every controller has an initialized port
+func allConnected() bool {
+	controllers := controllerList()
+	if len(controllers) == 0 {
+		return false
+	}
+
+	for _, controller := range controllers {
+		if !controller.pwctl.connected() {
+			return false
+		}
+	}
+	return true
+}
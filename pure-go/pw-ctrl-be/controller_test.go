@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		spec  string
+		first int
+		last  int
+		ok    bool
+	}{
+		{"*", 0, 9999, true},
+		{"7", 7, 7, true},
+		{"0-63", 0, 63, true},
+		{"64-64", 64, 64, true},
+		{"rack:0", 0, 99, true},
+		{"rack:2", 200, 299, true},
+		{"rack:99", 9900, 9999, true},
+		{"63-0", 0, 0, false},
+		{"", 0, 0, false},
+		{"-", 0, 0, false},
+		{"5-", 0, 0, false},
+		{"-5", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"rack:", 0, 0, false},
+		{"rack:-1", 0, 0, false},
+		{"rack:x", 0, 0, false},
+		{"auto", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		first, last, err := parseRoute(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRoute(%q) err = %v, want ok %v", tt.spec, err, tt.ok)
+			continue
+		}
+		if tt.ok && (first != tt.first || last != tt.last) {
+			t.Errorf("parseRoute(%q) = %v~%v, want %v~%v", tt.spec, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+func TestValidateControllers(t *testing.T) {
+	controller := func(name string, routes ...string) ControllerConfig {
+		return ControllerConfig{Name: name, Routes: routes}
+	}
+
+	tests := []struct {
+		name        string
+		controllers []ControllerConfig
+		err         string
+	}{
+		{"disjoint ranges", []ControllerConfig{controller("a", "0-63"), controller("b", "64-127")}, ""},
+		{"racks", []ControllerConfig{controller("a", "rack:0", "rack:1"), controller("b", "rack:2")}, ""},
+		{"overlap within a controller", []ControllerConfig{controller("a", "0-63", "10-20")}, ""},
+		{"auto next to a wildcard", []ControllerConfig{controller("a", "*"), controller("b", "auto")}, ""},
+		{"overlapping ranges", []ControllerConfig{controller("a", "0-63"), controller("b", "63-127")}, "overlaps route 0-63 of controller a"},
+		{"range inside a range", []ControllerConfig{controller("a", "0-63"), controller("b", "10")}, "overlaps"},
+		{"range over a rack", []ControllerConfig{controller("a", "rack:1"), controller("b", "150-250")}, "overlaps route rack:1"},
+		{"duplicate id", []ControllerConfig{controller("a", "7"), controller("b", "8", "7")}, "route 7 of controller b"},
+		{"wildcard", []ControllerConfig{controller("a", "7"), controller("b", "*")}, "overlaps"},
+		{"duplicate controller", []ControllerConfig{controller("a", "0"), controller("a", "1")}, "duplicate controller : a"},
+		{"reversed range", []ControllerConfig{controller("a", "63-0")}, "invalid route : 63-0"},
+		{"empty route", []ControllerConfig{controller("a", "")}, "invalid route"},
+		{"invalid rack", []ControllerConfig{controller("a", "rack:x")}, "invalid rack"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateControllers(&Config{Controllers: tt.controllers})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRoutingTableLookup(t *testing.T) {
+	a := &Controller{name: "a"}
+	b := &Controller{name: "b"}
+
+	table := &RoutingTable{}
+	for _, route := range []struct {
+		spec       string
+		controller *Controller
+	}{
+		{"0-63", a},
+		{"rack:1", b},
+		{"*", a},
+	} {
+		if err := table.add(route.spec, route.controller); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id         int
+		controller *Controller
+	}{
+		{0, a},
+		{63, a},
+		{64, a},
+		{100, b},
+		{199, b},
+		{9999, a},
+		{10000, nil},
+		{-1, nil},
+	}
+	for _, tt := range tests {
+		if controller := table.lookup(tt.id); controller != tt.controller {
+			t.Errorf("lookup(%v) = %v, want %v", tt.id, controller, tt.controller)
+		}
+	}
+
+	// NOTE : The routes put first by replace win over the remaining ones
+	c := &Controller{name: "c"}
+	table.replace([]*Controller{a}, []Route{{spec: "50-60", first: 50, last: 60, controller: c}})
+	for id, want := range map[int]*Controller{0: nil, 55: c, 150: b} {
+		if controller := table.lookup(id); controller != want {
+			t.Errorf("after replace lookup(%v) = %v, want %v", id, controller, want)
+		}
+	}
+}
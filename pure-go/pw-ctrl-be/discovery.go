@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ControllerDiscovery is the probing result of one controller
+type ControllerDiscovery struct {
+	Name       string   `json:"name"`
+	Routes     []string `json:"routes"`
+	Owned      int      `json:"owned"`
+	Unknown    int      `json:"unknown"`
+	FailedIds  []string `json:"failedIds"`
+	LastError  string   `json:"lastError"`
+	ProbedIds  int      `json:"probedIds"`
+	ElapsedSec int      `json:"elapsedSeconds"`
+}
+
+type DiscoveryResult struct {
+	Running     bool                  `json:"running"`
+	StartedAt   time.Time             `json:"startedAt"`
+	FinishedAt  time.Time             `json:"finishedAt"`
+	FirstId     int                   `json:"firstId"`
+	LastId      int                   `json:"lastId"`
+	Controllers []ControllerDiscovery `json:"controllers"`
+	Conflicts   []string              `json:"conflicts"`
+}
+
+var discoveryFirstId_ = 0
+var discoveryLastId_ = 127
+
+var discoveryMutex sync.Mutex
+var discoveryResult_ DiscoveryResult
+
+// beginDiscovery marks a discovery as running.
+// It returns false if a discovery is already running.
+func beginDiscovery(firstId int, lastId int) bool {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	if discoveryResult_.Running {
+		return false
+	}
+	discoveryResult_ = DiscoveryResult{
+		Running:   true,
+		StartedAt: time.Now(),
+		FirstId:   firstId,
+		LastId:    lastId,
+	}
+	return true
+}
+
+// discoverRoutes sends C<id> probes over the ports of the controllers.
+// Ids answered with a power state belong to the controller, ids answered
+// with 9 (unknown command or wrong rack-number) do not. The routes of the
+// probed controllers are replaced with the discovered ones.
+// beginDiscovery must have succeeded before.
+func discoverRoutes(ctx context.Context, controllers []*Controller, firstId int, lastId int) {
+	logger.Infof("Discovering workstation ids %v~%v on %v controllers", firstId, lastId, len(controllers))
+
+	owned := make([][]int, len(controllers))
+	results := make([]ControllerDiscovery, len(controllers))
+
+	var wg sync.WaitGroup
+	for i, controller := range controllers {
+		wg.Add(1)
+		go func(i int, controller *Controller) {
+			defer wg.Done()
+			owned[i], results[i] = probeController(ctx, controller, firstId, lastId)
+		}(i, controller)
+	}
+	wg.Wait()
+
+	// NOTE : An id answered by several controllers goes to the first one
+	claimed := make(map[int]string)
+	conflicts := make([]string, 0)
+	newRoutes := make([]Route, 0)
+
+	for i, controller := range controllers {
+		ids := make([]int, 0, len(owned[i]))
+		for _, id := range owned[i] {
+			if owner, found := claimed[id]; found {
+				conflicts = append(conflicts, zeroPad(id)+" : "+owner+", "+controller.name)
+				continue
+			}
+			claimed[id] = controller.name
+			ids = append(ids, id)
+		}
+
+		for _, route := range compressIds(ids) {
+			route.controller = controller
+			newRoutes = append(newRoutes, route)
+			results[i].Routes = append(results[i].Routes, route.spec)
+		}
+	}
+
+	routes_.replace(controllers, newRoutes)
+
+	discoveryMutex.Lock()
+	discoveryResult_.Running = false
+	discoveryResult_.FinishedAt = time.Now()
+	discoveryResult_.Controllers = results
+	discoveryResult_.Conflicts = conflicts
+	discoveryMutex.Unlock()
+
+	logger.Infof("Discovery finished : %v routes, %v conflicts", len(newRoutes), len(conflicts))
+}
+
+func probeController(ctx context.Context, controller *Controller, firstId int, lastId int) ([]int, ControllerDiscovery) {
+	startTime := time.Now()
+
+	result := ControllerDiscovery{
+		Name:      controller.name,
+		Routes:    make([]string, 0),
+		FailedIds: make([]string, 0),
+	}
+	owned := make([]int, 0)
+
+	for id := firstId; id <= lastId; id++ {
+		if ctx.Err() != nil {
+			result.LastError = ctx.Err().Error()
+			break
+		}
+
+		cmdCtx, cancel := context.WithTimeout(ctx, commandTimeOut_)
+		code, _, err := controller.queue.submit(cmdCtx, "C"+zeroPad(id))
+		cancel()
+
+		result.ProbedIds++
+		if err == nil {
+			owned = append(owned, id)
+		} else if code == ERROR_UNKNOWN_CMD {
+			result.Unknown++
+		} else {
+			result.FailedIds = append(result.FailedIds, zeroPad(id))
+			result.LastError = err.Error()
+		}
+	}
+
+	result.Owned = len(owned)
+	result.ElapsedSec = int(time.Since(startTime).Seconds())
+	return owned, result
+}
+
+// compressIds turns sorted ids into routes of consecutive ranges
+func compressIds(ids []int) []Route {
+	routes := make([]Route, 0)
+
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+
+		spec := strconv.Itoa(ids[i])
+		if j > i {
+			spec += "-" + strconv.Itoa(ids[j])
+		}
+		routes = append(routes, Route{spec: spec, first: ids[i], last: ids[j]})
+		i = j + 1
+	}
+	return routes
+}
+
+func lastDiscovery() DiscoveryResult {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+
+	return discoveryResult_
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCompressIds(t *testing.T) {
+	tests := []struct {
+		name  string
+		ids   []int
+		specs []string
+	}{
+		{"none", nil, []string{}},
+		{"single", []int{7}, []string{"7"}},
+		{"range", []int{0, 1, 2, 3}, []string{"0-3"}},
+		{"gaps", []int{0, 1, 3, 5, 6, 7, 10}, []string{"0-1", "3", "5-7", "10"}},
+		{"rack", []int{200, 201, 202, 299}, []string{"200-202", "299"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routes := compressIds(tt.ids)
+
+			specs := make([]string, 0)
+			for _, route := range routes {
+				first, last, err := parseRoute(route.spec)
+				if err != nil || first != route.first || last != route.last {
+					t.Errorf("route %q is %v~%v, parsed as %v~%v (err %v)", route.spec, route.first, route.last, first, last, err)
+				}
+				specs = append(specs, route.spec)
+			}
+			if !reflect.DeepEqual(specs, tt.specs) {
+				t.Errorf("compressIds(%v) = %v, want %v", tt.ids, specs, tt.specs)
+			}
+		})
+	}
+}
+
+// ownerOf answers the status of the workstations first~last, 9 for the others
+func ownerOf(first int, last int) MemoryResponder {
+	return func(data []byte) []byte {
+		id, err := strconv.Atoi(string(data[1:]))
+		if err != nil || id < first || id > last {
+			return []byte("9\r\n")
+		}
+		return []byte("1\r\n")
+	}
+}
+
+func TestDiscoverRoutes(t *testing.T) {
+	routes := routes_
+	routes_ = &RoutingTable{}
+	t.Cleanup(func() {
+		routes_ = routes
+	})
+
+	// NOTE : Ids 4 and 5 are answered by both controllers
+	var controllers []*Controller
+	for _, owner := range []struct {
+		name  string
+		first int
+		last  int
+	}{
+		{"a", 0, 5},
+		{"b", 4, 9},
+		{"c", 20, 30},
+	} {
+		pwctl, _ := newMemoryPwCtrl(t, ownerOf(owner.first, owner.last))
+		controller := NewController(owner.name, pwctl)
+		controller.start(context.Background())
+		t.Cleanup(controller.stop)
+		controllers = append(controllers, controller)
+	}
+
+	// A route of another controller is kept
+	other := &Controller{name: "other"}
+	routes_.add("100-199", other)
+
+	if !beginDiscovery(0, 11) {
+		t.Fatal("discovery already running")
+	}
+	if beginDiscovery(0, 11) {
+		t.Error("second discovery started")
+	}
+	discoverRoutes(context.Background(), controllers, 0, 11)
+
+	result := lastDiscovery()
+	if result.Running {
+		t.Error("discovery still running")
+	}
+	if want := []string{"0004 : a, b", "0005 : a, b"}; !reflect.DeepEqual(result.Conflicts, want) {
+		t.Errorf("conflicts = %v, want %v", result.Conflicts, want)
+	}
+
+	wantRoutes := [][]string{{"0-5"}, {"6-9"}, {}}
+	wantOwned := []int{6, 6, 0}
+	for i, controller := range controllers {
+		discovered := result.Controllers[i]
+		if !reflect.DeepEqual(discovered.Routes, wantRoutes[i]) || discovered.Owned != wantOwned[i] {
+			t.Errorf("%v : routes = %v, owned = %v, want %v, %v", controller.name, discovered.Routes, discovered.Owned, wantRoutes[i], wantOwned[i])
+		}
+		if discovered.ProbedIds != 12 || discovered.Unknown != 12-wantOwned[i] || len(discovered.FailedIds) != 0 {
+			t.Errorf("%v : probed = %v, unknown = %v, failed = %v", controller.name, discovered.ProbedIds, discovered.Unknown, discovered.FailedIds)
+		}
+		if specs := routes_.routeSpecs(controller); !reflect.DeepEqual(specs, wantRoutes[i]) {
+			t.Errorf("%v : routing table = %v, want %v", controller.name, specs, wantRoutes[i])
+		}
+	}
+
+	for id, want := range map[int]*Controller{4: controllers[0], 6: controllers[1], 10: nil, 25: nil, 150: other} {
+		if controller := routes_.lookup(id); controller != want {
+			t.Errorf("lookup(%v) = %v, want %v", id, controller, want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Driver speaks the protocol of the power-controller hardware over the
+// transport of PwCtrl, or over the network to each workstation.
+// Every driver takes the MCU commands (S/Q/E/C with the 4-digit
+// workstation id) and answers with an MCU response code, so the REST API,
+// the queue, verify and discovery work the same on any board.
+// A reload compares the drivers with reflect.DeepEqual to reopen.
+type Driver interface {
+	// Exchange runs the command and returns the response code before the
+	// deadline. For a driver using the port, the caller holds portMutex and
+	// has cleared the input buffer. A network driver runs without portMutex,
+	// concurrently for different workstations, and leaves PwCtrl alone.
+	Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error)
+	Name() string
+	// UsesPort is false for a driver which reaches each workstation over
+	// the network by itself, its controller opens no port
+	UsesPort() bool
+}
+
+const DRIVER_MCU = "mcu"
+const DRIVER_MODBUS = "modbus"
+const DRIVER_WOL = "wol"
+const DRIVER_IPMI = "ipmi"
+const DRIVER_REDFISH = "redfish"
+const DRIVER_SNMP = "snmp"
+
+// WorkstationConfig is a workstation in the inventory of a controller,
+// for the drivers which reach each workstation over the network
+type WorkstationConfig struct {
+	Id int `yaml:"id"`
+	// Wake-on-LAN : MAC address and broadcast address (port 9 by default)
+	Mac       string `yaml:"mac"`
+	Broadcast string `yaml:"broadcast"`
+	// wol : address checked for reachability, <host>[:<tcp port>]
+	// ipmi : address of the BMC, <host>[:<udp port>]
+	// redfish : address of the BMC, [http(s)://]<host>[:<port>], https by default
+	Host string `yaml:"host"`
+	// Credentials of the BMC
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// IPMI : privilege level of the session, operator (default) or administrator
+	Privilege string `yaml:"privilege"`
+	// Redfish : path of the ComputerSystem (ex: /redfish/v1/Systems/1),
+	// the first member of /redfish/v1/Systems by default
+	System string `yaml:"system"`
+	// Redfish : accept the self-signed certificate of the BMC
+	Insecure bool `yaml:"insecure"`
+	// SNMP : outlet of the PDU feeding the workstation, from 1
+	Outlet int `yaml:"outlet"`
+}
+
+// newDriver returns the driver of the controller configuration
+func (cc ControllerConfig) newDriver() (Driver, error) {
+	switch strings.ToLower(cc.Driver) {
+	case "", DRIVER_MCU:
+		return McuDriver{}, nil
+	case DRIVER_MODBUS:
+		return cc.Modbus.driver()
+	case DRIVER_WOL:
+		return wolDriver(cc.Workstations)
+	case DRIVER_IPMI:
+		return ipmiDriver(cc.Workstations)
+	case DRIVER_REDFISH:
+		return redfishDriver(cc.Workstations)
+	case DRIVER_SNMP:
+		return cc.Snmp.driver(cc.Workstations)
+	}
+	return nil, errors.New(cc.Name + " : unknown driver : " + cc.Driver)
+}
+
+// parseCommand splits the MCU command into the letter and the workstation id
+func parseCommand(cmdStr string) (byte, int, error) {
+	if len(cmdStr) != 5 {
+		return 0, 0, errors.New("invalid command : " + cmdStr)
+	}
+
+	id, err := strconv.Atoi(cmdStr[1:])
+	if err != nil || id < 0 {
+		return 0, 0, errors.New("invalid workstation id : " + cmdStr)
+	}
+	return cmdStr[0], id, nil
+}
+
+//---------------------------------------------------------
+// MCU driver (S/Q/E/C commands, CRLF-terminated code)
+//---------------------------------------------------------
+
+// McuDriver is the protocol of the custom power-controller MCU
+type McuDriver struct{}
+
+func (d McuDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	pwctl.frames.discard()
+	err := pwctl.write([]byte(cmdStr))
+	if err != nil {
+		return "", ERROR_WRITING, err
+	}
+
+	// NOTE : Some sleep before reading, adapted to the response latency of the MCU
+	time.Sleep(pwctl.latency.settleDelay(commandPriority(cmdStr)))
+
+	frame, code, err := pwctl.frames.readFrame(deadline, pwctl.readMinByte)
+	if err != nil {
+		return "", code, err
+	}
+	return string(frame), SUCCESS, nil
+}
+
+func (d McuDriver) Name() string {
+	return DRIVER_MCU
+}
+
+func (d McuDriver) UsesPort() bool {
+	return true
+}
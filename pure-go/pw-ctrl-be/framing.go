@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var frameDelimiter = []byte("\r\n")
+
+// ReadDeadlines is how long a response is waited for, per command type.
+// Power actions take longer on the MCU than status checks.
+type ReadDeadlines struct {
+	status time.Duration
+	power  time.Duration
+	// NOTE : Boot output of the MCU is dropped for up to this long after opening
+	initialize time.Duration
+}
+
+// FrameReader reads CRLF-terminated MCU responses from a transport.
+// Split reads are accumulated until the delimiter arrives, and stray bytes
+// (empty lines, noise, late answers to earlier commands) are dropped.
+type FrameReader struct {
+	transport Transport
+	pending   []byte
+}
+
+func NewFrameReader(transport Transport) *FrameReader {
+	return &FrameReader{transport: transport}
+}
+
+// discard drops the bytes left over from earlier commands
+func (f *FrameReader) discard() {
+	f.pending = f.pending[:0]
+}
+
+// readFrame returns the last complete frame without the delimiter as soon
+// as one has arrived, even if it is shorter than minBytes.
+// ERROR_NO_DATA_READ is returned if nothing arrived before the deadline,
+// ERROR_INCOMPLETE_FRAME if bytes arrived but the delimiter did not.
+func (f *FrameReader) readFrame(deadline time.Time, minBytes int) ([]byte, int, error) {
+	buff := make([]byte, 64)
+	// NOTE : Only the bytes read for this command count, not the pending ones
+	received := 0
+
+	for {
+		if frame, ok := f.nextFrame(); ok {
+			return frame, SUCCESS, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if len(f.pending) == 0 {
+				return nil, ERROR_NO_DATA_READ, errors.New("ERROR : no data read")
+			}
+			errMesg := "ERROR : incomplete response : " + string(f.pending)
+			if received < minBytes {
+				errMesg += " (" + strconv.Itoa(received) + " of " + strconv.Itoa(minBytes) + " bytes received)"
+			}
+			return nil, ERROR_INCOMPLETE_FRAME, errors.New(errMesg)
+		}
+
+		// NOTE : A read blocks no longer than the deadline of the command
+		err := f.transport.SetReadTimeout(remaining)
+		if err != nil {
+			return nil, ERROR_READING, err
+		}
+
+		n, err := f.transport.Read(buff)
+		if err != nil {
+			return nil, ERROR_READING, err
+		}
+		received += n
+		f.pending = append(f.pending, buff[:n]...)
+	}
+}
+
+// drain drops the bytes sent without a command, such as the boot output
+// of the MCU, until nothing arrives for the quiet period or the deadline passes
+func (f *FrameReader) drain(deadline time.Time, quiet time.Duration) error {
+	buff := make([]byte, 64)
+	defer f.discard()
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+
+		err := f.transport.SetReadTimeout(min(quiet, remaining))
+		if err != nil {
+			return err
+		}
+
+		n, err := f.transport.Read(buff)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// nextFrame cuts the first non-empty frame out of the pending bytes.
+// If several complete frames are pending the last one is the answer
+// to the current command and the earlier ones are dropped.
+func (f *FrameReader) nextFrame() ([]byte, bool) {
+	var frame []byte
+	found := false
+
+	for {
+		idx := bytes.Index(f.pending, frameDelimiter)
+		if idx < 0 {
+			break
+		}
+
+		candidate := trimFrame(f.pending[:idx])
+		f.pending = f.pending[idx+len(frameDelimiter):]
+		if len(candidate) > 0 {
+			frame = candidate
+			found = true
+		}
+	}
+
+	return frame, found
+}
+
+// trimFrame removes control characters and noise around the frame
+func trimFrame(raw []byte) []byte {
+	frame := make([]byte, 0, len(raw))
+	for _, b := range raw {
+		if b > ' ' && b < 0x7f {
+			frame = append(frame, b)
+		}
+	}
+	return frame
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		pending  string
+		reads    []string
+		minBytes int
+		frame    string
+		code     int
+		err      string
+	}{
+		{"short reply", "", []string{"1\r\n"}, 64, "1", SUCCESS, ""},
+		{"split reply", "", []string{"1", "\r", "\n"}, 64, "1", SUCCESS, ""},
+		{"empty lines first", "", []string{"\r\n", "\r\n0\r\n"}, 0, "0", SUCCESS, ""},
+		{"last of several frames", "", []string{"0\r\n3\r\n"}, 0, "3", SUCCESS, ""},
+		{"pending frame", "2\r\n", nil, 64, "2", SUCCESS, ""},
+		{"no reply", "", nil, 8, "", ERROR_NO_DATA_READ, "no data read"},
+		{"no delimiter", "", []string{"1"}, 0, "", ERROR_INCOMPLETE_FRAME, "incomplete response : 1"},
+		{"fewer bytes than minBytes", "", []string{"1", "2"}, 8, "", ERROR_INCOMPLETE_FRAME, "(2 of 8 bytes received)"},
+		// NOTE : Bytes pending from before are not received for this command
+		{"pending bytes not counted", "12", []string{"3"}, 4, "", ERROR_INCOMPLETE_FRAME, "123 (1 of 4 bytes received)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewMemoryTransport("mem0", nil, testDeadline)
+			transport.Open()
+			defer transport.Close()
+
+			for i, chunk := range tt.reads {
+				chunk := chunk
+				time.AfterFunc(time.Duration(i)*testDeadline/10, func() {
+					transport.Inject([]byte(chunk))
+				})
+			}
+
+			frames := NewFrameReader(transport)
+			frames.pending = []byte(tt.pending)
+			start := time.Now()
+			frame, code, err := frames.readFrame(start.Add(testDeadline), tt.minBytes)
+			elapsed := time.Since(start)
+
+			if code != tt.code || string(frame) != tt.frame {
+				t.Fatalf("frame = %q, code = %v, err = %v, want %q, %v", frame, code, err, tt.frame, tt.code)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			// A complete frame returns at once, without waiting for minBytes
+			if code == SUCCESS && elapsed >= testDeadline/2 {
+				t.Errorf("returned after %v, deadline %v", elapsed, testDeadline)
+			}
+		})
+	}
+}
+
+func TestSetCommandShortReply(t *testing.T) {
+	pwctl, _ := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	pwctl.readMinByte = 64
+	pwctl.readDeadlines = ReadDeadlines{status: 5 * time.Second, power: 5 * time.Second}
+
+	start := time.Now()
+	code, response, err := runCommand(pwctl, "C0001")
+	elapsed := time.Since(start)
+
+	if code != SUCCESS || response != "1" {
+		t.Fatalf("code = %v, response = %q, err = %v", code, response, err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("returned after %v, want well before the 5s deadline", elapsed)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// Uevent is a kernel device event, ex) a USB serial board plugged or unplugged
+type Uevent struct {
+	Action    string            `json:"action"`
+	DevPath   string            `json:"devPath"`
+	Subsystem string            `json:"subsystem"`
+	DevName   string            `json:"devName"`
+	Env       map[string]string `json:"env"`
+}
+
+var hotplugEnabled_ = true
+var hotplugAllowInject_ = false
+
+// parseUevent parses a kernel uevent message
+// "add@/devices/...\0ACTION=add\0DEVPATH=...\0SUBSYSTEM=tty\0DEVNAME=ttyACM0\0..."
+func parseUevent(msg []byte) (Uevent, bool) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		// NOTE : Messages of udev start with "libudev" and are not used
+		return Uevent{}, false
+	}
+
+	ev := Uevent{Env: make(map[string]string)}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(string(field), "=")
+		if found {
+			ev.Env[key] = value
+		}
+	}
+	ev.Action = ev.Env["ACTION"]
+	ev.DevPath = ev.Env["DEVPATH"]
+	ev.Subsystem = ev.Env["SUBSYSTEM"]
+	ev.DevName = ev.Env["DEVNAME"]
+	return ev, ev.Action != ""
+}
+
+// handleUevent marks a controller down as soon as its tty is removed and
+// retries the disconnected controllers right away when a tty is added
+func handleUevent(ev Uevent) {
+	if ev.Subsystem != "tty" || ev.DevName == "" {
+		return
+	}
+
+	device := ev.DevName
+	if !strings.HasPrefix(device, "/") {
+		device = "/dev/" + device
+	}
+
+	switch ev.Action {
+	case "remove":
+		for _, controller := range controllerList() {
+			controller.pwctl.deviceRemoved(device)
+		}
+	case "add":
+		for _, controller := range controllerList() {
+			controller.pwctl.deviceAdded(device)
+		}
+	}
+}
+
+// injectUevent handles a synthetic uevent as if it came from the kernel
+func injectUevent(ev Uevent) error {
+	if !hotplugAllowInject_ {
+		return errors.New("uevent injection is not allowed (hotplug.allowInject)")
+	}
+	if ev.Action != "add" && ev.Action != "remove" {
+		return errors.New("invalid uevent action : " + ev.Action)
+	}
+	if ev.Subsystem == "" {
+		ev.Subsystem = "tty"
+	}
+
+	logger.Infof("Injected uevent : %v %v", ev.Action, ev.DevName)
+	handleUevent(ev)
+	return nil
+}
+
+func (pwctl *PwCtrl) deviceRemoved(device string) {
+	pwctl.portMutex.Lock()
+	defer pwctl.portMutex.Unlock()
+
+	if pwctl.closed || pwctl.portName != device {
+		return
+	}
+
+	logger.Info("Serial port removed : ", device)
+	if pwctl.transport != nil {
+		pwctl.transport.Close()
+		pwctl.transport = nil
+	}
+	pwctl.startReIntializing(errors.New("device removed : " + device))
+}
+
+func (pwctl *PwCtrl) deviceAdded(device string) {
+	pwctl.portMutex.Lock()
+	defer pwctl.portMutex.Unlock()
+
+	if pwctl.closed || pwctl.standby || pwctl.connectInitialized || !pwctl.portSelector.mayMatch(device) {
+		return
+	}
+
+	logger.Info("Serial port added : ", device)
+	pwctl.reconnect.resetBackoff()
+	if pwctl.reIntializing {
+		pwctl.wakeReconnect()
+	} else {
+		pwctl.reIntializing = true
+		go pwctl.reIntializeConnection()
+	}
+}
+
+// wakeReconnect ends the backoff wait of the re-initializing goroutine
+func (pwctl *PwCtrl) wakeReconnect() {
+	select {
+	case pwctl.reconnectWake <- struct{}{}:
+	default:
+	}
+}
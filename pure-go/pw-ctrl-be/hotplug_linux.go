@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// NOTE : Multicast group of the kernel uevents
+const UEVENT_KERNEL_GROUP = 1
+
+// watchHotplug subscribes to the kernel uevents over netlink
+func watchHotplug() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Pid:    0,
+		Groups: UEVENT_KERNEL_GROUP,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buff := make([]byte, 64*1024)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buff, 0)
+			if err != nil {
+				if err == syscall.EINTR || err == syscall.ENOBUFS {
+					continue
+				}
+				logger.Info("Stopped watching uevents : ", err.Error())
+				return
+			}
+
+			ev, ok := parseUevent(buff[:n])
+			if ok {
+				handleUevent(ev)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchHotplug is only available on linux, ports are still
+// reopened by the reconnect backoff
+func watchHotplug() error {
+	return errors.New("uevents are not supported on this platform")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const ueventTtyAdd = "add@/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/tty/ttyACM0\x00" +
+	"ACTION=add\x00" +
+	"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0/tty/ttyACM0\x00" +
+	"SUBSYSTEM=tty\x00" +
+	"MAJOR=166\x00" +
+	"MINOR=0\x00" +
+	"DEVNAME=ttyACM0\x00" +
+	"SEQNUM=4711\x00"
+
+// NOTE : udev sends "libudev", a binary header and the properties again
+const ueventLibudev = "libudev\x00\xfe\xed\xca\xfe\x28\x00\x00\x00\x28\x00\x00\x00\x9a\x00\x00\x00" +
+	"ACTION=add\x00DEVPATH=/devices/virtual/tty/ttyACM0\x00SUBSYSTEM=tty\x00DEVNAME=/dev/ttyACM0\x00"
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		ok        bool
+		action    string
+		subsystem string
+		devName   string
+	}{
+		{"kernel add", ueventTtyAdd, true, "add", "tty", "ttyACM0"},
+		{"kernel remove", "remove@/devices/virtual/tty/ttyUSB1\x00ACTION=remove\x00SUBSYSTEM=tty\x00DEVNAME=ttyUSB1", true, "remove", "tty", "ttyUSB1"},
+		{"kernel usb", "bind@/devices/usb1/1-2\x00ACTION=bind\x00SUBSYSTEM=usb\x00DEVTYPE=usb_device", true, "bind", "usb", ""},
+		{"libudev", ueventLibudev, false, "", "", ""},
+		{"empty", "", false, "", "", ""},
+		{"header only", "add@/devices/virtual/tty/ttyACM0", false, "", "", ""},
+		{"truncated before action", "add@/devices/virtual/tty/ttyACM0\x00DEVPATH=/devices/virtual/tt", false, "", "", ""},
+		{"truncated in a field", "remove@/devices/virtual/tty/ttyACM0\x00ACTION=remove\x00SUBSYSTEM=tty\x00DEVNA", true, "remove", "tty", ""},
+		{"empty action", "add@/x\x00ACTION=\x00SUBSYSTEM=tty", false, "", "tty", ""},
+		{"garbage", "\xff\x13=\x00\x00==\x00\x01\x02", false, "", "", ""},
+		{"garbage with @", "@@@\x00===\x00\xff\xfe", false, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, ok := parseUevent([]byte(tt.msg))
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v (%+v)", ok, tt.ok, ev)
+			}
+			if ev.Action != tt.action || ev.Subsystem != tt.subsystem || ev.DevName != tt.devName {
+				t.Errorf("got %q %q %q, want %q %q %q",
+					ev.Action, ev.Subsystem, ev.DevName, tt.action, tt.subsystem, tt.devName)
+			}
+		})
+	}
+}
+
+// pluggablePwCtrl returns the only controller, connected to ttyACM0 in
+// memory. The device cannot be opened while unplugged.
+func pluggablePwCtrl(t *testing.T) (*PwCtrl, *atomic.Bool) {
+	t.Helper()
+
+	initial, maximum := reconnectInitial_, reconnectMax_
+	// NOTE : Only a hotplug event can end the backoff within the test
+	reconnectInitial_, reconnectMax_ = time.Minute, time.Minute
+	t.Cleanup(func() {
+		reconnectInitial_, reconnectMax_ = initial, maximum
+		setControllerList(nil)
+	})
+
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	plugged := &atomic.Bool{}
+	plugged.Store(true)
+
+	pwctl.portMutex.Lock()
+	pwctl.portSelector = PortSelector{prefix: []string{"/dev/ttyACM"}}
+	pwctl.newTransport = func(pwctl *PwCtrl) (Transport, int, error) {
+		if !plugged.Load() {
+			return nil, ERROR_NO_PORT_FOUND, errors.New("no serial port found")
+		}
+		pwctl.portName = "/dev/ttyACM0"
+		return transport, SUCCESS, nil
+	}
+	_, err := pwctl.intializeConnection()
+	pwctl.portMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setControllerList([]*Controller{NewController("rack0", pwctl)})
+	return pwctl, plugged
+}
+
+// waitConnection waits for the connection state of the controller
+func waitConnection(t *testing.T, pwctl *PwCtrl, state ConnectionState) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for pwctl.reconnect.snapshot().State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %v, want %v", pwctl.reconnect.snapshot().State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleUeventRemove(t *testing.T) {
+	tests := []struct {
+		name      string
+		ev        Uevent
+		connected bool
+	}{
+		{"our tty", Uevent{Action: "remove", Subsystem: "tty", DevName: "ttyACM0"}, false},
+		{"our tty by path", Uevent{Action: "remove", Subsystem: "tty", DevName: "/dev/ttyACM0"}, false},
+		{"another tty", Uevent{Action: "remove", Subsystem: "tty", DevName: "ttyACM1"}, true},
+		{"not a tty", Uevent{Action: "remove", Subsystem: "usb", DevName: "ttyACM0"}, true},
+		{"no device name", Uevent{Action: "remove", Subsystem: "tty"}, true},
+		{"other action", Uevent{Action: "change", Subsystem: "tty", DevName: "ttyACM0"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pwctl, plugged := pluggablePwCtrl(t)
+
+			plugged.Store(false)
+			handleUevent(tt.ev)
+
+			if pwctl.connected() != tt.connected {
+				t.Errorf("connected = %v, want %v", pwctl.connected(), tt.connected)
+			}
+		})
+	}
+}
+
+func TestHandleUeventAddReconnects(t *testing.T) {
+	pwctl, plugged := pluggablePwCtrl(t)
+
+	plugged.Store(false)
+	handleUevent(Uevent{Action: "remove", Subsystem: "tty", DevName: "ttyACM0"})
+	waitConnection(t, pwctl, CONNECTION_BACKOFF)
+
+	// NOTE : A device which cannot be the port does not end the backoff
+	plugged.Store(true)
+	handleUevent(Uevent{Action: "add", Subsystem: "tty", DevName: "ttyUSB0"})
+	time.Sleep(100 * time.Millisecond)
+	if pwctl.connected() {
+		t.Fatal("reconnected on the add of ttyUSB0")
+	}
+
+	ev, ok := parseUevent([]byte(ueventTtyAdd))
+	if !ok {
+		t.Fatal("kernel add not parsed")
+	}
+	handleUevent(ev)
+	waitConnection(t, pwctl, CONNECTION_CONNECTED)
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------
+// IPMI v2.0 over LAN (RMCP+) driver for BMCs
+//---------------------------------------------------------
+
+// RMCP+ session and IPMI message constants
+const (
+	RMCP_VERSION        = 0x06
+	RMCP_NO_ACK         = 0xff
+	RMCP_CLASS_IPMI     = 0x07
+	IPMI_AUTH_RMCP_PLUS = 0x06
+
+	IPMI_PAYLOAD_IPMI                  = 0x00
+	IPMI_PAYLOAD_OPEN_SESSION_REQUEST  = 0x10
+	IPMI_PAYLOAD_OPEN_SESSION_RESPONSE = 0x11
+	IPMI_PAYLOAD_RAKP1                 = 0x12
+	IPMI_PAYLOAD_RAKP2                 = 0x13
+	IPMI_PAYLOAD_RAKP3                 = 0x14
+	IPMI_PAYLOAD_RAKP4                 = 0x15
+	IPMI_PAYLOAD_ENCRYPTED             = 0x80
+	IPMI_PAYLOAD_AUTHENTICATED         = 0x40
+	IPMI_PAYLOAD_TYPE_MASK             = 0x3f
+
+	IPMI_NETFN_CHASSIS   = 0x00
+	IPMI_NETFN_APP       = 0x06
+	IPMI_CHASSIS_STATUS  = 0x01
+	IPMI_CHASSIS_CONTROL = 0x02
+	IPMI_CLOSE_SESSION   = 0x3c
+
+	IPMI_CHASSIS_POWER_DOWN    = 0x00
+	IPMI_CHASSIS_POWER_UP      = 0x01
+	IPMI_CHASSIS_SOFT_SHUTDOWN = 0x05
+
+	// NOTE : Chassis control needs the operator privilege at least
+	IPMI_PRIVILEGE_OPERATOR      = 0x03
+	IPMI_PRIVILEGE_ADMINISTRATOR = 0x04
+	IPMI_NAME_ONLY_LOOKUP        = 0x10
+	IPMI_BMC_ADDRESS             = 0x20
+	IPMI_CONSOLE_ADDRESS         = 0x81
+)
+
+const IPMI_PORT = "623"
+
+// Cipher suite 3 : RAKP-HMAC-SHA1, HMAC-SHA1-96, AES-CBC-128
+var ipmiCipherSuite = []byte{
+	0x00, 0, 0, 0x08, 0x01, 0, 0, 0,
+	0x01, 0, 0, 0x08, 0x01, 0, 0, 0,
+	0x02, 0, 0, 0x08, 0x01, 0, 0, 0,
+}
+
+// NOTE : UDP, a request is sent again if no response arrives within this
+var ipmiRetryInterval_ = 1 * time.Second
+
+// IpmiTarget is the BMC of a workstation
+type IpmiTarget struct {
+	address   string
+	user      string
+	password  string
+	privilege byte
+}
+
+// IpmiDriver controls the chassis power of the workstations of its
+// inventory through their BMCs. Every command runs in its own session.
+//   - S : chassis control power up, answered with 3 (being turned on)
+//   - Q : chassis control soft shutdown (ACPI), answered with 2
+//   - E : chassis control power down, answered with 2
+//   - C : chassis status, answered with 0 or 1
+//
+// A workstation not in the inventory is answered with 9.
+type IpmiDriver struct {
+	targets map[int]IpmiTarget
+}
+
+// ipmiDriver validates the inventory and returns the driver
+func ipmiDriver(workstations []WorkstationConfig) (Driver, error) {
+	if len(workstations) == 0 {
+		return nil, errors.New("ipmi : no workstations")
+	}
+
+	d := IpmiDriver{targets: make(map[int]IpmiTarget)}
+	for _, ws := range workstations {
+		id := strconv.Itoa(ws.Id)
+		if _, found := d.targets[ws.Id]; found {
+			return nil, errors.New("ipmi : duplicate workstation : " + id)
+		}
+		if ws.Host == "" {
+			return nil, errors.New("ipmi : workstation " + id + " : no host")
+		}
+		// NOTE : The user name is 16 bytes at most, the password 20 bytes
+		if len(ws.User) > 16 || len(ws.Password) > 20 {
+			return nil, errors.New("ipmi : workstation " + id + " : user or password too long")
+		}
+
+		var privilege byte
+		switch strings.ToLower(ws.Privilege) {
+		case "", "operator":
+			privilege = IPMI_PRIVILEGE_OPERATOR
+		case "administrator":
+			privilege = IPMI_PRIVILEGE_ADMINISTRATOR
+		default:
+			return nil, errors.New("ipmi : workstation " + id + " : invalid privilege : " + ws.Privilege + " (operator or administrator)")
+		}
+
+		d.targets[ws.Id] = IpmiTarget{
+			address:   withDefaultPort(ws.Host, IPMI_PORT),
+			user:      ws.User,
+			password:  ws.Password,
+			privilege: privilege,
+		}
+	}
+	return d, nil
+}
+
+func (d IpmiDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	letter, id, err := parseCommand(cmdStr)
+	if err != nil {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	target, found := d.targets[id]
+	if !found {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	var control byte
+	var response byte
+	switch letter {
+	case 'S':
+		control, response = IPMI_CHASSIS_POWER_UP, CODE_TURNING_ON
+	case 'Q':
+		control, response = IPMI_CHASSIS_SOFT_SHUTDOWN, CODE_TURNING_OFF
+	case 'E':
+		control, response = IPMI_CHASSIS_POWER_DOWN, CODE_TURNING_OFF
+	case 'C':
+	default:
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	session, err := openIpmiSession(target, deadline)
+	if err != nil {
+		return "", ERROR_NETWORK, err
+	}
+	defer session.close()
+
+	if letter == 'C' {
+		data, err := session.request(IPMI_NETFN_CHASSIS, IPMI_CHASSIS_STATUS, nil)
+		if err != nil {
+			return "", ERROR_NETWORK, err
+		}
+		if len(data) == 0 {
+			return "", ERROR_NETWORK, errors.New("IPMI : empty chassis status from " + target.address)
+		}
+		// NOTE : Bit 0 of the current power state is power on
+		if data[0]&0x01 != 0 {
+			return string(CODE_ON), SUCCESS, nil
+		}
+		return string(CODE_OFF), SUCCESS, nil
+	}
+
+	_, err = session.request(IPMI_NETFN_CHASSIS, IPMI_CHASSIS_CONTROL, []byte{control})
+	if err != nil {
+		return "", ERROR_NETWORK, err
+	}
+	return string(response), SUCCESS, nil
+}
+
+func (d IpmiDriver) Name() string {
+	return DRIVER_IPMI
+}
+
+func (d IpmiDriver) UsesPort() bool {
+	return false
+}
+
+//---------------------------------------------------------
+// RMCP+ session
+//---------------------------------------------------------
+
+// IpmiSession is an RMCP+ session with a BMC, opened with the RAKP
+// handshake. The messages are authenticated with K1 and encrypted with K2.
+type IpmiSession struct {
+	conn     net.Conn
+	address  string
+	deadline time.Time
+
+	consoleId uint32
+	bmcId     uint32
+	sequence  uint32
+	rqSeq     byte
+	k1        []byte
+	k2        []byte
+}
+
+// openIpmiSession runs the open session request and RAKP 1~4
+func openIpmiSession(target IpmiTarget, deadline time.Time) (*IpmiSession, error) {
+	conn, err := net.Dial("udp", target.address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &IpmiSession{conn: conn, address: target.address, deadline: deadline}
+	err = s.handshake(target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *IpmiSession) handshake(target IpmiTarget) error {
+	random := ipmiRandom(4)
+	s.consoleId = binary.LittleEndian.Uint32(random) | 1
+	tag := random[0]
+
+	// Open session
+	payload := []byte{tag, target.privilege, 0, 0}
+	payload = binary.LittleEndian.AppendUint32(payload, s.consoleId)
+	payload = append(payload, ipmiCipherSuite...)
+
+	response, err := s.handshakeStep(IPMI_PAYLOAD_OPEN_SESSION_REQUEST, payload, IPMI_PAYLOAD_OPEN_SESSION_RESPONSE, tag, 12)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(response[4:8]) != s.consoleId {
+		return errors.New("IPMI : open session : wrong session id from " + s.address)
+	}
+	s.bmcId = binary.LittleEndian.Uint32(response[8:12])
+
+	// RAKP 1, 2 : the BMC proves it knows the password
+	rm := ipmiRandom(16)
+	role := target.privilege | IPMI_NAME_ONLY_LOOKUP
+	user := []byte(target.user)
+	kuid := []byte(target.password)
+
+	payload = []byte{tag, 0, 0, 0}
+	payload = binary.LittleEndian.AppendUint32(payload, s.bmcId)
+	payload = append(payload, rm...)
+	payload = append(payload, role, 0, 0, byte(len(user)))
+	payload = append(payload, user...)
+
+	response, err = s.handshakeStep(IPMI_PAYLOAD_RAKP1, payload, IPMI_PAYLOAD_RAKP2, tag, 60)
+	if err != nil {
+		return err
+	}
+	rc := response[8:24]
+	guid := response[24:40]
+
+	authCode := ipmiHmac(kuid, le32(s.consoleId), le32(s.bmcId), rm, rc, guid, []byte{role, byte(len(user))}, user)
+	if !hmac.Equal(authCode, response[40:60]) {
+		return errors.New("IPMI : RAKP 2 : wrong password for " + target.user + "@" + s.address)
+	}
+
+	var sik []byte
+	sik, s.k1, s.k2 = ipmiSessionKeys(kuid, rm, rc, role, user)
+
+	// RAKP 3, 4 : the console proves it knows the password
+	payload = []byte{tag, 0, 0, 0}
+	payload = binary.LittleEndian.AppendUint32(payload, s.bmcId)
+	payload = append(payload, ipmiHmac(kuid, rc, le32(s.consoleId), []byte{role, byte(len(user))}, user)...)
+
+	response, err = s.handshakeStep(IPMI_PAYLOAD_RAKP3, payload, IPMI_PAYLOAD_RAKP4, tag, 20)
+	if err != nil {
+		return err
+	}
+
+	icv := ipmiHmac(sik, rm, le32(s.bmcId), guid)[:12]
+	if !hmac.Equal(icv, response[8:20]) {
+		return errors.New("IPMI : RAKP 4 : integrity check failed for " + s.address)
+	}
+	return nil
+}
+
+// handshakeStep sends a session setup payload and returns the response
+// payload after checking its tag, status code and length
+func (s *IpmiSession) handshakeStep(payloadType byte, payload []byte, responseType byte, tag byte, length int) ([]byte, error) {
+	packet := rmcpHeader()
+	packet = append(packet, IPMI_AUTH_RMCP_PLUS, payloadType)
+	// NOTE : Session id and sequence are zero outside of a session
+	packet = append(packet, 0, 0, 0, 0, 0, 0, 0, 0)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(len(payload)))
+	packet = append(packet, payload...)
+
+	response, err := s.transact(packet, func(received []byte) ([]byte, bool) {
+		payload, ok := parseRmcpPlus(received)
+		if !ok || received[5]&IPMI_PAYLOAD_TYPE_MASK != responseType || len(payload) < 2 || payload[0] != tag {
+			return nil, false
+		}
+		return payload, true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if response[1] != 0 {
+		return nil, errors.New("IPMI : session setup (payload " + hexByte(payloadType) + ") refused by " + s.address + " : status " + hexByte(response[1]))
+	}
+	if len(response) < length {
+		return nil, errors.New("IPMI : session setup (payload " + hexByte(payloadType) + ") : short response from " + s.address)
+	}
+	return response, nil
+}
+
+// request sends an IPMI request in the session and returns the
+// response data after the completion code
+func (s *IpmiSession) request(netFn byte, command byte, data []byte) ([]byte, error) {
+	s.sequence++
+	s.rqSeq = (s.rqSeq + 1) & 0x3f
+
+	message := []byte{IPMI_BMC_ADDRESS, netFn << 2}
+	message = append(message, ipmiChecksum(message))
+	body := append([]byte{IPMI_CONSOLE_ADDRESS, s.rqSeq << 2, command}, data...)
+	message = append(message, body...)
+	message = append(message, ipmiChecksum(body))
+
+	encrypted, err := ipmiEncrypt(s.k2[:16], message)
+	if err != nil {
+		return nil, err
+	}
+
+	packet := []byte{IPMI_AUTH_RMCP_PLUS, IPMI_PAYLOAD_ENCRYPTED | IPMI_PAYLOAD_AUTHENTICATED | IPMI_PAYLOAD_IPMI}
+	packet = binary.LittleEndian.AppendUint32(packet, s.bmcId)
+	packet = binary.LittleEndian.AppendUint32(packet, s.sequence)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(len(encrypted)))
+	packet = append(packet, encrypted...)
+	packet = ipmiSign(s.k1, packet)
+	packet = append(rmcpHeader(), packet...)
+
+	var completion byte
+	response, err := s.transact(packet, func(received []byte) ([]byte, bool) {
+		payload, ok := parseRmcpPlus(received)
+		if !ok || received[5] != IPMI_PAYLOAD_ENCRYPTED|IPMI_PAYLOAD_AUTHENTICATED|IPMI_PAYLOAD_IPMI ||
+			binary.LittleEndian.Uint32(received[6:10]) != s.consoleId || !ipmiVerify(s.k1, received[4:]) {
+			return nil, false
+		}
+
+		message, err := ipmiDecrypt(s.k2[:16], payload)
+		if err != nil || len(message) < 8 || message[5] != command || message[4]>>2 != s.rqSeq {
+			return nil, false
+		}
+		if ipmiChecksum(message[:2]) != message[2] || ipmiChecksum(message[3:len(message)-1]) != message[len(message)-1] {
+			return nil, false
+		}
+
+		completion = message[6]
+		return message[7 : len(message)-1], true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if completion != 0 {
+		return nil, errors.New("IPMI : command " + hexByte(command) + " refused by " + s.address + " : completion code " + hexByte(completion))
+	}
+	return response, nil
+}
+
+// close ends the session on the BMC, it is cleaned up by the BMC
+// after a timeout anyway if the request is lost
+func (s *IpmiSession) close() {
+	s.deadline = time.Now().Add(ipmiRetryInterval_)
+	s.request(IPMI_NETFN_APP, IPMI_CLOSE_SESSION, le32(s.bmcId))
+	s.conn.Close()
+}
+
+// transact sends the packet until accept takes a received packet
+// or the deadline of the session passes
+func (s *IpmiSession) transact(packet []byte, accept func(received []byte) ([]byte, bool)) ([]byte, error) {
+	buff := make([]byte, 1024)
+
+	for time.Now().Before(s.deadline) {
+		_, err := s.conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		retryAt := time.Now().Add(ipmiRetryInterval_)
+		if retryAt.After(s.deadline) {
+			retryAt = s.deadline
+		}
+		s.conn.SetReadDeadline(retryAt)
+		for {
+			n, err := s.conn.Read(buff)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if response, ok := accept(buff[:n]); ok {
+				return response, nil
+			}
+		}
+	}
+	return nil, errors.New("IPMI : no response from " + s.address)
+}
+
+func rmcpHeader() []byte {
+	return []byte{RMCP_VERSION, 0, RMCP_NO_ACK, RMCP_CLASS_IPMI}
+}
+
+// parseRmcpPlus returns the payload of an RMCP+ packet
+func parseRmcpPlus(packet []byte) ([]byte, bool) {
+	if len(packet) < 16 || packet[0] != RMCP_VERSION || packet[3] != RMCP_CLASS_IPMI || packet[4] != IPMI_AUTH_RMCP_PLUS {
+		return nil, false
+	}
+
+	length := int(binary.LittleEndian.Uint16(packet[14:16]))
+	if len(packet) < 16+length {
+		return nil, false
+	}
+	return packet[16 : 16+length], true
+}
+
+// ipmiSign adds the integrity pad, the next header and the HMAC-SHA1-96
+// auth code to the session packet starting at the auth type
+func ipmiSign(k1 []byte, packet []byte) []byte {
+	length := len(packet)
+	for (len(packet)+2)%4 != 0 {
+		packet = append(packet, 0xff)
+	}
+	packet = append(packet, byte(len(packet)-length), RMCP_CLASS_IPMI)
+	return append(packet, ipmiHmac(k1, packet)[:12]...)
+}
+
+// ipmiVerify checks the auth code of a session packet starting at the auth type
+func ipmiVerify(k1 []byte, packet []byte) bool {
+	if len(packet) < 12 {
+		return false
+	}
+	signed := packet[:len(packet)-12]
+	return hmac.Equal(ipmiHmac(k1, signed)[:12], packet[len(packet)-12:])
+}
+
+// ipmiEncrypt encrypts with AES-CBC-128 : IV followed by the data padded
+// with 1, 2, 3, ... and the pad length
+func ipmiEncrypt(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := append([]byte(nil), data...)
+	pad := 0
+	for (len(plain)+1)%aes.BlockSize != 0 {
+		pad++
+		plain = append(plain, byte(pad))
+	}
+	plain = append(plain, byte(pad))
+
+	iv := ipmiRandom(aes.BlockSize)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+	return append(iv, encrypted...), nil
+}
+
+func ipmiDecrypt(key []byte, data []byte) ([]byte, error) {
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("IPMI : invalid encrypted payload length")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+
+	pad := int(plain[len(plain)-1])
+	if pad >= aes.BlockSize {
+		return nil, errors.New("IPMI : invalid confidentiality pad")
+	}
+	return plain[:len(plain)-1-pad], nil
+}
+
+// ipmiSessionKeys derives the session integrity key (SIK) from the password
+// and the random numbers of RAKP, then K1 for the auth codes and K2 (first
+// 16 bytes) for the encryption of the session messages
+func ipmiSessionKeys(kuid []byte, rm []byte, rc []byte, role byte, user []byte) ([]byte, []byte, []byte) {
+	sik := ipmiHmac(kuid, rm, rc, []byte{role, byte(len(user))}, user)
+	k1 := ipmiHmac(sik, bytes.Repeat([]byte{0x01}, 20))
+	k2 := ipmiHmac(sik, bytes.Repeat([]byte{0x02}, 20))
+	return sik, k1, k2
+}
+
+func ipmiHmac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// ipmiChecksum is the 2's complement of the sum of the bytes
+func ipmiChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+func ipmiRandom(n int) []byte {
+	random := make([]byte, n)
+	rand.Read(random)
+	return random
+}
+
+func hexByte(b byte) string {
+	return "0x" + hex.EncodeToString([]byte{b})
+}
+
+func le32(value uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, value)
+}
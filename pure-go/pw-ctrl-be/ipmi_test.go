@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func byteRange(first byte, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = first + byte(i)
+	}
+	return data
+}
+
+func TestIpmiSessionKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		rm       []byte
+		rc       []byte
+		role     byte
+		user     string
+		sik      string
+		k1       string
+		k2       string
+	}{
+		{
+			"operator", "secret", byteRange(0x00, 16), byteRange(0x10, 16), 0x13, "admin",
+			"393ac4faa0cab6e68ab6854e6e119a7ed676bf4d",
+			"351589d50f8210ab80df45e86c8b1143687a5317",
+			"372e0fd830c2eb7ac83daf0d5b1956a8eac8145d",
+		},
+		{
+			"anonymous", "", bytes.Repeat([]byte{0xff}, 16), make([]byte, 16), 0x14, "",
+			"e8f9245630f9b7769000179335640e21aef7cc38",
+			"7f84b0e939138e9f2fce4d3fd3ebc2f48cd0b6e9",
+			"dac2d7c96f9514d9b61086ef004a2d3d3b8d6ea9",
+		},
+		{
+			"longest user and password", "abcdefghijklmnopqrst", byteRange(0xa0, 16), byteRange(0x50, 16), 0x13, "operator-sixteen",
+			"ce3dafac344f8d9073203ad76aadd5832745eb27",
+			"0218d3026ecae7cd2e8eb187bc63308598e05f0e",
+			"cc2e0ca4f302dbeefde37c16d44ad9dc9da213e5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sik, k1, k2 := ipmiSessionKeys([]byte(tt.password), tt.rm, tt.rc, tt.role, []byte(tt.user))
+			if !bytes.Equal(sik, unhex(t, tt.sik)) {
+				t.Errorf("SIK = %x, want %v", sik, tt.sik)
+			}
+			if !bytes.Equal(k1, unhex(t, tt.k1)) {
+				t.Errorf("K1 = %x, want %v", k1, tt.k1)
+			}
+			if !bytes.Equal(k2, unhex(t, tt.k2)) {
+				t.Errorf("K2 = %x, want %v", k2, tt.k2)
+			}
+		})
+	}
+}
+
+// NOTE : RFC 2202 HMAC-SHA1 test cases truncated to 96 bits
+func TestIpmiHmacSha196(t *testing.T) {
+	tests := []struct {
+		name string
+		key  []byte
+		data [][]byte
+		want string
+	}{
+		{"rfc2202 1", bytes.Repeat([]byte{0x0b}, 20), [][]byte{[]byte("Hi There")}, "b617318655057264e28bc0b6"},
+		{"rfc2202 2", []byte("Jefe"), [][]byte{[]byte("what do ya want for nothing?")}, "effcdf6ae5eb2fa2d27416d5"},
+		{"rfc2202 2 in parts", []byte("Jefe"), [][]byte{[]byte("what do "), nil, []byte("ya want for nothing?")}, "effcdf6ae5eb2fa2d27416d5"},
+		{"rfc2202 3", bytes.Repeat([]byte{0xaa}, 20), [][]byte{bytes.Repeat([]byte{0xdd}, 50)}, "125d7342b9ac11cd91a39af4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ipmiHmac(tt.key, tt.data...)[:12]
+			if !bytes.Equal(got, unhex(t, tt.want)) {
+				t.Errorf("HMAC-SHA1-96 = %x, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIpmiSign(t *testing.T) {
+	k1 := bytes.Repeat([]byte{0x5a}, 20)
+
+	// NOTE : The pad makes the packet up to the next header a multiple of 4
+	for length, pad := range []int{2, 1, 0, 3, 2} {
+		packet := byteRange(0x01, length)
+		signed := ipmiSign(k1, append([]byte(nil), packet...))
+
+		if len(signed) != length+pad+2+12 {
+			t.Fatalf("length %v : signed %v bytes, want %v", length, len(signed), length+pad+2+12)
+		}
+		if !bytes.Equal(signed[:length], packet) {
+			t.Errorf("length %v : packet changed %x", length, signed[:length])
+		}
+		if !bytes.Equal(signed[length:length+pad], bytes.Repeat([]byte{0xff}, pad)) {
+			t.Errorf("length %v : pad %x", length, signed[length:length+pad])
+		}
+		if signed[length+pad] != byte(pad) || signed[length+pad+1] != RMCP_CLASS_IPMI {
+			t.Errorf("length %v : pad length %v, next header %#x", length, signed[length+pad], signed[length+pad+1])
+		}
+		if !bytes.Equal(signed[length+pad+2:], ipmiHmac(k1, signed[:length+pad+2])[:12]) {
+			t.Errorf("length %v : wrong auth code", length)
+		}
+
+		if !ipmiVerify(k1, signed) {
+			t.Errorf("length %v : not verified", length)
+		}
+		for i := range signed {
+			tampered := append([]byte(nil), signed...)
+			tampered[i] ^= 0x01
+			if ipmiVerify(k1, tampered) {
+				t.Errorf("length %v : verified with byte %v changed", length, i)
+			}
+		}
+		if ipmiVerify(bytes.Repeat([]byte{0xa5}, 20), signed) {
+			t.Errorf("length %v : verified with another K1", length)
+		}
+	}
+
+	if ipmiVerify(k1, make([]byte, 11)) {
+		t.Error("verified a packet shorter than the auth code")
+	}
+}
+
+func TestIpmiEncrypt(t *testing.T) {
+	key := byteRange(0x30, 16)
+
+	tests := []struct {
+		name string
+		data []byte
+		pad  []byte
+	}{
+		{"empty", nil, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 15}},
+		{"3 bytes", []byte("abc"), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 12}},
+		{"15 bytes", byteRange(0x41, 15), []byte{0}},
+		{"16 bytes", byteRange(0x41, 16), []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 15}},
+		{"chassis control", unhex(t, "2000e08104020100ff"), []byte{1, 2, 3, 4, 5, 6, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := append(append([]byte(nil), tt.data...), tt.pad...)
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encrypted, err := ipmiEncrypt(key, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encrypted) != aes.BlockSize+len(plain) {
+				t.Fatalf("encrypted %v bytes, want %v", len(encrypted), aes.BlockSize+len(plain))
+			}
+			decrypted := make([]byte, len(plain))
+			cipher.NewCBCDecrypter(block, encrypted[:aes.BlockSize]).CryptBlocks(decrypted, encrypted[aes.BlockSize:])
+			if !bytes.Equal(decrypted, plain) {
+				t.Errorf("padded = %x, want %x", decrypted, plain)
+			}
+
+			// NOTE : Encrypted by the BMC with its own IV
+			iv := byteRange(0x90, aes.BlockSize)
+			fromBmc := make([]byte, len(plain))
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(fromBmc, plain)
+			data, err := ipmiDecrypt(key, append(iv, fromBmc...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.data) && len(data)+len(tt.data) > 0 {
+				t.Errorf("decrypted = %x, want %x", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestIpmiDecryptInvalid(t *testing.T) {
+	key := byteRange(0x30, 16)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badPad := make([]byte, 2*aes.BlockSize)
+	plain := bytes.Repeat([]byte{0x10}, aes.BlockSize)
+	cipher.NewCBCEncrypter(block, badPad[:aes.BlockSize]).CryptBlocks(badPad[aes.BlockSize:], plain)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"iv only", make([]byte, aes.BlockSize)},
+		{"not a block multiple", make([]byte, 2*aes.BlockSize+3)},
+		{"pad length over a block", badPad},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ipmiDecrypt(key, tt.data)
+			if err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestIpmiChecksum(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want byte
+	}{
+		{nil, 0x00},
+		{[]byte{IPMI_BMC_ADDRESS, IPMI_NETFN_CHASSIS << 2}, 0xe0},
+		{[]byte{IPMI_BMC_ADDRESS, IPMI_NETFN_APP << 2}, 0xc8},
+		{[]byte{0x81, 0x04, 0x02, 0x01}, 0x78},
+		{[]byte{0xff, 0x01}, 0x00},
+	}
+
+	for _, tt := range tests {
+		got := ipmiChecksum(tt.data)
+		if got != tt.want {
+			t.Errorf("checksum of % x = %#x, want %#x", tt.data, got, tt.want)
+		}
+		var sum byte
+		for _, b := range append(tt.data, got) {
+			sum += b
+		}
+		if sum != 0 {
+			t.Errorf("% x with its checksum sums to %#x", tt.data, sum)
+		}
+	}
+}
+
+//---------------------------------------------------------
+// BMC stand-in on the loopback
+//---------------------------------------------------------
+
+var testBmcGuid = []byte("pwctrl-test-bmc0")
+
+type testBmcSession struct {
+	consoleId uint32
+	rm        []byte
+	rc        []byte
+	role      byte
+	user      []byte
+	k1        []byte
+	k2        []byte
+	active    bool
+}
+
+// testBmc is a BMC with one user and a chassis, over RMCP+ with cipher suite 3
+type testBmc struct {
+	conn     net.PacketConn
+	user     string
+	password string
+
+	mutex    sync.Mutex
+	power    bool
+	controls []byte
+	roles    []byte
+	sessions map[uint32]*testBmcSession
+}
+
+func newTestBmc(t *testing.T, user string, password string) *testBmc {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	bmc := &testBmc{conn: conn, user: user, password: password, sessions: make(map[uint32]*testBmcSession)}
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			bmc.mutex.Lock()
+			response := bmc.handle(buff[:n])
+			bmc.mutex.Unlock()
+			if response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return bmc
+}
+
+func (bmc *testBmc) handle(packet []byte) []byte {
+	payload, ok := parseRmcpPlus(packet)
+	if !ok {
+		return nil
+	}
+
+	switch packet[5] {
+	case IPMI_PAYLOAD_OPEN_SESSION_REQUEST:
+		bmcId := uint32(len(bmc.sessions) + 1)
+		bmc.sessions[bmcId] = &testBmcSession{consoleId: binary.LittleEndian.Uint32(payload[4:8])}
+		response := []byte{payload[0], 0, payload[1], 0}
+		response = binary.LittleEndian.AppendUint32(response, binary.LittleEndian.Uint32(payload[4:8]))
+		response = binary.LittleEndian.AppendUint32(response, bmcId)
+		return bmc.setupResponse(IPMI_PAYLOAD_OPEN_SESSION_RESPONSE, append(response, ipmiCipherSuite...))
+
+	case IPMI_PAYLOAD_RAKP1:
+		bmcId := binary.LittleEndian.Uint32(payload[4:8])
+		session := bmc.sessions[bmcId]
+		session.rm = append([]byte(nil), payload[8:24]...)
+		session.role = payload[24]
+		session.user = append([]byte(nil), payload[28:28+int(payload[27])]...)
+		bmc.roles = append(bmc.roles, session.role)
+		if string(session.user) != bmc.user {
+			return bmc.setupResponse(IPMI_PAYLOAD_RAKP2, []byte{payload[0], 0x0d, 0, 0})
+		}
+
+		kuid := []byte(bmc.password)
+		session.rc = byteRange(0x70, 16)
+		_, session.k1, session.k2 = ipmiSessionKeys(kuid, session.rm, session.rc, session.role, session.user)
+		response := []byte{payload[0], 0, 0, 0}
+		response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+		response = append(response, session.rc...)
+		response = append(response, testBmcGuid...)
+		response = append(response, ipmiHmac(kuid, le32(session.consoleId), le32(bmcId), session.rm, session.rc,
+			testBmcGuid, []byte{session.role, byte(len(session.user))}, session.user)...)
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP2, response)
+
+	case IPMI_PAYLOAD_RAKP3:
+		bmcId := binary.LittleEndian.Uint32(payload[4:8])
+		session := bmc.sessions[bmcId]
+		expected := ipmiHmac([]byte(bmc.password), session.rc, le32(session.consoleId), []byte{session.role, byte(len(session.user))}, session.user)
+		if !hmac.Equal(expected, payload[8:28]) {
+			return bmc.setupResponse(IPMI_PAYLOAD_RAKP4, []byte{payload[0], 0x0f, 0, 0})
+		}
+		session.active = true
+		sik, _, _ := ipmiSessionKeys([]byte(bmc.password), session.rm, session.rc, session.role, session.user)
+		response := []byte{payload[0], 0, 0, 0}
+		response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+		response = append(response, ipmiHmac(sik, session.rm, le32(bmcId), testBmcGuid)[:12]...)
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP4, response)
+
+	case IPMI_PAYLOAD_ENCRYPTED | IPMI_PAYLOAD_AUTHENTICATED | IPMI_PAYLOAD_IPMI:
+		session := bmc.sessions[binary.LittleEndian.Uint32(packet[6:10])]
+		if session == nil || !session.active || !ipmiVerify(session.k1, packet[4:]) {
+			return nil
+		}
+		request, err := ipmiDecrypt(session.k2[:16], payload)
+		if err != nil {
+			return nil
+		}
+		netFn, command, data := request[1]>>2, request[5], request[6:len(request)-1]
+
+		responseData := []byte{}
+		switch {
+		case netFn == IPMI_NETFN_CHASSIS && command == IPMI_CHASSIS_STATUS:
+			if bmc.power {
+				responseData = []byte{0x01, 0, 0}
+			} else {
+				responseData = []byte{0x00, 0, 0}
+			}
+		case netFn == IPMI_NETFN_CHASSIS && command == IPMI_CHASSIS_CONTROL:
+			bmc.controls = append(bmc.controls, data[0])
+			bmc.power = data[0] == IPMI_CHASSIS_POWER_UP
+		}
+
+		message := []byte{request[3], (netFn | 1) << 2}
+		message = append(message, ipmiChecksum(message))
+		body := append([]byte{request[0], request[4], command, 0}, responseData...)
+		message = append(message, body...)
+		message = append(message, ipmiChecksum(body))
+		encrypted, _ := ipmiEncrypt(session.k2[:16], message)
+
+		response := []byte{IPMI_AUTH_RMCP_PLUS, IPMI_PAYLOAD_ENCRYPTED | IPMI_PAYLOAD_AUTHENTICATED | IPMI_PAYLOAD_IPMI}
+		response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+		response = binary.LittleEndian.AppendUint32(response, 1)
+		response = binary.LittleEndian.AppendUint16(response, uint16(len(encrypted)))
+		response = append(response, encrypted...)
+		return append(rmcpHeader(), ipmiSign(session.k1, response)...)
+	}
+	return nil
+}
+
+func (bmc *testBmc) setupResponse(payloadType byte, payload []byte) []byte {
+	packet := append(rmcpHeader(), IPMI_AUTH_RMCP_PLUS, payloadType, 0, 0, 0, 0, 0, 0, 0, 0)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(len(payload)))
+	return append(packet, payload...)
+}
+
+// ipmiExchange runs a command on workstation 600 at the BMC
+func ipmiExchange(t *testing.T, bmc *testBmc, ws WorkstationConfig, cmdStr string) (string, error) {
+	t.Helper()
+
+	ws.Id = 600
+	ws.Host = bmc.conn.LocalAddr().String()
+	driver, err := ipmiDriver([]WorkstationConfig{ws})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, _, err := driver.Exchange(nil, cmdStr, time.Now().Add(2*time.Second))
+	return response, err
+}
+
+func TestIpmiExchange(t *testing.T) {
+	bmc := newTestBmc(t, "admin", "secret")
+	ws := WorkstationConfig{User: "admin", Password: "secret"}
+
+	steps := []struct {
+		cmd      string
+		response string
+		power    bool
+	}{
+		{"C0600", "0", false},
+		{"S0600", "3", true},
+		{"C0600", "1", true},
+		{"Q0600", "2", false},
+		{"E0600", "2", false},
+		{"C0600", "0", false},
+		{"C0601", "9", false},
+		{"X0600", "9", false},
+	}
+
+	for _, step := range steps {
+		response, err := ipmiExchange(t, bmc, ws, step.cmd)
+		if err != nil {
+			t.Fatalf("%v : %v", step.cmd, err)
+		}
+		if response != step.response {
+			t.Errorf("%v : response = %v, want %v", step.cmd, response, step.response)
+		}
+		bmc.mutex.Lock()
+		power := bmc.power
+		bmc.mutex.Unlock()
+		if power != step.power {
+			t.Errorf("%v : power = %v, want %v", step.cmd, power, step.power)
+		}
+	}
+
+	bmc.mutex.Lock()
+	defer bmc.mutex.Unlock()
+	want := []byte{IPMI_CHASSIS_POWER_UP, IPMI_CHASSIS_SOFT_SHUTDOWN, IPMI_CHASSIS_POWER_DOWN}
+	if !bytes.Equal(bmc.controls, want) {
+		t.Errorf("chassis controls = % x, want % x", bmc.controls, want)
+	}
+	for _, role := range bmc.roles {
+		if role != IPMI_PRIVILEGE_OPERATOR|IPMI_NAME_ONLY_LOOKUP {
+			t.Errorf("requested role %#x, want operator", role)
+		}
+	}
+}
+
+func TestIpmiExchangeAdministrator(t *testing.T) {
+	bmc := newTestBmc(t, "admin", "secret")
+
+	_, err := ipmiExchange(t, bmc, WorkstationConfig{User: "admin", Password: "secret", Privilege: "administrator"}, "C0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bmc.mutex.Lock()
+	defer bmc.mutex.Unlock()
+	if len(bmc.roles) != 1 || bmc.roles[0] != IPMI_PRIVILEGE_ADMINISTRATOR|IPMI_NAME_ONLY_LOOKUP {
+		t.Errorf("requested roles % x, want administrator", bmc.roles)
+	}
+}
+
+func TestIpmiExchangeRejected(t *testing.T) {
+	bmc := newTestBmc(t, "admin", "secret")
+
+	tests := []struct {
+		name  string
+		ws    WorkstationConfig
+		error string
+	}{
+		// NOTE : The auth code of RAKP 2 is made with the password of the BMC
+		{"wrong password", WorkstationConfig{User: "admin", Password: "guess"}, "RAKP 2 : wrong password"},
+		{"unknown user", WorkstationConfig{User: "nobody", Password: "secret"}, "status 0x0d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ipmiExchange(t, bmc, tt.ws, "S0600")
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Fatalf("err = %v, want %q", err, tt.error)
+			}
+
+			bmc.mutex.Lock()
+			defer bmc.mutex.Unlock()
+			if len(bmc.controls) != 0 {
+				t.Errorf("chassis controlled without a session : % x", bmc.controls)
+			}
+		})
+	}
+}
+
+func TestIpmiDriverConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		ws    []WorkstationConfig
+		error string
+	}{
+		{"no workstations", nil, "no workstations"},
+		{"no host", []WorkstationConfig{{Id: 1}}, "no host"},
+		{"duplicate", []WorkstationConfig{{Id: 1, Host: "a"}, {Id: 1, Host: "b"}}, "duplicate workstation"},
+		{"user too long", []WorkstationConfig{{Id: 1, Host: "a", User: strings.Repeat("u", 17)}}, "too long"},
+		{"password too long", []WorkstationConfig{{Id: 1, Host: "a", Password: strings.Repeat("p", 21)}}, "too long"},
+		{"invalid privilege", []WorkstationConfig{{Id: 1, Host: "a", Privilege: "user"}}, "invalid privilege"},
+		{"valid", []WorkstationConfig{{Id: 1, Host: "a", Privilege: "Operator"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ipmiDriver(tt.ws)
+			if tt.error == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Fatalf("err = %v, want %q", err, tt.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets in milliseconds
+var latencyBucketsMs = []int{5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// NOTE : Samples needed before the settle delay adapts to the MCU
+const LATENCY_WARMUP = 5
+
+// NOTE : Weight of a new sample in the moving average
+const LATENCY_EWMA_WEIGHT = 0.2
+
+var adaptiveSettle_ = true
+
+// LatencyHistogram is the MCU response latency of one command type,
+// measured from the write to the complete frame
+type LatencyHistogram struct {
+	counts   []int
+	count    int
+	timeouts int
+	sum      time.Duration
+	min      time.Duration
+	max      time.Duration
+	ewma     time.Duration
+}
+
+// LatencyTracker measures the response latency of a controller
+// per command type and derives the wait before reading from it
+type LatencyTracker struct {
+	mutex sync.Mutex
+	kinds [PRIORITY_COUNT]LatencyHistogram
+}
+
+type LatencyBucket struct {
+	Le    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+type LatencyStats struct {
+	Count    int             `json:"count"`
+	Timeouts int             `json:"timeouts"`
+	MinMs    float64         `json:"minMs"`
+	MaxMs    float64         `json:"maxMs"`
+	MeanMs   float64         `json:"meanMs"`
+	EwmaMs   float64         `json:"ewmaMs"`
+	P50Ms    float64         `json:"p50Ms"`
+	P90Ms    float64         `json:"p90Ms"`
+	P99Ms    float64         `json:"p99Ms"`
+	SettleMs float64         `json:"settleMs"`
+	Buckets  []LatencyBucket `json:"buckets"`
+}
+
+type ControllerLatency struct {
+	Name   string       `json:"name"`
+	Status LatencyStats `json:"status"`
+	Power  LatencyStats `json:"power"`
+}
+
+func NewLatencyTracker() *LatencyTracker {
+	t := &LatencyTracker{}
+	t.reset()
+	return t
+}
+
+func (t *LatencyTracker) reset() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := range t.kinds {
+		t.kinds[i] = LatencyHistogram{counts: make([]int, len(latencyBucketsMs)+1)}
+	}
+}
+
+func (t *LatencyTracker) observe(priority Priority, latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	h := &t.kinds[priority]
+	bucket := len(latencyBucketsMs)
+	for i, le := range latencyBucketsMs {
+		if latency <= time.Duration(le)*time.Millisecond {
+			bucket = i
+			break
+		}
+	}
+	h.counts[bucket]++
+
+	if h.count == 0 {
+		h.min = latency
+		h.max = latency
+		h.ewma = latency
+	} else {
+		h.min = min(h.min, latency)
+		h.max = max(h.max, latency)
+		h.ewma += time.Duration(LATENCY_EWMA_WEIGHT * float64(latency-h.ewma))
+	}
+	h.count++
+	h.sum += latency
+}
+
+// timeout counts a command which got no complete response
+func (t *LatencyTracker) timeout(priority Priority) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.kinds[priority].timeouts++
+}
+
+// settleDelay is the wait between writing a command and reading.
+// The frame reader returns as soon as a full response arrives, so the
+// wait only saves reads of partial responses. It stays below the fastest
+// response seen and half of the average, and never exceeds settleDelay_.
+// Before enough samples it does not wait at all.
+func (t *LatencyTracker) settleDelay(priority Priority) time.Duration {
+	if !adaptiveSettle_ {
+		return settleDelay_
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	h := &t.kinds[priority]
+	if h.count < LATENCY_WARMUP {
+		return 0
+	}
+	return min(h.ewma/2, h.min, settleDelay_)
+}
+
+func (t *LatencyTracker) stats(priority Priority) LatencyStats {
+	settle := t.settleDelay(priority)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	h := &t.kinds[priority]
+	stats := LatencyStats{
+		Count:    h.count,
+		Timeouts: h.timeouts,
+		MinMs:    milliseconds(h.min),
+		MaxMs:    milliseconds(h.max),
+		EwmaMs:   milliseconds(h.ewma),
+		P50Ms:    milliseconds(h.percentile(0.5)),
+		P90Ms:    milliseconds(h.percentile(0.9)),
+		P99Ms:    milliseconds(h.percentile(0.99)),
+		SettleMs: milliseconds(settle),
+		Buckets:  make([]LatencyBucket, 0, len(h.counts)),
+	}
+	if h.count > 0 {
+		stats.MeanMs = milliseconds(h.sum / time.Duration(h.count))
+	}
+
+	for i, count := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBucketsMs) {
+			le = strconv.Itoa(latencyBucketsMs[i])
+		}
+		stats.Buckets = append(stats.Buckets, LatencyBucket{Le: le, Count: count})
+	}
+	return stats
+}
+
+// percentile returns the upper bound of the bucket holding the q-th sample
+func (h *LatencyHistogram) percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := int(q*float64(h.count-1)) + 1
+	cumulative := 0
+	for i, count := range h.counts {
+		cumulative += count
+		if cumulative >= rank && i < len(latencyBucketsMs) {
+			return min(time.Duration(latencyBucketsMs[i])*time.Millisecond, h.max)
+		}
+	}
+	return h.max
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
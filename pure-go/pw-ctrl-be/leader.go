@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Lease is the leadership record in the shared lease file.
+// Term grows with every change of the holder.
+type Lease struct {
+	Holder    string    `json:"holder"`
+	Address   string    `json:"address"`
+	Term      int64     `json:"term"`
+	RenewedAt time.Time `json:"renewedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type LeaderStatus struct {
+	Enabled     bool      `json:"enabled"`
+	Id          string    `json:"id"`
+	Role        string    `json:"role"`
+	Lease       Lease     `json:"lease"`
+	LastRenewAt time.Time `json:"lastRenewAt"`
+	LastError   string    `json:"lastError"`
+}
+
+const ROLE_LEADER = "leader"
+const ROLE_STANDBY = "standby"
+
+// NOTE : Set on requests proxied by a standby, not to proxy them again
+const PROXIED_HEADER = "X-Pwctl-Proxied-By"
+
+// Wait between attempts to lock the lease file held by another replica
+const LEASE_LOCK_RETRY = 50 * time.Millisecond
+
+var haEnabled_ = false
+var haLeaseFile_ = ""
+var haId_ = ""
+var haAdvertise_ = ""
+var haLeaseDuration_ = 15 * time.Second
+var haRenewInterval_ = 5 * time.Second
+var haStandbyProxy_ = true
+
+var leaderMutex sync.RWMutex
+var leaderStatus_ = LeaderStatus{Role: ROLE_STANDBY}
+
+// isLeader is true if this replica may use the serial ports
+func isLeader() bool {
+	if !haEnabled_ {
+		return true
+	}
+
+	leaderMutex.RLock()
+	defer leaderMutex.RUnlock()
+
+	return leaderStatus_.Role == ROLE_LEADER
+}
+
+func leaderState() LeaderStatus {
+	leaderMutex.RLock()
+	defer leaderMutex.RUnlock()
+
+	status := leaderStatus_
+	status.Enabled = haEnabled_
+	status.Id = haId_
+	return status
+}
+
+// runElection renews or takes the lease every haRenewInterval_.
+// The leader opens the ports; a standby closes them. A leader which cannot
+// renew steps down before its lease expires, and a standby takes over only
+// after expiry, so the two never hold the ports at once.
+// NOTE : The replicas are assumed to have synchronized clocks
+func runElection(ctx context.Context) {
+	ticker := time.NewTicker(haRenewInterval_)
+	defer ticker.Stop()
+
+	for {
+		elect()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func elect() {
+	lease, err := acquireLease()
+	now := time.Now()
+
+	leaderMutex.Lock()
+	wasLeader := leaderStatus_.Role == ROLE_LEADER
+	// NOTE : A renewal finishing after the lease expired leaves a gap in
+	// which the ports were held without a lease, the leader starts over
+	lapsed := wasLeader && !now.Before(leaderStatus_.Lease.ExpiresAt)
+	if err != nil {
+		leaderStatus_.LastError = err.Error()
+		stepDown := wasLeader && !now.Before(leaderStatus_.Lease.ExpiresAt.Add(-haRenewInterval_))
+		if stepDown {
+			leaderStatus_.Role = ROLE_STANDBY
+		}
+		leaderMutex.Unlock()
+
+		logger.Info("Failed to renew the lease : ", err.Error())
+		if stepDown {
+			logger.Info("Stepping down, the lease cannot be renewed")
+			deactivateControllers()
+		}
+		return
+	}
+
+	leaderStatus_.Lease = lease
+	leaderStatus_.LastError = ""
+	isLeader := lease.Holder == haId_ && !lapsed
+	if isLeader {
+		leaderStatus_.Role = ROLE_LEADER
+		leaderStatus_.LastRenewAt = lease.RenewedAt
+	} else {
+		leaderStatus_.Role = ROLE_STANDBY
+	}
+	leaderMutex.Unlock()
+
+	if lapsed && lease.Holder == haId_ {
+		logger.Info("Stepping down, the lease expired before it was renewed")
+		deactivateControllers()
+	} else if isLeader && !wasLeader {
+		logger.Infof("Became the leader (term %v)", lease.Term)
+		activateControllers()
+	} else if !isLeader && wasLeader {
+		logger.Infof("Lost the leadership to %v (term %v)", lease.Holder, lease.Term)
+		deactivateControllers()
+	}
+}
+
+// acquireLease renews the lease of this replica, or takes it if it
+// expired. Otherwise the lease of the other holder is returned.
+func acquireLease() (Lease, error) {
+	lockFile, err := os.OpenFile(haLeaseFile_+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return Lease{}, err
+	}
+	defer lockFile.Close()
+
+	err = lockLeaseFile(lockFile, haRenewInterval_/2)
+	if err != nil {
+		return Lease{}, err
+	}
+
+	// NOTE : The time is taken once locked, waiting for the lock ages the lease
+	now := time.Now()
+
+	var lease Lease
+	data, err := os.ReadFile(haLeaseFile_)
+	if err == nil {
+		err = json.Unmarshal(data, &lease)
+		if err != nil {
+			return Lease{}, errors.New(haLeaseFile_ + " : " + err.Error())
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return Lease{}, err
+	}
+
+	if lease.Holder != haId_ && now.Before(lease.ExpiresAt) {
+		return lease, nil
+	}
+
+	if lease.Holder != haId_ {
+		lease.Term++
+	}
+	lease.Holder = haId_
+	lease.Address = haAdvertise_
+	lease.RenewedAt = now
+	lease.ExpiresAt = now.Add(haLeaseDuration_)
+
+	return lease, writeLease(lease)
+}
+
+// writeLease replaces the lease file atomically
+func writeLease(lease Lease) error {
+	data, err := json.MarshalIndent(lease, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(haLeaseFile_), filepath.Base(haLeaseFile_)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), haLeaseFile_)
+}
+
+// leaderOnly passes the request on the leader. A standby proxies it
+// to the leader, or answers 503 if the leader is unknown or not proxied.
+func leaderOnly(c *gin.Context) {
+	if isLeader() {
+		c.Next()
+		return
+	}
+
+	status := leaderState()
+	lease := status.Lease
+	leaderKnown := lease.Holder != "" && lease.Address != "" && time.Now().Before(lease.ExpiresAt)
+
+	if haStandbyProxy_ && leaderKnown && c.GetHeader(PROXIED_HEADER) == "" {
+		target, err := url.Parse(lease.Address)
+		if err == nil {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Info("Failed to proxy to the leader : ", err.Error())
+				notLeader(c, "failed to proxy to the leader "+lease.Holder+" : "+err.Error())
+			}
+			c.Request.Header.Set(PROXIED_HEADER, haId_)
+			proxy.ServeHTTP(c.Writer, c.Request)
+			c.Abort()
+			return
+		}
+	}
+
+	message := "standby replica " + haId_
+	if lease.Holder != "" {
+		message += ", the leader is " + lease.Holder + " (term " + strconv.FormatInt(lease.Term, 10) + ")"
+	}
+	notLeader(c, message)
+}
+
+func notLeader(c *gin.Context, message string) {
+	var failResponse McuResponseFail
+	failResponse.State = "fail"
+	failResponse.Message = message
+	failResponse.ErrorType = strconv.Itoa(ERROR_NOT_LEADER)
+	c.IndentedJSON(http.StatusServiceUnavailable, failResponse)
+	c.Abort()
+}
+
+// standbyReady is the readiness of a standby. It is ready when
+// requests can be proxied to a live leader.
+func standbyReady() (bool, []string) {
+	lease := leaderState().Lease
+	if lease.Holder == "" || !time.Now().Before(lease.ExpiresAt) {
+		return false, []string{"standby : no leader"}
+	}
+	if !haStandbyProxy_ || lease.Address == "" {
+		return false, []string{"standby : the leader is " + lease.Holder}
+	}
+	return true, nil
+}
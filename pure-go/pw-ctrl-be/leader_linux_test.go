@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestElectionLostLock(t *testing.T) {
+	setupElection(t)
+	a := newElector("a")
+	b := newElector("b")
+
+	a.elect()
+	a.expectRole(t, ROLE_LEADER, "a", 1)
+	renewedAt := time.Now()
+
+	// NOTE : Another replica stuck holding the lock of the lease file
+	lockFile, err := os.OpenFile(haLeaseFile_+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	if err := lockLeaseFile(lockFile, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing to renew early in the lease keeps the leadership
+	a.elect()
+	a.expectRole(t, ROLE_LEADER, "a", 1)
+	if a.status.LastError == "" {
+		t.Error("no error while the lock is held")
+	}
+
+	// The leader steps down a renew interval before its lease expires
+	time.Sleep(time.Until(renewedAt.Add(testLease - testRenew)))
+	a.elect()
+	a.expectRole(t, ROLE_STANDBY, "a", 1)
+
+	b.elect()
+	b.expectRole(t, ROLE_STANDBY, "", 0)
+
+	// Once the lock is released and the lease expired the standby takes over
+	lockFile.Close()
+	time.Sleep(time.Until(renewedAt.Add(testLease + 10*time.Millisecond)))
+	b.elect()
+	b.expectRole(t, ROLE_LEADER, "b", 2)
+	a.elect()
+	a.expectRole(t, ROLE_STANDBY, "b", 2)
+}
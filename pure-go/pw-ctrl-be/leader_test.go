@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testLease = 300 * time.Millisecond
+const testRenew = 100 * time.Millisecond
+
+// elector is one replica of the election. The election state is global,
+// so each elector swaps its own state in while it runs.
+type elector struct {
+	id      string
+	address string
+	status  LeaderStatus
+}
+
+// setupElection points the election to a lease file of the test
+func setupElection(t *testing.T) {
+	t.Helper()
+
+	savedEnabled, savedFile, savedId, savedAdvertise := haEnabled_, haLeaseFile_, haId_, haAdvertise_
+	savedLease, savedRenew, savedProxy := haLeaseDuration_, haRenewInterval_, haStandbyProxy_
+	savedControllers := controllerList()
+	leaderMutex.Lock()
+	savedStatus := leaderStatus_
+	leaderMutex.Unlock()
+	t.Cleanup(func() {
+		haEnabled_, haLeaseFile_, haId_, haAdvertise_ = savedEnabled, savedFile, savedId, savedAdvertise
+		haLeaseDuration_, haRenewInterval_, haStandbyProxy_ = savedLease, savedRenew, savedProxy
+		setControllerList(savedControllers)
+		leaderMutex.Lock()
+		leaderStatus_ = savedStatus
+		leaderMutex.Unlock()
+	})
+
+	haEnabled_ = true
+	haLeaseFile_ = filepath.Join(t.TempDir(), "leader.lease")
+	haLeaseDuration_ = testLease
+	haRenewInterval_ = testRenew
+	haStandbyProxy_ = true
+	// NOTE : No ports to open or close on a change of the leader
+	setControllerList(nil)
+}
+
+func newElector(id string) *elector {
+	return &elector{id: id, address: "http://" + id, status: LeaderStatus{Role: ROLE_STANDBY}}
+}
+
+// run runs f as this replica
+func (e *elector) run(f func()) {
+	haId_ = e.id
+	haAdvertise_ = e.address
+	leaderMutex.Lock()
+	leaderStatus_ = e.status
+	leaderMutex.Unlock()
+
+	f()
+
+	leaderMutex.Lock()
+	e.status = leaderStatus_
+	leaderMutex.Unlock()
+}
+
+func (e *elector) elect() {
+	e.run(elect)
+}
+
+func (e *elector) expectRole(t *testing.T, role string, holder string, term int64) {
+	t.Helper()
+
+	if e.status.Role != role || e.status.Lease.Holder != holder || e.status.Lease.Term != term {
+		t.Fatalf("%v : role = %v, lease %v (term %v), want %v, lease %v (term %v), error %q",
+			e.id, e.status.Role, e.status.Lease.Holder, e.status.Lease.Term, role, holder, term, e.status.LastError)
+	}
+}
+
+func TestElectionSingleLeader(t *testing.T) {
+	setupElection(t)
+	a := newElector("a")
+	b := newElector("b")
+
+	a.elect()
+	a.expectRole(t, ROLE_LEADER, "a", 1)
+	b.elect()
+	b.expectRole(t, ROLE_STANDBY, "a", 1)
+
+	// Renewing keeps the term, the standby keeps waiting
+	for i := 0; i < 3; i++ {
+		time.Sleep(testRenew)
+		a.elect()
+		b.elect()
+		a.expectRole(t, ROLE_LEADER, "a", 1)
+		b.expectRole(t, ROLE_STANDBY, "a", 1)
+	}
+	if b.status.Lease.Address != "http://a" {
+		t.Errorf("leader address = %q", b.status.Lease.Address)
+	}
+}
+
+func TestElectionTakeover(t *testing.T) {
+	setupElection(t)
+	a := newElector("a")
+	b := newElector("b")
+
+	a.elect()
+	b.elect()
+	b.expectRole(t, ROLE_STANDBY, "a", 1)
+
+	// NOTE : The leader is gone, the standby waits for the lease to expire
+	time.Sleep(testLease / 2)
+	b.elect()
+	b.expectRole(t, ROLE_STANDBY, "a", 1)
+
+	time.Sleep(testLease/2 + 10*time.Millisecond)
+	b.elect()
+	b.expectRole(t, ROLE_LEADER, "b", 2)
+
+	// The former leader comes back as the standby
+	a.elect()
+	a.expectRole(t, ROLE_STANDBY, "b", 2)
+}
+
+func TestElectionLapsedRenewal(t *testing.T) {
+	setupElection(t)
+	a := newElector("a")
+
+	a.elect()
+	a.expectRole(t, ROLE_LEADER, "a", 1)
+
+	// NOTE : A leader renewing too late steps down once before leading again
+	time.Sleep(testLease + 10*time.Millisecond)
+	a.elect()
+	a.expectRole(t, ROLE_STANDBY, "a", 1)
+	a.elect()
+	a.expectRole(t, ROLE_LEADER, "a", 1)
+}
+
+// follower serves a leaderOnly endpoint as the replica
+func (e *elector) follower(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/set", func(c *gin.Context) {
+		e.run(func() {
+			leaderOnly(c)
+		})
+	}, func(c *gin.Context) {
+		c.String(http.StatusOK, "served by "+e.id)
+	})
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLeaderOnly(t *testing.T) {
+	setupElection(t)
+
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served by the leader, proxied by " + r.Header.Get(PROXIED_HEADER)))
+	}))
+	defer leader.Close()
+
+	a := newElector("a")
+	a.address = leader.URL
+	b := newElector("b")
+	a.elect()
+	b.elect()
+	b.expectRole(t, ROLE_STANDBY, "a", 1)
+
+	get := func(server *httptest.Server, proxied string) (int, string) {
+		t.Helper()
+
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/set", nil)
+		if proxied != "" {
+			request.Header.Set(PROXIED_HEADER, proxied)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, string(body)
+	}
+
+	notLeader := func(code int, body string) {
+		t.Helper()
+
+		var failResponse McuResponseFail
+		err := json.Unmarshal([]byte(body), &failResponse)
+		if code != http.StatusServiceUnavailable || err != nil || failResponse.ErrorType != strconv.Itoa(ERROR_NOT_LEADER) {
+			t.Errorf("%v %s, want 503 with ERROR_NOT_LEADER", code, body)
+		}
+	}
+
+	if code, body := get(a.follower(t), ""); code != http.StatusOK || body != "served by a" {
+		t.Errorf("leader : %v %q", code, body)
+	}
+
+	standby := b.follower(t)
+	if code, body := get(standby, ""); code != http.StatusOK || body != "served by the leader, proxied by b" {
+		t.Errorf("standby : %v %q", code, body)
+	}
+
+	// NOTE : A request proxied once is not proxied again
+	code, body := get(standby, "c")
+	notLeader(code, body)
+
+	haStandbyProxy_ = false
+	code, body = get(standby, "")
+	notLeader(code, body)
+	haStandbyProxy_ = true
+
+	// Without a live leader there is nobody to proxy to
+	time.Sleep(testLease + 10*time.Millisecond)
+	code, body = get(standby, "")
+	notLeader(code, body)
+
+	// A leader not answering the proxy is not served either
+	leader.Close()
+	b.status.Lease.ExpiresAt = time.Now().Add(testLease)
+	code, body = get(standby, "")
+	notLeader(code, body)
+}
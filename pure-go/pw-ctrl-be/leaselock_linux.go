@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockLeaseFile takes the exclusive flock of the lease file of the leader
+// election, released by closing the file. It retries until the timeout
+// instead of blocking : a leader stuck on the lock would keep the ports
+// past its lease.
+func lockLeaseFile(file *os.File, timeOut time.Duration) error {
+	deadline := time.Now().Add(timeOut)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return os.NewSyscallError("flock", err)
+		}
+		if !time.Now().Before(deadline) {
+			return errors.New(file.Name() + " : still locked after " + timeOut.String())
+		}
+		time.Sleep(LEASE_LOCK_RETRY)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// NOTE : Without flock, only one replica may use the lease file at once
+func lockLeaseFile(file *os.File, timeOut time.Duration) error {
+	return nil
+}
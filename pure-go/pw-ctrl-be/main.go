@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"grida/pwctrlbe/docs"
+	"grida/pwctrlbe/portlock"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -52,6 +56,8 @@ type LivenessState struct {
 
 type ReadinessState struct {
 	Status string `json:"status"`
+	// NOTE : Why the controllers are not connected, see /admin/connections
+	Details []string `json:"details,omitempty"`
 }
 
 type HealthComponent struct {
@@ -66,18 +72,33 @@ type HealthResponse struct {
 }
 
 type PwCtrl struct {
-	//portPrefix         string
+	portSelector       PortSelector
+	serialMode         *serial.Mode
 	readTimeOut        int
 	readMinByte        int
+	readDeadlines      ReadDeadlines
+	latency            *LatencyTracker
+	reconnect          *ReconnectTracker
+	reconnectWake      chan struct{}
 	portName           string
 	connectInitialized bool
 	serialPortFound    bool
-	serialPort         serial.Port
+	transport          Transport
+	newTransport       TransportFactory
+	frames             *FrameReader
+	driver             Driver
 	reIntializing      bool
+	// NOTE : The controller was removed by a reload
+	closed bool
+	// NOTE : The port is left to the leader replica (HA)
+	standby bool
+
+	// NOTE : Guards the transport between the command worker
+	// and the re-initializing goroutine
+	portMutex sync.Mutex
 }
 
 var debugginMode_ bool
-var inComMCU_ bool
 
 // Error code
 const SUCCESS = 0
@@ -89,19 +110,54 @@ const ERROR_OPEN_PORT = 102
 const ERROR_RESET_OUTBUFFER = 103
 const ERROR_RESET_INBUFFER = 104
 const ERROR_PORT_NOT_SPECIFIED = 105
+const ERROR_NO_CONTROLLER = 106
+const ERROR_CONFIG = 107
+const ERROR_RELOAD_BUSY = 108
+const ERROR_PORT_LOCKED = 109
+const ERROR_NOT_LEADER = 110
+const ERROR_BAD_REQUEST = 111
 const ERROR_PORT_BUSY = 200
 const ERROR_READING = 201
 const ERROR_NO_DATA_READ = 202
+const ERROR_QUEUE_FULL = 203
+const ERROR_DEADLINE_EXCEEDED = 204
+const ERROR_INCOMPLETE_FRAME = 205
+const ERROR_VERIFY_TIMEOUT = 206
+const ERROR_INVALID_FRAME = 207
+const ERROR_NETWORK = 208
 const ERROR_IN_INITAILIZING = 210
 
 // PwCtrl constructor
-//func NewPwCtrl(prefix string, timeout int, minbyte int) *PwCtrl {
-//	return &PwCtrl{prefix, timeout, minbyte}
-//}
+func NewPwCtrl(selector PortSelector, mode *serial.Mode, timeout int, minbyte int) *PwCtrl {
+	pwctl := &PwCtrl{
+		portSelector: selector,
+		serialMode:   mode,
+		readTimeOut:  timeout,
+		readMinByte:  minbyte,
+		readDeadlines: ReadDeadlines{
+			status: time.Duration(timeout) * time.Second,
+			power:  time.Duration(timeout) * time.Second,
+		},
 
-var pwCtrl PwCtrl
+		portName:           "",
+		connectInitialized: false,
+		serialPortFound:    false,
+		newTransport:       portTransportFactory,
+		driver:             McuDriver{},
+		reIntializing:      false,
+		latency:            NewLatencyTracker(),
+		reconnect:          NewReconnectTracker(),
+		reconnectWake:      make(chan struct{}, 1),
+		standby:            !isLeader(),
+	}
+	if pwctl.standby {
+		pwctl.reconnect.standby()
+	}
+	return pwctl
+}
 
-var portPrefix_ []string
+var readTimeOut_ int
+var readMinByte_ int
 
 func main() {
 	fmt.Println("******************************")
@@ -110,50 +166,36 @@ func main() {
 
 	args := os.Args
 
+	// NOTE : PWCTL_CONFIG gives the config file when no argument is given
+	if configFile, found := os.LookupEnv("PWCTL_CONFIG"); found && len(args) == 1 {
+		args = []string{args[0], "--config", configFile}
+	}
+
 	if len(args) < 3 {
-		fmt.Println("- usage : pwctl <arg1> <arg2> <arg3>(optional)")
+		fmt.Println("- usage : pwctl <arg1> <arg2> <arg3>(optional) ...")
 		fmt.Println(" . arg1 : max. reading time in seconds")
 		fmt.Println(" . arg2 : minimum bytes to read")
 		fmt.Println(" . arg3 : (optional) port name prefix (ex: ttyACM or ttyUSB)")
-		fmt.Println(" . (example) pwctl ttyACM 100 0")
+		fmt.Println(" .        or controllers as <port>=<routes> (ex: ttyACM0=0-63 ttyACM1=64-127,rack:2)")
+		fmt.Println(" .        port : ttyACM0, usb:<vid>:<pid>[:<serial>] or /dev/serial/by-id/<name>")
+		fmt.Println(" .               tcp://<host>:<port> or rfc2217://<host>:<port> (ser2net)")
+		fmt.Println(" .        routes : *, 7, 0-63, rack:2 or auto (discovered by probing)")
+		fmt.Println(" . (example) pwctl 5 0 ttyACM")
+		fmt.Println("- usage : pwctl --config <config file>")
+		fmt.Println(" . (example) pwctl --config config.example.yaml")
+		fmt.Println(" . PWCTL_CONFIG gives the config file without arguments")
+		fmt.Println(" . PWCTL_* environment variables override the parameters")
+		fmt.Println(" . SIGHUP or POST /admin/reload reloads the configuration")
 		return
 	}
 
-	if len(args) < 4 {
-		portPrefix_ = append(portPrefix_, "/dev/ttyACM")
-		portPrefix_ = append(portPrefix_, "/dev/ttyUSB")
-		logger.Info(
-			"Started with parameters : " + args[1] + ", " + args[2] + " ttyACM/ttyUSB")
-	} else {
-		portPrefix_ = append(portPrefix_, "/dev/"+args[3])
-		logger.Info(
-			"Started with parameters : " + args[1] + ", " + args[2] + ", " + args[3])
-	}
-
-	fmt.Println("portPrefix : ", len(portPrefix_))
-	for i := 0; i < len(portPrefix_); i++ {
-		fmt.Print(portPrefix_[i], " ")
-	}
-	fmt.Println()
+	logger.Info("Started with parameters : " + strings.Join(args[1:], ", "))
 
 	logger.Formatter = &logrus.TextFormatter{
 		FullTimestamp:   true,
 		TimestampFormat: "2006-01-02 15:04:05",
 	}
 
-	pwCtrl = PwCtrl{
-		//portPrefix:  "/dev/ttyACM",
-		readTimeOut: 10,
-		readMinByte: 0,
-
-		portName:           "",
-		connectInitialized: false,
-		serialPortFound:    false,
-		reIntializing:      false,
-	}
-
-	//pwCtrl.printValues()
-
 	fmt.Println("====")
 
 	err := readInputs(args)
@@ -162,11 +204,30 @@ func main() {
 		return
 	}
 
-	//err = pwCtrl.findSerialPort()
-	_, err = pwCtrl.intializeConnection()
+	err = setupControllers(config_)
 	if err != nil {
-		fmt.Println(err.Error())
-		//return
+		fmt.Println("Error in reading inputs : ", err.Error())
+		return
+	}
+
+	for _, controller := range controllers_ {
+		controller.start(context.Background())
+	}
+
+	// NOTE : With HA the ports are opened when this replica becomes the leader
+	if haEnabled_ {
+		go runElection(context.Background())
+	} else {
+		activateControllers()
+	}
+
+	watchReload()
+
+	if hotplugEnabled_ {
+		err = watchHotplug()
+		if err != nil {
+			logger.Info("Hotplug detection disabled : ", err.Error())
+		}
 	}
 
 	// Set debuggin mode
@@ -179,48 +240,89 @@ func main() {
 		logger.Info("Running in Debugging mode")
 	}
 
+	basePath := config_.BasePath
+
 	// Set swagger info
 	docs.SwaggerInfo.Title = "Infra-External API"
 	docs.SwaggerInfo.Description = "This is a power-controller backend server"
 	docs.SwaggerInfo.Version = "1.0"
-	docs.SwaggerInfo.Host = "localhost"
-	docs.SwaggerInfo.BasePath = "/api/v1/infra-external/power"
+	docs.SwaggerInfo.Host = config_.SwaggerHost
+	docs.SwaggerInfo.BasePath = basePath
 	docs.SwaggerInfo.Schemes = []string{"http", "https"}
 
-	//
-	inComMCU_ = false
-
 	router := gin.Default()
 
 	setupSwagger(router)
 
-	basePath := "/api/v1/infra-external/power"
-
-	router.GET(basePath+"/set/:id/:cmd", setPower)
-	router.GET(basePath+"/initialize", initialize)
-	router.GET(basePath+"/get/:id", getPower)
+	// NOTE : leaderOnly proxies the MCU requests of a standby replica to the leader
+	router.GET(basePath+"/set/:id/:cmd", leaderOnly, setPower)
+	router.GET(basePath+"/initialize", leaderOnly, initialize)
+	router.GET(basePath+"/get/:id", leaderOnly, getPower)
+	router.GET(basePath+"/v2/set/:id/:cmd", leaderOnly, setPowerV2)
+	router.GET(basePath+"/v2/get/:id", leaderOnly, getPowerV2)
+	router.GET(basePath+"/controllers", getControllers)
+	router.POST(basePath+"/admin/discover", leaderOnly, startDiscovery)
+	router.GET(basePath+"/admin/discovery", leaderOnly, getDiscovery)
+	router.GET(basePath+"/admin/leader", getLeader)
+	router.POST(basePath+"/admin/reload", reload)
+	router.GET(basePath+"/admin/latency", getLatency)
+	router.GET(basePath+"/admin/connections", getConnections)
+	router.POST(basePath+"/admin/uevent", injectHotplug)
 
 	router.GET("/actuator/health", healthCheck)
 	router.GET("/ready", readyCheck)
 
-	router.Run(":8080")
-
-	logger.Info("Listening :8080")
+	logger.Info("Listening ", config_.Listen)
 
-	/*err = pwCtrl.write([]byte("0"))
+	err = router.Run(config_.Listen)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		logger.Info(err.Error())
 	}
+}
 
-	buff := make([]byte, 100)
-	n, err := pwCtrl.read(buff)
+// setupControllers creates the controllers and the routing table
+func setupControllers(cfg *Config) error {
+	err := validateControllers(cfg)
 	if err != nil {
-		return
+		return err
+	}
+
+	for _, cc := range cfg.Controllers {
+		pwctl, err := cc.newPwCtrl(cfg)
+		if err != nil {
+			return err
+		}
+
+		err = addController(cc.Name, pwctl, cc.Routes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addController(name string, pwctl *PwCtrl, routeSpecs []string) error {
+	controller := NewController(name, pwctl)
+
+	if len(routeSpecs) == 1 && routeSpecs[0] == "auto" {
+		controller.autoDiscover = true
+		routeSpecs = nil
+	}
+
+	for _, spec := range routeSpecs {
+		err := routes_.add(spec, controller)
+		if err != nil {
+			return err
+		}
 	}
-	fmt.Println(buff[:n])
 
-	return*/
+	controllers_ = append(controllers_, controller)
+	if controller.autoDiscover {
+		fmt.Println("- Controller ", name, " : ", pwctl.portSelector, " -> (auto)")
+	} else {
+		fmt.Println("- Controller ", name, " : ", pwctl.portSelector, " -> ", strings.Join(routeSpecs, ","))
+	}
+	return nil
 }
 
 func zeroPad(number int) string {
@@ -236,13 +338,27 @@ func setupSwagger(r *gin.Engine) {
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 }
 
+// readiness is true if all controllers are connected,
+// or on a standby replica if requests can be proxied to the leader
+func readiness() (bool, []string) {
+	if !isLeader() {
+		return standbyReady()
+	}
+	if allConnected() {
+		return true, nil
+	}
+	return false, notConnectedDetails()
+}
+
 func readyCheck(c *gin.Context) {
 	var readinessState ReadinessState
-	if pwCtrl.connectInitialized {
+	ready, details := readiness()
+	if ready {
 		readinessState.Status = "UP"
 		c.IndentedJSON(http.StatusOK, readinessState)
 	} else {
 		readinessState.Status = "DOWN"
+		readinessState.Details = details
 		c.IndentedJSON(http.StatusInternalServerError, readinessState)
 	}
 }
@@ -252,7 +368,7 @@ func healthCheck(c *gin.Context) {
 
 	healthResponse.Status = "UP"
 	healthResponse.Components.Liveness.Status = "UP"
-	if pwCtrl.connectInitialized {
+	if ready, _ := readiness(); ready {
 		healthResponse.Components.Readiness.Status = "UP"
 	} else {
 		healthResponse.Components.Readiness.Status = "DOWN"
@@ -270,71 +386,17 @@ func healthCheck(c *gin.Context) {
 // @Produce      json
 // @Param        id   path      int  true  "Workstation ID in power-controller"
 // @Param 		 cmd  path		string true "Power controll command(S:power-on, Q:shutdown(OS), E:power-off(HW)"
+// @Param 		 verify  query	bool false "Poll the power state until the command takes effect"
+// @Param 		 timeout query	int  false "Max. seconds to verify the power state (default: 60)"
 // @Success      200  {object}  string "Successfully power on/off workstation with the given id"
-// @Failure		 408  {object}  string "Port is busy"
-// @Failure 	 400  {object}	string "Unknown command or wrong rack number"
+// @Failure		 503  {object}  string "Command queue is full or deadline exceeded"
+// @Failure		 504  {object}  string "Power state not reached within the timeout"
+// @Failure 	 400  {object}	string "Unknown command, wrong rack number or no controller for the id"
 // @Failure 	 500  {object}	string "Internal server error"
 // @Router       /set/{id}/{cmd} [get]
 func setPower(c *gin.Context) {
-	chars := make([]byte, 64)
-	mesg := string(chars)
-
-	paramId := c.Param("id")
-	paramCmd := c.Param("cmd")
-
-	tmpParamId, _ := strconv.Atoi(string(paramId))
-	tmpCmd := paramCmd + zeroPad(tmpParamId)
-	//logger.Infof("Sent command : %v", tmpCmd)
-
-	code, err := pwCtrl.setCommand(tmpCmd, &mesg, 100)
-	if err != nil {
-		logger.Info(err.Error())
-		if code == ERROR_PORT_BUSY {
-			var failResponse McuResponseFail
-
-			failResponse.State = "fail"
-			failResponse.Message = err.Error()
-			failResponse.ErrorType = strconv.Itoa(code)
-			c.IndentedJSON(http.StatusRequestTimeout, failResponse)
-			return
-		}
-	}
-	//logger.Infof("MCU response : %v", mesg)
-
-	var tmpResponse CmdResult
-	tmpResponse.Cmd = tmpCmd
-	tmpResponse.Res = mesg
-
-	mcuCode := -1
-	if len(tmpResponse.Res) > 0 {
-		mcuCode, _ = strconv.Atoi(tmpResponse.Res[:1])
-	}
-
-	var response McuResponse
-	response.ElapsedSeconds = 0
-
-	if mcuCode == 0 || mcuCode == 2 {
-		response.Data = false
-	} else if mcuCode == 1 || mcuCode == 3 {
-		response.Data = true
-	} else {
-		response.Data = false
-	}
-
-	if err == nil {
-		response.State = "success"
-		c.IndentedJSON(http.StatusOK, response)
-	} else {
-		var failResponse McuResponseFail
-		failResponse.State = "fail"
-		failResponse.Message = err.Error()
-		failResponse.ErrorType = strconv.Itoa(code)
-		if mcuCode == 9 {
-			c.IndentedJSON(http.StatusBadRequest, failResponse)
-		} else {
-			c.IndentedJSON(http.StatusInternalServerError, failResponse)
-		}
-	}
+	id, tmpCmd := setPowerCommand(c)
+	runPowerCommand(c, id, tmpCmd, false)
 }
 
 // getPower godoc
@@ -345,106 +407,165 @@ func setPower(c *gin.Context) {
 // @Produce      json
 // @Param        id   path      int  true  "Workstation ID in power-controller"
 // @Success      200  {object}  string "Power state(on/ff) identified"
-// @Failure		 408  {object}  string "Port is busy"
-// @Failure 	 400  {object}	string "Unknown command or wrong rack number"
+// @Failure		 503  {object}  string "Command queue is full or deadline exceeded"
+// @Failure 	 400  {object}	string "Unknown command, wrong rack number or no controller for the id"
 // @Failure 	 500  {object}	string "Internal server error"
 // @Router       /get/{id} [get]
 func getPower(c *gin.Context) {
-	chars := make([]byte, 64)
-	mesg := string(chars)
+	id, tmpCmd := getPowerCommand(c)
+	runPowerCommand(c, id, tmpCmd, false)
+}
 
-	paramId := c.Param("id")
+// setPowerV2 godoc
+// @Summary      Power on/off workstation (v2)
+// @Description  Power on/off workstation with id and return the full power state
+// @Tags         infra-external
+// @Accept       json
+// @Produce      json
+// @Param        id   path      int  true  "Workstation ID in power-controller"
+// @Param 		 cmd  path		string true "Power controll command(S:power-on, Q:shutdown(OS), E:power-off(HW)"
+// @Param 		 verify  query	bool false "Poll the power state until the command takes effect"
+// @Param 		 timeout query	int  false "Max. seconds to verify the power state (default: 60)"
+// @Success      200  {object}  McuResponseV2 "Successfully power on/off workstation with the given id"
+// @Failure		 503  {object}  McuResponseFail "Command queue is full or deadline exceeded"
+// @Failure		 504  {object}  McuResponseFail "Power state not reached within the timeout"
+// @Failure 	 400  {object}	McuResponseFail "Unknown command, wrong rack number or no controller for the id"
+// @Failure 	 500  {object}	McuResponseFail "Internal server error"
+// @Router       /v2/set/{id}/{cmd} [get]
+func setPowerV2(c *gin.Context) {
+	id, tmpCmd := setPowerCommand(c)
+	runPowerCommand(c, id, tmpCmd, true)
+}
 
-	tmpParamId, _ := strconv.Atoi(string(paramId))
-	tmpCmd := "C" + zeroPad(tmpParamId)
-	//logger.Infof("Sent command : %v", tmpCmd)
+// getPowerV2 godoc
+// @Summary      Check power state of worktation (v2)
+// @Description  Check the full power state(off, on, transitioning-off, transitioning-on, failed, unknown) with workstation id
+// @Tags         infra-external
+// @Accept       json
+// @Produce      json
+// @Param        id   path      int  true  "Workstation ID in power-controller"
+// @Success      200  {object}  McuResponseV2 "Power state identified"
+// @Failure		 503  {object}  McuResponseFail "Command queue is full or deadline exceeded"
+// @Failure 	 400  {object}	McuResponseFail "Unknown command, wrong rack number or no controller for the id"
+// @Failure 	 500  {object}	McuResponseFail "Internal server error"
+// @Router       /v2/get/{id} [get]
+func getPowerV2(c *gin.Context) {
+	id, tmpCmd := getPowerCommand(c)
+	runPowerCommand(c, id, tmpCmd, true)
+}
 
-	code, err := pwCtrl.setCommand(tmpCmd, &mesg, 100)
-	//logger.Infof("MCU response : %v", mesg)
-	if err != nil {
-		logger.Info(err.Error())
+func setPowerCommand(c *gin.Context) (int, string) {
+	paramId := c.Param("id")
+	paramCmd := c.Param("cmd")
 
-		if code == ERROR_PORT_BUSY {
-			var failResponse McuResponseFail
-			failResponse.State = "fail"
-			failResponse.Message = err.Error()
-			failResponse.ErrorType = strconv.Itoa(code)
-			c.IndentedJSON(http.StatusRequestTimeout, failResponse)
-			return
-		} else if code == ERROR_PORT_NOT_SPECIFIED {
-			var failResponse McuResponseFail
+	tmpParamId, _ := strconv.Atoi(string(paramId))
+	return tmpParamId, paramCmd + zeroPad(tmpParamId)
+}
 
-			failResponse.State = "fail"
-			failResponse.Message = err.Error()
-			failResponse.ErrorType = strconv.Itoa(code)
-			c.IndentedJSON(http.StatusInternalServerError, failResponse)
-			return
-		}
-	}
+func getPowerCommand(c *gin.Context) (int, string) {
+	paramId := c.Param("id")
 
-	//logger.Info()
+	tmpParamId, _ := strconv.Atoi(string(paramId))
+	return tmpParamId, "C" + zeroPad(tmpParamId)
+}
 
-	var tmpResponse CmdResult
-	tmpResponse.Cmd = tmpCmd
-	tmpResponse.Res = mesg
-	//logger.Info("RESPONSE :", mesg, len(mesg), len(tmpResponse.Res))
+// runPowerCommand sends the command through the queue and writes
+// McuResponse, or McuResponseV2 if v2 is set.
+// With ?verify=true a power command is followed by polling the state
+// until the target state is reached.
+func runPowerCommand(c *gin.Context, id int, tmpCmd string, v2 bool) {
+	startTime := time.Now()
 
-	mcuCode := 0
-	if len(tmpResponse.Res) > 0 {
-		mcuCode, _ = strconv.Atoi(tmpResponse.Res[:1])
-	} else {
+	controller := routes_.lookup(id)
+	if controller == nil {
 		var failResponse McuResponseFail
 		failResponse.State = "fail"
-		failResponse.Message = err.Error()
-		failResponse.ErrorType = strconv.Itoa(code)
-		c.IndentedJSON(http.StatusInternalServerError, failResponse)
-		//httputil.NewError(c, http.StatusInternalServerError, err)
+		failResponse.Message = "no controller for workstation id " + zeroPad(id)
+		failResponse.ErrorType = strconv.Itoa(ERROR_NO_CONTROLLER)
+		c.IndentedJSON(http.StatusBadRequest, failResponse)
 		return
 	}
-	//logger.Info("mcuCode=", mcuCode)
 
-	var response McuResponse
-	response.ElapsedSeconds = 0
+	ctx, cancel := context.WithTimeout(c.Request.Context(), commandTimeOut_)
+	defer cancel()
 
-	if mcuCode == 0 || mcuCode == 2 {
-		response.Data = false
-	} else if mcuCode == 1 || mcuCode == 3 {
-		response.Data = true
-	} else {
-		response.Data = false
+	code, mesg, err := controller.queue.submit(ctx, tmpCmd)
+	//logger.Infof("MCU response : %v", mesg)
+
+	powerState := decodePowerState(mesg)
+
+	target, isPowerCmd := targetPowerState(tmpCmd)
+	if err == nil && isPowerCmd && c.Query("verify") == "true" {
+		verifyCtx, verifyCancel := context.WithTimeout(c.Request.Context(), verifyTimeOut(c.Query("timeout")))
+		defer verifyCancel()
+
+		powerState, mesg, code, err = verifyPowerState(verifyCtx, controller.queue, tmpCmd, target)
 	}
 
-	if err == nil {
-		response.State = "success"
-		c.IndentedJSON(http.StatusOK, response)
-	} else {
+	elapsedSeconds := int(time.Since(startTime).Seconds())
+
+	if err != nil {
+		logger.Info(err.Error())
+
 		var failResponse McuResponseFail
 		failResponse.State = "fail"
 		failResponse.Message = err.Error()
 		failResponse.ErrorType = strconv.Itoa(code)
-		if mcuCode == 9 {
+
+		if code == ERROR_QUEUE_FULL || code == ERROR_DEADLINE_EXCEEDED {
+			c.IndentedJSON(http.StatusServiceUnavailable, failResponse)
+		} else if code == ERROR_VERIFY_TIMEOUT {
+			c.IndentedJSON(http.StatusGatewayTimeout, failResponse)
+		} else if code == ERROR_UNKNOWN_CMD {
 			c.IndentedJSON(http.StatusBadRequest, failResponse)
 		} else {
 			c.IndentedJSON(http.StatusInternalServerError, failResponse)
 		}
+		return
+	}
+
+	if v2 {
+		var response McuResponseV2
+		response.Data = powerState.isOn()
+		response.PowerState = powerState
+		response.McuCode = mesg
+		response.State = "success"
+		response.ElapsedSeconds = elapsedSeconds
+		c.IndentedJSON(http.StatusOK, response)
+	} else {
+		var response McuResponse
+		response.Data = powerState.isOn()
+		response.State = "success"
+		response.ElapsedSeconds = elapsedSeconds
+		c.IndentedJSON(http.StatusOK, response)
 	}
 }
 
 // intialize godoc
 // @Summary      Initialize serial port
-// @Description  Initialize serial port
+// @Description  Initialize serial ports of all controllers
 // @Tags         infra-external
 // @Accept       json
 // @Produce      json
 // @Success      200  {object}  string "Successfully initialized the serial port"
 // @Failure		 500  {object}  string "Failed to initialize the serial port"
+// @Failure		 503  {object}  string "Command queue is full or deadline exceeded"
 // @Router       /initialize [get]
 func initialize(c *gin.Context) {
-	code, err := pwCtrl.intializeConnection()
-	if err != nil {
-		logger.Info("Failed to initialize serial port")
-	} else {
-		logger.Infof("Successfully initialized serial port : %v", pwCtrl.portName)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), commandTimeOut_)
+	defer cancel()
+
+	code := SUCCESS
+	var err error
+	for _, controller := range controllerList() {
+		tmpCode, tmpErr := controller.queue.submitInitialize(ctx)
+		if tmpErr != nil {
+			logger.Infof("Failed to initialize serial port : %v", controller.name)
+			code = tmpCode
+			err = errors.New(controller.name + " : " + tmpErr.Error())
+		} else {
+			logger.Infof("Successfully initialized serial port : %v", controller.pwctl.portName)
+		}
 	}
 
 	if err != nil {
@@ -452,7 +573,11 @@ func initialize(c *gin.Context) {
 		failResponse.State = "fail"
 		failResponse.Message = err.Error()
 		failResponse.ErrorType = strconv.Itoa(code)
-		c.IndentedJSON(http.StatusInternalServerError, failResponse)
+		if code == ERROR_QUEUE_FULL || code == ERROR_DEADLINE_EXCEEDED {
+			c.IndentedJSON(http.StatusServiceUnavailable, failResponse)
+		} else {
+			c.IndentedJSON(http.StatusInternalServerError, failResponse)
+		}
 	} else {
 		var response McuResponse
 		response.Data = true
@@ -462,139 +587,360 @@ func initialize(c *gin.Context) {
 	}
 }
 
-func (pwctl *PwCtrl) setCommand(cmdStr string, response *string, sleepUTime int) (int, error) {
-	if pwctl.reIntializing {
-		return ERROR_IN_INITAILIZING, errors.New("in re-initializing")
+// getControllers godoc
+// @Summary      List power controllers
+// @Description  List power controllers with their ports, connection states and routes
+// @Tags         infra-external
+// @Produce      json
+// @Success      200  {array}  ControllerState "Power controllers"
+// @Router       /controllers [get]
+func getControllers(c *gin.Context) {
+	controllers := controllerList()
+	states := make([]ControllerState, 0, len(controllers))
+	for _, controller := range controllers {
+		var state ControllerState
+		state.Name = controller.name
+		status := controller.pwctl.reconnect.snapshot()
+		state.PortName = status.PortName
+		state.Driver = controller.pwctl.driver.Name()
+		state.Connected = status.State == CONNECTION_CONNECTED
+		state.Routes = routes_.routeSpecs(controller)
+		states = append(states, state)
 	}
+	c.IndentedJSON(http.StatusOK, states)
+}
 
-	if inComMCU_ {
-		error := errors.New("Busy serial communication")
-		//logger.Info(error)
-		return ERROR_PORT_BUSY, error
-	} else {
-		inComMCU_ = true
+// startDiscovery godoc
+// @Summary      Discover workstation ids of controllers
+// @Description  Probe workstation ids with C<id> on every controller (or the given one) in background and rebuild the routing table
+// @Tags         infra-external
+// @Produce      json
+// @Param        from        query  int     false  "First workstation id to probe (default: 0)"
+// @Param        to          query  int     false  "Last workstation id to probe (default: 127)"
+// @Param        controller  query  string  false  "Controller name to probe"
+// @Success      202  {object}  DiscoveryResult "Discovery started"
+// @Failure		 400  {object}  McuResponseFail "Invalid range or unknown controller"
+// @Failure		 409  {object}  DiscoveryResult "Discovery already running"
+// @Router       /admin/discover [post]
+func startDiscovery(c *gin.Context) {
+	firstId, err1 := strconv.Atoi(c.DefaultQuery("from", strconv.Itoa(discoveryFirstId_)))
+	lastId, err2 := strconv.Atoi(c.DefaultQuery("to", strconv.Itoa(discoveryLastId_)))
+	if err1 != nil || err2 != nil || firstId < 0 || lastId > 9999 || firstId > lastId {
+		var failResponse McuResponseFail
+		failResponse.State = "fail"
+		failResponse.Message = "invalid workstation id range"
+		failResponse.ErrorType = strconv.Itoa(ERROR_BAD_REQUEST)
+		c.IndentedJSON(http.StatusBadRequest, failResponse)
+		return
+	}
+
+	controllers := controllerList()
+	if name := c.Query("controller"); name != "" {
+		controllers = nil
+		for _, controller := range controllerList() {
+			if controller.name == name {
+				controllers = append(controllers, controller)
+			}
+		}
+		if len(controllers) == 0 {
+			var failResponse McuResponseFail
+			failResponse.State = "fail"
+			failResponse.Message = "unknown controller : " + name
+			failResponse.ErrorType = strconv.Itoa(ERROR_NO_CONTROLLER)
+			c.IndentedJSON(http.StatusBadRequest, failResponse)
+			return
+		}
+	}
+
+	if !beginDiscovery(firstId, lastId) {
+		c.IndentedJSON(http.StatusConflict, lastDiscovery())
+		return
+	}
+
+	go discoverRoutes(context.Background(), controllers, firstId, lastId)
+
+	c.IndentedJSON(http.StatusAccepted, lastDiscovery())
+}
+
+// getDiscovery godoc
+// @Summary      Result of the last discovery
+// @Description  Result of the last discovery of workstation ids
+// @Tags         infra-external
+// @Produce      json
+// @Success      200  {object}  DiscoveryResult "Last discovery"
+// @Router       /admin/discovery [get]
+func getDiscovery(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, lastDiscovery())
+}
+
+// getLeader godoc
+// @Summary      Leader election state
+// @Description  Role of this replica (leader or standby) and the lease of the leader
+// @Tags         infra-external
+// @Produce      json
+// @Success      200  {object}  LeaderStatus "Leader election state"
+// @Router       /admin/leader [get]
+func getLeader(c *gin.Context) {
+	status := leaderState()
+	if !haEnabled_ {
+		status.Role = ROLE_LEADER
+	}
+	c.IndentedJSON(http.StatusOK, status)
+}
+
+// getConnections godoc
+// @Summary      Connection states of the controllers
+// @Description  State of the serial port reconnect state machine per controller : state, attempts, last error, last success and the port in use
+// @Tags         infra-external
+// @Produce      json
+// @Success      200  {array}  ConnectionStatus "Connection states"
+// @Router       /admin/connections [get]
+func getConnections(c *gin.Context) {
+	controllers := controllerList()
+	states := make([]ConnectionStatus, 0, len(controllers))
+	for _, controller := range controllers {
+		states = append(states, controller.connectionStatus())
+	}
+	c.IndentedJSON(http.StatusOK, states)
+}
+
+// injectHotplug godoc
+// @Summary      Inject a synthetic uevent
+// @Description  Handle a tty add/remove uevent as if it came from the kernel, to test hotplug handling. Only with hotplug.allowInject.
+// @Tags         infra-external
+// @Produce      json
+// @Param        action   query  string  true  "add or remove"
+// @Param        devname  query  string  true  "Device name (ex: ttyACM0)"
+// @Success      200  {object}  Uevent "Uevent handled"
+// @Failure		 400  {object}  McuResponseFail "Invalid uevent or injection not allowed"
+// @Router       /admin/uevent [post]
+func injectHotplug(c *gin.Context) {
+	ev := Uevent{
+		Action:    c.Query("action"),
+		Subsystem: c.DefaultQuery("subsystem", "tty"),
+		DevName:   c.Query("devname"),
+	}
+
+	err := injectUevent(ev)
+	if err != nil {
+		var failResponse McuResponseFail
+		failResponse.State = "fail"
+		failResponse.Message = err.Error()
+		failResponse.ErrorType = strconv.Itoa(ERROR_CONFIG)
+		c.IndentedJSON(http.StatusBadRequest, failResponse)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, ev)
+}
+
+// getLatency godoc
+// @Summary      MCU response latency
+// @Description  Histogram of the MCU response latency per controller and command type, with the current wait before reading
+// @Tags         infra-external
+// @Produce      json
+// @Param        reset  query  bool  false  "Clear the histograms after reading"
+// @Success      200  {array}  ControllerLatency "Response latency"
+// @Router       /admin/latency [get]
+func getLatency(c *gin.Context) {
+	reset := c.Query("reset") == "true"
+
+	controllers := controllerList()
+	latencies := make([]ControllerLatency, 0, len(controllers))
+	for _, controller := range controllers {
+		var latency ControllerLatency
+		latency.Name = controller.name
+		latency.Status = controller.pwctl.latency.stats(PRIORITY_STATUS)
+		latency.Power = controller.pwctl.latency.stats(PRIORITY_POWER)
+		latencies = append(latencies, latency)
+
+		if reset {
+			controller.pwctl.latency.reset()
+		}
+	}
+	c.IndentedJSON(http.StatusOK, latencies)
+}
+
+// reload godoc
+// @Summary      Reload configuration
+// @Description  Read the configuration again and apply it. Unchanged controllers stay connected, only the controllers with a changed port are reopened. The same as SIGHUP.
+// @Tags         infra-external
+// @Produce      json
+// @Success      200  {object}  ReloadResult "Configuration reloaded"
+// @Failure		 400  {object}  McuResponseFail "Invalid configuration"
+// @Failure		 409  {object}  McuResponseFail "Discovery is running"
+// @Router       /admin/reload [post]
+func reload(c *gin.Context) {
+	result, code, err := reloadConfig()
+	if err != nil {
+		var failResponse McuResponseFail
+		failResponse.State = "fail"
+		failResponse.Message = err.Error()
+		failResponse.ErrorType = strconv.Itoa(code)
+		if code == ERROR_RELOAD_BUSY {
+			c.IndentedJSON(http.StatusConflict, failResponse)
+		} else {
+			c.IndentedJSON(http.StatusBadRequest, failResponse)
+		}
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, result)
+}
+
+// usesPort is false for a network driver, its commands need not wait for each other
+func (pwctl *PwCtrl) usesPort() bool {
+	pwctl.portMutex.Lock()
+	defer pwctl.portMutex.Unlock()
+
+	return pwctl.driver.UsesPort()
+}
+
+// readDeadline returns the read deadline of the command
+func (pwctl *PwCtrl) readDeadline(cmdStr string) time.Duration {
+	if commandPriority(cmdStr) == PRIORITY_STATUS {
+		return pwctl.readDeadlines.status
+	}
+	return pwctl.readDeadlines.power
+}
+
+// setCommand runs the command with the driver. The caller holds portMutex,
+// which is released during the exchange of a network driver.
+func (pwctl *PwCtrl) setCommand(cmdStr string, response *string) (int, error) {
+	if pwctl.standby {
+		return ERROR_NOT_LEADER, errors.New("standby replica, the port is used by the leader")
+	}
+	if pwctl.reIntializing {
+		return ERROR_IN_INITAILIZING, errors.New("in re-initializing")
 	}
 
-	// NOTE : Clear input buffer before writing
+	// NOTE : Clear input buffer before writing, a network driver has no port
 	errCode := 0
 	error := errors.New("")
 
-	if pwctl.serialPort != nil {
-		if pwctl.serialPort.ResetInputBuffer() != nil {
-			errCode = ERROR_RESET_INBUFFER
-			error = errors.New("Failed to reset input buffer")
-			inComMCU_ = false
-			//return ERROR_RESET_INBUFFER, errors.New("Failed to reset input buffer")
+	if pwctl.driver.UsesPort() {
+		if pwctl.transport != nil {
+			if pwctl.transport.ResetInputBuffer() != nil {
+				errCode = ERROR_RESET_INBUFFER
+				error = errors.New("Failed to reset input buffer")
+			}
+		} else {
+			errCode = ERROR_PORT_NOT_SPECIFIED
+			error = errors.New("Serial port not specified")
 		}
-	} else {
-		inComMCU_ = false
-		errCode = ERROR_PORT_NOT_SPECIFIED
-		error = errors.New("Serial port not specified")
-		//return ERROR_PORT_NOT_SPECIFIED, errors.New("Serial port not specified")
 	}
 
 	if errCode != 0 {
-		pwctl.connectInitialized = false
-		if !pwctl.reIntializing {
-			logger.Info("Re-initializing serial port")
-			go pwctl.reIntializeConnection()
-		} else {
-			return errCode, error
-		}
+		pwctl.startReIntializing(error)
+		return errCode, error
 	}
 
 	logger.Info("Sent command : ", cmdStr)
 
-	err := pwctl.write([]byte(cmdStr))
-	if err != nil {
-		pwctl.connectInitialized = false
+	writtenAt := time.Now()
+	priority := commandPriority(cmdStr)
+	deadline := writtenAt.Add(pwctl.readDeadline(cmdStr))
 
-		//Re-initializing as a separate thread
-		if !pwctl.reIntializing {
-			logger.Info("Re-initializing serial port")
-			go pwctl.reIntializeConnection()
+	// NOTE : A network driver has no port to guard, the commands of the
+	// other workstations run meanwhile instead of waiting for this host
+	driver := pwctl.driver
+	if !driver.UsesPort() {
+		pwctl.portMutex.Unlock()
+	}
+	mesg, code, err := driver.Exchange(pwctl, cmdStr, deadline)
+	if !driver.UsesPort() {
+		pwctl.portMutex.Lock()
+	}
+	if err != nil {
+		if code == ERROR_NO_DATA_READ || code == ERROR_INCOMPLETE_FRAME {
+			pwctl.latency.timeout(priority)
 		}
-		logger.Info(err.Error())
-
-		inComMCU_ = false
-		return ERROR_WRITING, err
-	} else {
-		// NOTE : Some sleep before reading to avoid dropping in response
-		time.Sleep(200 * time.Millisecond)
-
-		tmpRes := make([]byte, 64)
-		n, err := pwctl.read(tmpRes)
-		if n == 0 {
-			errMesg := "ERROR : no data read"
-			logger.Info(errMesg)
-			inComMCU_ = false
-			return ERROR_NO_DATA_READ, errors.New(errMesg)
+		// NOTE : A write or read error means the port is lost (unplugged, connection closed)
+		if code == ERROR_WRITING || code == ERROR_READING {
+			//Re-initializing as a separate thread
+			pwctl.startReIntializing(err)
 		}
+		logger.Info(err.Error())
+		return code, err
+	}
+	pwctl.latency.observe(priority, time.Since(writtenAt))
 
-		if err != nil {
-			logger.Info(err.Error())
+	// NOTE : Every driver answers with a response code, nothing is not an answer
+	if len(mesg) == 0 {
+		errMesg := "ERROR : empty response from " + pwctl.driver.Name() + " driver"
+		logger.Info(errMesg)
+		return ERROR_INVALID_FRAME, errors.New(errMesg)
+	}
 
-			inComMCU_ = false
-			return ERROR_READING, err
-		}
+	*response = mesg
+	logger.Info("Received data : ", *response)
 
-		*response = string(tmpRes)
-		logger.Info("Received data : ", (*response)[:1])
-		//fmt.Println("n=", n)
-		//fmt.Println("response = ", response[:n])
-
-		if (*response)[n-1] != '\n' {
-			logger.Info("WARNING : no newline character in response")
-			inComMCU_ = false
-			return SUCCESS, nil
-		} else if (*response)[0] == '9' {
-			errMesg := "ERROR : unknown command or wrong rack-number"
-			logger.Info(errMesg)
-			inComMCU_ = false
-			return ERROR_UNKNOWN_CMD, errors.New(errMesg)
-		}
-		//---------------------------------------------------------
-		// NOTE : Ignore CODE=8
-		// because in many cases the power state is not
-		// correctly sent right after executing a power on/off command.
-		//---------------------------------------------------------
-		//else if response[0] == '8' {
-		//	errMesg = "ERROR : failed to power on/off"
-		//	logger.Info(errMesg)
-		//	return ERROR_POWER_ONOFF, errors.New(errMesg)
-		//}
-
-		inComMCU_ = false
-		return SUCCESS, nil
+	if (*response)[0] == CODE_UNKNOWN_COMMAND {
+		errMesg := "ERROR : unknown command or wrong rack-number"
+		logger.Info(errMesg)
+		return ERROR_UNKNOWN_CMD, errors.New(errMesg)
 	}
+	//---------------------------------------------------------
+	// NOTE : Ignore CODE=8
+	// because in many cases the power state is not
+	// correctly sent right after executing a power on/off command.
+	//---------------------------------------------------------
+	//else if response[0] == '8' {
+	//	errMesg = "ERROR : failed to power on/off"
+	//	logger.Info(errMesg)
+	//	return ERROR_POWER_ONOFF, errors.New(errMesg)
+	//}
+
+	return SUCCESS, nil
 }
 
-func (pwctl *PwCtrl) reIntializeConnection() {
+// startReIntializing marks the connection down for the reason and starts
+// re-initializing as a separate goroutine. The caller must hold portMutex.
+func (pwctl *PwCtrl) startReIntializing(reason error) {
+	pwctl.connectInitialized = false
+	pwctl.reconnect.failed(reason)
+
 	// To prevent multiple executions of re-initializing
 	if !pwctl.reIntializing {
+		logger.Info("Re-initializing serial port")
 		pwctl.reIntializing = true
-		inComMCU_ = true
-
-		for {
-			_, err := pwctl.intializeConnection()
-			if err == nil {
-				pwctl.connectInitialized = true
-				pwctl.reIntializing = false
-				inComMCU_ = false
-				break
-			}
+		go pwctl.reIntializeConnection()
+	}
+}
+
+func (pwctl *PwCtrl) reIntializeConnection() {
+	for {
+		pwctl.portMutex.Lock()
+		if pwctl.closed || pwctl.standby {
+			pwctl.reIntializing = false
+			pwctl.portMutex.Unlock()
+			break
+		}
+		// NOTE : The port may have been initialized by the initialize API meanwhile
+		if !pwctl.connectInitialized {
+			pwctl.intializeConnection()
+		}
+		if pwctl.connectInitialized {
+			pwctl.reIntializing = false
+			pwctl.portMutex.Unlock()
+			break
+		}
+		backoff := pwctl.reconnect.backoff()
+		pwctl.portMutex.Unlock()
 
-			time.Sleep(5 * time.Second)
+		// NOTE : A hotplug event of a matching device ends the wait
+		select {
+		case <-time.After(backoff):
+		case <-pwctl.reconnectWake:
 		}
 	}
 }
 
 func (pwctl *PwCtrl) read(buff []byte) (int, error) {
-	if pwctl.serialPort == nil {
+	if pwctl.transport == nil {
 		return 0, errors.New("serial port not initialized")
 	}
 
-	n, err := pwctl.serialPort.Read(buff)
+	n, err := pwctl.transport.Read(buff)
 	if err != nil {
 		return 0, err
 	}
@@ -607,10 +953,10 @@ func (pwctl *PwCtrl) read(buff []byte) (int, error) {
 }
 
 func (pwctl *PwCtrl) write(data []byte) error {
-	if pwctl.serialPort == nil {
+	if pwctl.transport == nil {
 		return errors.New("serial port not initialized")
 	}
-	_, err := pwctl.serialPort.Write(data)
+	_, err := pwctl.transport.Write(data)
 	if err != nil {
 		return err
 	}
@@ -619,46 +965,73 @@ func (pwctl *PwCtrl) write(data []byte) error {
 	return nil
 }
 
+// intializeConnection opens the port and records the attempt
+// in the reconnect state machine
 func (pwctl *PwCtrl) intializeConnection() (int, error) {
-	if pwctl.serialPort != nil {
-		pwctl.serialPort.Close()
+	pwctl.reconnect.connecting(pwctl.portSelector.String())
+
+	code, err := pwctl.openConnection()
+	if err != nil {
+		pwctl.reconnect.failed(err)
+	} else {
+		pwctl.reconnect.connected(pwctl.portName)
+	}
+	return code, err
+}
+
+func (pwctl *PwCtrl) openConnection() (int, error) {
+	if pwctl.transport != nil {
+		pwctl.transport.Close()
+		pwctl.transport = nil
 	}
 
-	err := pwctl.findSerialPort()
+	// NOTE : A network driver reaches each workstation by itself
+	if !pwctl.driver.UsesPort() {
+		pwctl.portName = pwctl.driver.Name()
+		pwctl.connectInitialized = true
+		return SUCCESS, nil
+	}
+
+	transport, code, err := pwctl.newTransport(pwctl)
 	if err != nil {
 		if !pwctl.reIntializing {
 			logger.Info(err.Error())
 		}
-		return ERROR_NO_PORT_FOUND, err
+		return code, err
 	}
 
-	mode := &serial.Mode{
-		BaudRate: 9600,
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
-	}
-
-	pwctl.serialPort, err = serial.Open(pwctl.portName, mode)
+	err = transport.Open()
 	if err != nil {
 		logger.Info(err.Error())
+		var lockedErr *portlock.LockedError
+		if errors.As(err, &lockedErr) {
+			return ERROR_PORT_LOCKED, err
+		}
 		return ERROR_OPEN_PORT, err
 	}
+	pwctl.transport = transport
+	pwctl.frames = NewFrameReader(transport)
 
-	pwctl.serialPort.SetReadTimeout(time.Duration(pwctl.readTimeOut) * time.Second)
-
-	err = pwctl.serialPort.ResetInputBuffer()
+	err = pwctl.transport.ResetInputBuffer()
 	if err != nil {
 		logger.Info(err.Error())
 		return ERROR_RESET_INBUFFER, err
 	}
 
-	err = pwctl.serialPort.ResetOutputBuffer()
+	err = pwctl.transport.ResetOutputBuffer()
 	if err != nil {
 		logger.Info(err.Error())
 		return ERROR_RESET_OUTBUFFER, err
 	}
 
+	if pwctl.readDeadlines.initialize > 0 {
+		err = pwctl.frames.drain(time.Now().Add(pwctl.readDeadlines.initialize), settleDelay_)
+		if err != nil {
+			logger.Info(err.Error())
+			return ERROR_READING, err
+		}
+	}
+
 	pwctl.connectInitialized = true
 	logger.Info("Serial port re-initialized : ", pwctl.portName)
 
@@ -666,36 +1039,20 @@ func (pwctl *PwCtrl) intializeConnection() (int, error) {
 }
 
 func (p *PwCtrl) findSerialPort() error {
-	ports, err := serial.GetPortsList()
+	portName, err := p.portSelector.find()
 	if err != nil {
 		p.connectInitialized = false
 		return err
 	}
 
-	portList := make([]string, 0)
-
-	for _, port := range ports {
-		for i := 0; i < len(portPrefix_); i++ {
-			prefix := portPrefix_[i]
-			if len(port) >= len(prefix) && port[:len(prefix)] == prefix {
-				portList = append(portList, port)
-			}
-		}
-	}
-
-	if len(portList) != 1 {
-		p.connectInitialized = false
-		return errors.New("no or multiple ports found")
-	}
-
-	p.portName = portList[0]
+	p.portName = portName
 	fmt.Printf("- Serial port found : %v\n", p.portName)
 
 	return nil
 }
 
 func (p *PwCtrl) printValues() {
-	//fmt.Println("prefix:", p.portPrefix)
+	fmt.Println("port:", p.portSelector)
 	fmt.Println("readTimeOut:", p.readTimeOut)
 	fmt.Println("readMinByte:", p.readMinByte)
 	fmt.Println("portName:", p.portName)
@@ -703,26 +1060,22 @@ func (p *PwCtrl) printValues() {
 	fmt.Println("portFound:", p.serialPortFound)
 }
 
+// readInputs reads the configuration and sets the global parameters
 func readInputs(args []string) error {
-	//pwCtrl.portPrefix = "/dev/" + args[1]
-	fmt.Print("portPrefix = ")
-	for i := 0; i < len(portPrefix_); i++ {
-		fmt.Print(portPrefix_[i])
-	}
-	fmt.Println()
-
 	var err error
-	pwCtrl.readTimeOut, err = strconv.Atoi(args[1])
+	config_, err = readConfig(args)
 	if err != nil {
 		return err
 	}
-	fmt.Println("readTimeOut = ", pwCtrl.readTimeOut)
+	configArgs_ = args
 
-	pwCtrl.readMinByte, err = strconv.Atoi(args[2])
+	config_.applyGlobals()
+	err = config_.applyHA()
 	if err != nil {
 		return err
 	}
-	fmt.Println("readMinByte = ", pwCtrl.readMinByte)
+	fmt.Println("readTimeOut = ", readTimeOut_)
+	fmt.Println("readMinByte = ", readMinByte_)
 
 	return nil
 }
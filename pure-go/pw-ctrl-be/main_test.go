@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+const testDeadline = 200 * time.Millisecond
+
+// mcuReply answers every command with the given bytes
+func mcuReply(reply string) MemoryResponder {
+	return func(data []byte) []byte {
+		return []byte(reply)
+	}
+}
+
+// newMemoryPwCtrl returns a PwCtrl opened on an in-memory MCU
+func newMemoryPwCtrl(t *testing.T, responder MemoryResponder) (*PwCtrl, *MemoryTransport) {
+	t.Helper()
+
+	settleDelay := settleDelay_
+	settleDelay_ = 0
+	t.Cleanup(func() {
+		settleDelay_ = settleDelay
+	})
+
+	transport := NewMemoryTransport("mem0", responder, testDeadline)
+	pwctl := NewPwCtrl(PortSelector{}, &serial.Mode{}, 1, 0)
+	pwctl.newTransport = memoryTransportFactory(transport)
+	pwctl.readDeadlines = ReadDeadlines{status: testDeadline, power: testDeadline}
+
+	pwctl.portMutex.Lock()
+	_, err := pwctl.intializeConnection()
+	pwctl.portMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		pwctl.portMutex.Lock()
+		// NOTE : A closed controller stops reconnecting
+		pwctl.closed = true
+		transport.Close()
+		pwctl.portMutex.Unlock()
+	})
+	return pwctl, transport
+}
+
+// runCommand runs setCommand holding portMutex as the queue does
+func runCommand(pwctl *PwCtrl, cmdStr string) (int, string, error) {
+	pwctl.portMutex.Lock()
+	defer pwctl.portMutex.Unlock()
+
+	var response string
+	code, err := pwctl.setCommand(cmdStr, &response)
+	return code, response, err
+}
+
+func TestSetCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		code     int
+		response string
+	}{
+		{"status on", "1\r\n", SUCCESS, "1"},
+		{"status off", "0\r\n", SUCCESS, "0"},
+		{"noise around the frame", "\r\n\x00 3 \r\n", SUCCESS, "3"},
+		{"last of several frames", "0\r\n1\r\n", SUCCESS, "1"},
+		{"unknown command", "9\r\n", ERROR_UNKNOWN_CMD, "9"},
+		{"no reply", "", ERROR_NO_DATA_READ, ""},
+		{"no delimiter", "1", ERROR_INCOMPLETE_FRAME, ""},
+		{"empty frames only", "\r\n\r\n", ERROR_NO_DATA_READ, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pwctl, transport := newMemoryPwCtrl(t, mcuReply(tt.reply))
+
+			code, response, err := runCommand(pwctl, "C0001")
+			if code != tt.code {
+				t.Fatalf("code = %v, want %v (err %v)", code, tt.code, err)
+			}
+			if (err != nil) != (tt.code != SUCCESS) {
+				t.Fatalf("err = %v with code %v", err, code)
+			}
+			if response != tt.response {
+				t.Errorf("response = %q, want %q", response, tt.response)
+			}
+			if written := string(transport.Written()); written != "C0001" {
+				t.Errorf("written = %q, want %q", written, "C0001")
+			}
+		})
+	}
+}
+
+func TestSetCommandTimeout(t *testing.T) {
+	pwctl, _ := newMemoryPwCtrl(t, nil)
+
+	start := time.Now()
+	code, _, err := runCommand(pwctl, "S0001")
+	elapsed := time.Since(start)
+
+	if code != ERROR_NO_DATA_READ || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_NO_DATA_READ", code, err)
+	}
+	if elapsed < testDeadline || elapsed > testDeadline+time.Second {
+		t.Errorf("returned after %v, want the read deadline %v", elapsed, testDeadline)
+	}
+	// NOTE : A timeout is not a lost port
+	if pwctl.reIntializing {
+		t.Error("re-initializing after a timeout")
+	}
+}
+
+func TestSetCommandSplitDelimiter(t *testing.T) {
+	var transport *MemoryTransport
+	responder := func(data []byte) []byte {
+		// NOTE : The LF of the CRLF arrives in a later read
+		time.AfterFunc(testDeadline/4, func() {
+			transport.Inject([]byte("\n"))
+		})
+		return []byte("1\r")
+	}
+	pwctl, transport := newMemoryPwCtrl(t, responder)
+
+	code, response, err := runCommand(pwctl, "C0001")
+	if code != SUCCESS || err != nil {
+		t.Fatalf("code = %v, err = %v, want SUCCESS", code, err)
+	}
+	if response != "1" {
+		t.Errorf("response = %q, want %q", response, "1")
+	}
+}
+
+func TestSetCommandResetInputBufferFailure(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+
+	// NOTE : A closed memory transport fails to reset its input buffer
+	transport.Close()
+
+	code, _, err := runCommand(pwctl, "C0001")
+	if code != ERROR_RESET_INBUFFER || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_RESET_INBUFFER", code, err)
+	}
+	if len(transport.Written()) != 0 {
+		t.Errorf("written = %q, want nothing", transport.Written())
+	}
+
+	// The port is re-initialized in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pwctl.portMutex.Lock()
+		connected := pwctl.connectInitialized && !pwctl.reIntializing
+		pwctl.portMutex.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not re-initialized")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, response, err := runCommand(pwctl, "C0001")
+	if code != SUCCESS || response != "1" {
+		t.Fatalf("after re-initializing : code = %v, response = %q, err = %v", code, response, err)
+	}
+}
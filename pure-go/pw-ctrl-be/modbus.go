@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------
+// Modbus RTU driver (relay boards)
+//---------------------------------------------------------
+
+// Modbus function codes
+const (
+	MODBUS_READ_COILS           = 0x01
+	MODBUS_READ_DISCRETE_INPUTS = 0x02
+	MODBUS_WRITE_SINGLE_COIL    = 0x05
+	// NOTE : The function code of an exception response has this bit set
+	MODBUS_EXCEPTION = 0x80
+)
+
+// Modbus exception codes answered as an unknown workstation
+const (
+	MODBUS_ILLEGAL_FUNCTION     = 0x01
+	MODBUS_ILLEGAL_DATA_ADDRESS = 0x02
+	MODBUS_ILLEGAL_DATA_VALUE   = 0x03
+)
+
+// ModbusConfig maps the workstation ids to the coils and discrete inputs
+// of a relay board : workstation firstId is coil coilBase and input inputBase.
+// A zero slaveId is slave 1.
+type ModbusConfig struct {
+	SlaveId   int `yaml:"slaveId"`
+	FirstId   int `yaml:"firstId"`
+	CoilBase  int `yaml:"coilBase"`
+	InputBase int `yaml:"inputBase"`
+	// inputs : the power state is read from the discrete inputs (power sense),
+	// coils : the relay state is read back when the board has no inputs
+	Status string `yaml:"status"`
+}
+
+// ModbusDriver switches a workstation with a coil of a Modbus RTU slave.
+//   - S : coil on, answered with 1
+//   - Q, E : coil off, answered with 0. A relay has no graceful shutdown.
+//   - C : discrete input (or coil), answered with 0 or 1
+//
+// Exceptions for an illegal function, address or value are answered
+// with 9, as an unknown workstation. Other exceptions are answered with 8.
+type ModbusDriver struct {
+	slaveId         byte
+	firstId         int
+	coilBase        int
+	inputBase       int
+	statusFromCoils bool
+}
+
+// driver validates the configuration and returns the driver
+func (mc ModbusConfig) driver() (Driver, error) {
+	if mc.SlaveId == 0 {
+		mc.SlaveId = 1
+	}
+	if mc.SlaveId < 1 || mc.SlaveId > 247 {
+		return nil, errors.New("modbus : slaveId must be 1~247 : " + strconv.Itoa(mc.SlaveId))
+	}
+	if mc.FirstId < 0 || mc.CoilBase < 0 || mc.CoilBase > 0xffff || mc.InputBase < 0 || mc.InputBase > 0xffff {
+		return nil, errors.New("modbus : invalid firstId, coilBase or inputBase")
+	}
+
+	d := ModbusDriver{
+		slaveId:   byte(mc.SlaveId),
+		firstId:   mc.FirstId,
+		coilBase:  mc.CoilBase,
+		inputBase: mc.InputBase,
+	}
+	switch strings.ToLower(mc.Status) {
+	case "", "inputs":
+	case "coils":
+		d.statusFromCoils = true
+	default:
+		return nil, errors.New("modbus : invalid status : " + mc.Status + " (inputs or coils)")
+	}
+	return d, nil
+}
+
+func (d ModbusDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	letter, id, err := parseCommand(cmdStr)
+	if err != nil {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	var request []byte
+	var length int
+	switch letter {
+	case 'S', 'Q', 'E':
+		var value uint16
+		if letter == 'S' {
+			value = 0xff00
+		}
+		address, ok := d.address(d.coilBase, id)
+		if !ok {
+			return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+		}
+		request = d.request(MODBUS_WRITE_SINGLE_COIL, address, value)
+		// NOTE : Echo of the request
+		length = 8
+	case 'C':
+		function := byte(MODBUS_READ_DISCRETE_INPUTS)
+		base := d.inputBase
+		if d.statusFromCoils {
+			function = MODBUS_READ_COILS
+			base = d.coilBase
+		}
+		address, ok := d.address(base, id)
+		if !ok {
+			return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+		}
+		// NOTE : One bit : slave, function, byte count, data, CRC
+		request = d.request(function, address, 1)
+		length = 6
+	default:
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	pwctl.frames.discard()
+	err = pwctl.write(request)
+	if err != nil {
+		return "", ERROR_WRITING, err
+	}
+
+	frame, code, err := pwctl.frames.readRtuFrame(deadline, d.slaveId, request[1], length)
+	if err != nil {
+		return "", code, err
+	}
+
+	if frame[1]&MODBUS_EXCEPTION != 0 {
+		logger.Infof("Modbus exception %v for %v", frame[2], cmdStr)
+		switch frame[2] {
+		case MODBUS_ILLEGAL_FUNCTION, MODBUS_ILLEGAL_DATA_ADDRESS, MODBUS_ILLEGAL_DATA_VALUE:
+			return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+		}
+		return string(CODE_POWER_FAIL), SUCCESS, nil
+	}
+
+	switch letter {
+	case 'S':
+		return string(CODE_ON), SUCCESS, nil
+	case 'Q', 'E':
+		return string(CODE_OFF), SUCCESS, nil
+	}
+	if frame[3]&0x01 != 0 {
+		return string(CODE_ON), SUCCESS, nil
+	}
+	return string(CODE_OFF), SUCCESS, nil
+}
+
+func (d ModbusDriver) Name() string {
+	return DRIVER_MODBUS
+}
+
+func (d ModbusDriver) UsesPort() bool {
+	return true
+}
+
+// address returns the coil or input address of the workstation
+func (d ModbusDriver) address(base int, id int) (uint16, bool) {
+	address := base + id - d.firstId
+	if id < d.firstId || address > 0xffff {
+		return 0, false
+	}
+	return uint16(address), true
+}
+
+// request builds a request frame of two 16-bit fields with the CRC
+func (d ModbusDriver) request(function byte, address uint16, value uint16) []byte {
+	frame := []byte{d.slaveId, function, byte(address >> 8), byte(address), byte(value >> 8), byte(value)}
+	crc := modbusCrc(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+// readRtuFrame returns the response of the slave to the function.
+// Bytes before the slave address and the function are dropped, as noise
+// or late answers. A normal response is length bytes, an exception 5 bytes.
+// ERROR_INVALID_FRAME is returned if the CRC does not match.
+func (f *FrameReader) readRtuFrame(deadline time.Time, slave byte, function byte, length int) ([]byte, int, error) {
+	buff := make([]byte, 64)
+
+	for {
+		for len(f.pending) > 0 && f.pending[0] != slave {
+			f.pending = f.pending[1:]
+		}
+		if len(f.pending) >= 2 && f.pending[1]&^MODBUS_EXCEPTION != function {
+			f.pending = f.pending[1:]
+			continue
+		}
+
+		expected := length
+		if len(f.pending) >= 2 && f.pending[1]&MODBUS_EXCEPTION != 0 {
+			expected = 5
+		}
+		if len(f.pending) >= expected {
+			frame := append([]byte(nil), f.pending[:expected]...)
+			f.pending = f.pending[expected:]
+
+			crc := modbusCrc(frame[:expected-2])
+			if frame[expected-2] != byte(crc) || frame[expected-1] != byte(crc>>8) {
+				return nil, ERROR_INVALID_FRAME, errors.New("ERROR : invalid CRC : " + hex.EncodeToString(frame))
+			}
+			return frame, SUCCESS, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if len(f.pending) == 0 {
+				return nil, ERROR_NO_DATA_READ, errors.New("ERROR : no data read")
+			}
+			return nil, ERROR_INCOMPLETE_FRAME, errors.New("ERROR : incomplete response : " + hex.EncodeToString(f.pending))
+		}
+
+		err := f.transport.SetReadTimeout(remaining)
+		if err != nil {
+			return nil, ERROR_READING, err
+		}
+
+		n, err := f.transport.Read(buff)
+		if err != nil {
+			return nil, ERROR_READING, err
+		}
+		f.pending = append(f.pending, buff[:n]...)
+	}
+}
+
+// modbusCrc is the CRC-16/MODBUS of the frame, sent low byte first
+func modbusCrc(frame []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range frame {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
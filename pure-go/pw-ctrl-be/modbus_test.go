@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// rtu appends the CRC to the frame
+func rtu(frame ...byte) []byte {
+	crc := modbusCrc(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+func TestModbusCrc(t *testing.T) {
+	tests := []struct {
+		frame []byte
+		crc   uint16
+	}{
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x01}, 0x0a84},
+		{[]byte{0x01, 0x05, 0x00, 0x00, 0xff, 0x00}, 0x3a8c},
+		{[]byte("123456789"), 0x4b37},
+		{nil, 0xffff},
+	}
+
+	for _, tt := range tests {
+		if crc := modbusCrc(tt.frame); crc != tt.crc {
+			t.Errorf("modbusCrc(% x) = %#04x, want %#04x", tt.frame, crc, tt.crc)
+		}
+	}
+}
+
+func TestReadRtuFrame(t *testing.T) {
+	status := rtu(0x01, MODBUS_READ_DISCRETE_INPUTS, 0x01, 0x01)
+	badCrc := append([]byte(nil), status...)
+	badCrc[5] ^= 0xff
+
+	tests := []struct {
+		name  string
+		reads [][]byte
+		frame []byte
+		code  int
+	}{
+		{"response", [][]byte{status}, status, SUCCESS},
+		{"exception", [][]byte{rtu(0x01, MODBUS_READ_DISCRETE_INPUTS|MODBUS_EXCEPTION, MODBUS_ILLEGAL_DATA_ADDRESS)},
+			rtu(0x01, MODBUS_READ_DISCRETE_INPUTS|MODBUS_EXCEPTION, MODBUS_ILLEGAL_DATA_ADDRESS), SUCCESS},
+		{"split across reads", [][]byte{status[:1], status[1:4], status[4:]}, status, SUCCESS},
+		{"leading noise", [][]byte{{0x00, 0xff, 0x13}, status}, status, SUCCESS},
+		{"noise in a later read", [][]byte{{0x00}, {0xfe, 0x7f}, status}, status, SUCCESS},
+		{"other slave", [][]byte{rtu(0x02, MODBUS_READ_DISCRETE_INPUTS, 0x01, 0x00), status}, status, SUCCESS},
+		{"other function", [][]byte{rtu(0x01, MODBUS_WRITE_SINGLE_COIL, 0x00, 0x00, 0xff, 0x00), status}, status, SUCCESS},
+		{"exception of another function", [][]byte{rtu(0x01, MODBUS_READ_COILS|MODBUS_EXCEPTION, MODBUS_ILLEGAL_FUNCTION), status}, status, SUCCESS},
+		{"invalid CRC", [][]byte{badCrc}, nil, ERROR_INVALID_FRAME},
+		{"partial frame", [][]byte{status[:4]}, nil, ERROR_INCOMPLETE_FRAME},
+		{"partial exception", [][]byte{{0x01, MODBUS_READ_DISCRETE_INPUTS | MODBUS_EXCEPTION, 0x02}}, nil, ERROR_INCOMPLETE_FRAME},
+		{"noise only", [][]byte{{0x00, 0xff, 0x13}}, nil, ERROR_NO_DATA_READ},
+		{"no response", nil, nil, ERROR_NO_DATA_READ},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := NewMemoryTransport("mem0", nil, testDeadline)
+			transport.Open()
+			defer transport.Close()
+
+			// NOTE : The reads arrive apart so each is read on its own
+			for i, chunk := range tt.reads {
+				chunk := chunk
+				time.AfterFunc(time.Duration(i)*testDeadline/10, func() {
+					transport.Inject(chunk)
+				})
+			}
+
+			frames := NewFrameReader(transport)
+			start := time.Now()
+			frame, code, err := frames.readRtuFrame(start.Add(testDeadline), 0x01, MODBUS_READ_DISCRETE_INPUTS, 6)
+			elapsed := time.Since(start)
+
+			if code != tt.code || (err != nil) != (tt.code != SUCCESS) {
+				t.Fatalf("code = %v, err = %v, want %v", code, err, tt.code)
+			}
+			if !bytes.Equal(frame, tt.frame) {
+				t.Errorf("frame = % x, want % x", frame, tt.frame)
+			}
+			// A frame is returned as soon as it is complete, a partial one at the deadline
+			if tt.code == SUCCESS && elapsed >= testDeadline {
+				t.Errorf("returned after %v, before the deadline expected", elapsed)
+			}
+			if (tt.code == ERROR_INCOMPLETE_FRAME || tt.code == ERROR_NO_DATA_READ) && elapsed < testDeadline {
+				t.Errorf("returned after %v, at the deadline %v expected", elapsed, testDeadline)
+			}
+		})
+	}
+}
+
+func TestModbusExchange(t *testing.T) {
+	echo := func(data []byte) []byte {
+		return data
+	}
+	inputs := func(value byte) MemoryResponder {
+		return func(data []byte) []byte {
+			return rtu(data[0], data[1], 0x01, value)
+		}
+	}
+	exception := func(code byte) MemoryResponder {
+		return func(data []byte) []byte {
+			return rtu(data[0], data[1]|MODBUS_EXCEPTION, code)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		config    ModbusConfig
+		cmd       string
+		responder MemoryResponder
+		request   []byte
+		response  string
+	}{
+		{"power on", ModbusConfig{FirstId: 1}, "S0001", echo, rtu(0x01, MODBUS_WRITE_SINGLE_COIL, 0x00, 0x00, 0xff, 0x00), "1"},
+		{"power off", ModbusConfig{FirstId: 1, CoilBase: 16}, "Q0003", echo, rtu(0x01, MODBUS_WRITE_SINGLE_COIL, 0x00, 0x12, 0x00, 0x00), "0"},
+		{"input on", ModbusConfig{SlaveId: 7, FirstId: 1}, "C0002", inputs(0x01), rtu(0x07, MODBUS_READ_DISCRETE_INPUTS, 0x00, 0x01, 0x00, 0x01), "1"},
+		{"input off", ModbusConfig{FirstId: 1}, "C0001", inputs(0x00), rtu(0x01, MODBUS_READ_DISCRETE_INPUTS, 0x00, 0x00, 0x00, 0x01), "0"},
+		{"coil read back", ModbusConfig{FirstId: 1, Status: "coils"}, "C0001", inputs(0x01), rtu(0x01, MODBUS_READ_COILS, 0x00, 0x00, 0x00, 0x01), "1"},
+		{"illegal address", ModbusConfig{FirstId: 1}, "S0001", exception(MODBUS_ILLEGAL_DATA_ADDRESS), rtu(0x01, MODBUS_WRITE_SINGLE_COIL, 0x00, 0x00, 0xff, 0x00), "9"},
+		{"slave failure", ModbusConfig{FirstId: 1}, "C0001", exception(0x04), rtu(0x01, MODBUS_READ_DISCRETE_INPUTS, 0x00, 0x00, 0x00, 0x01), "8"},
+		{"id below firstId", ModbusConfig{FirstId: 10}, "S0009", echo, nil, "9"},
+		{"unknown command", ModbusConfig{FirstId: 1}, "X0001", echo, nil, "9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver, err := tt.config.driver()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pwctl, transport := newMemoryPwCtrl(t, tt.responder)
+			pwctl.driver = driver
+
+			// NOTE : An unknown workstation is an error of setCommand
+			want := SUCCESS
+			if tt.response == string(CODE_UNKNOWN_COMMAND) {
+				want = ERROR_UNKNOWN_CMD
+			}
+			code, response, err := runCommand(pwctl, tt.cmd)
+			if code != want {
+				t.Fatalf("code = %v, err = %v, want %v", code, err, want)
+			}
+			if response != tt.response {
+				t.Errorf("response = %q, want %q", response, tt.response)
+			}
+			if written := transport.Written(); !bytes.Equal(written, tt.request) {
+				t.Errorf("request = % x, want % x", written, tt.request)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+// Package portlock locks a serial device exclusively between processes.
+// The backend and the test CLI both take the lock, so that their commands
+// to the MCU cannot interleave.
+package portlock
+
+// LockedError tells which process holds the lock of the device
+type LockedError struct {
+	Device string
+	Holder string
+}
+
+func (e *LockedError) Error() string {
+	return "serial port " + e.Device + " is locked by " + e.Holder
+}
@@ -0,0 +1,124 @@
+package portlock
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Lock is an advisory exclusive lock (flock) on a serial device.
+// Every process opening the device through Lock (backends, the test CLI)
+// gets the device alone; go.bug.st/serial adds TIOCEXCL after opening,
+// which only stops non-root processes.
+//
+// go.bug.st/serial does not expose the descriptor of the port, so the lock
+// is a second descriptor of the device. Opening it has the side effects of
+// opening a tty : O_NOCTTY keeps it from becoming the controlling terminal,
+// but the first open of the device raises DTR, which resets a board such as
+// an Arduino. Because the lock is taken right before the port is opened, the
+// reset happens once as it would anyway. The last close drops DTR (HUPCL),
+// which is when the lock is released after the port is closed.
+type Lock struct {
+	device string
+	file   *os.File
+}
+
+// Acquire takes the lock of the device without waiting.
+// It must be taken before the port is opened.
+func Acquire(portName string) (*Lock, error) {
+	device, err := filepath.EvalSymlinks(portName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(device, os.O_RDONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EBUSY) {
+			// NOTE : TIOCEXCL of the port opened by another process
+			return nil, &LockedError{Device: device, Holder: lockHolder(device)}
+		}
+		return nil, err
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, &LockedError{Device: device, Holder: lockHolder(device)}
+		}
+		return nil, os.NewSyscallError("flock", err)
+	}
+
+	return &Lock{device: device, file: file}, nil
+}
+
+// Unlock releases the lock, a nil or released lock is ignored
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	// NOTE : Closing the file releases the flock
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// lockHolder finds the process holding a flock on the device in /proc/locks.
+// A holder in another pid namespace (container) is not visible.
+func lockHolder(device string) string {
+	unknown := "another process"
+
+	var st syscall.Stat_t
+	if syscall.Stat(device, &st) != nil {
+		return unknown
+	}
+	dev := uint64(st.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) & 0xfffff000)
+	minor := (dev & 0xff) | ((dev >> 12) & 0xffffff00)
+
+	file, err := os.Open("/proc/locks")
+	if err != nil {
+		return unknown
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// ex) 1: FLOCK  ADVISORY  WRITE 1234 00:05:87 0 EOF
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		lockMajor, lockMinor, lockInode, ok := parseLockInode(fields[5])
+		if !ok || lockMajor != major || lockMinor != minor || lockInode != st.Ino {
+			continue
+		}
+
+		pid := fields[4]
+		holder := "pid " + pid
+		cmdline, err := os.ReadFile("/proc/" + pid + "/cmdline")
+		if err == nil && len(cmdline) > 0 {
+			holder += " (" + strings.ReplaceAll(strings.TrimRight(string(cmdline), "\x00"), "\x00", " ") + ")"
+		}
+		return holder
+	}
+	return unknown
+}
+
+// parseLockInode parses "major:minor:inode" of /proc/locks,
+// major and minor in hex
+func parseLockInode(field string) (uint64, uint64, uint64, bool) {
+	ids := strings.Split(field, ":")
+	if len(ids) != 3 {
+		return 0, 0, 0, false
+	}
+
+	major, err1 := strconv.ParseUint(ids[0], 16, 64)
+	minor, err2 := strconv.ParseUint(ids[1], 16, 64)
+	inode, err3 := strconv.ParseUint(ids[2], 10, 64)
+	return major, minor, inode, err1 == nil && err2 == nil && err3 == nil
+}
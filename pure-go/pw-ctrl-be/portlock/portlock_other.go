@@ -0,0 +1,14 @@
+//go:build !linux
+
+package portlock
+
+// Lock is only available on linux, elsewhere the port is not locked
+type Lock struct{}
+
+func Acquire(portName string) (*Lock, error) {
+	return &Lock{}, nil
+}
+
+func (l *Lock) Unlock() error {
+	return nil
+}
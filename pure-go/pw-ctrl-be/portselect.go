@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+// PortSelector finds the serial port of a controller by one of
+//   - USB vendor/product id and serial number : usb:<vid>:<pid>[:<serial>]
+//   - a fixed device path, ex) /dev/serial/by-id/usb-xxx
+//   - port name prefixes, ex) /dev/ttyACM
+//   - a remote port of a terminal server : tcp://<host>:<port> (raw)
+//     or rfc2217://<host>:<port> (Telnet COM-PORT-OPTION)
+//
+// It is resolved again on every (re)initialization, so the same
+// physical board is found after a replug or renumbering.
+type PortSelector struct {
+	prefix       []string
+	vid          string
+	pid          string
+	serialNumber string
+	path         string
+	network      string
+	address      string
+}
+
+// parsePortSelector parses a port given in argv
+func parsePortSelector(name string) (PortSelector, error) {
+	for _, network := range []string{"tcp", "rfc2217"} {
+		if address, found := strings.CutPrefix(name, network+"://"); found {
+			_, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return PortSelector{}, errors.New("invalid " + network + " port : " + name + " (ex: " + network + "://10.0.0.5:4001)")
+			}
+			return PortSelector{network: network, address: address}, nil
+		}
+	}
+
+	if usb, found := strings.CutPrefix(name, "usb:"); found {
+		ids := strings.Split(usb, ":")
+		if len(ids) < 2 || len(ids) > 3 || ids[0] == "" || ids[1] == "" {
+			return PortSelector{}, errors.New("invalid usb port : " + name + " (ex: usb:2341:0043:SERIAL)")
+		}
+
+		selector := PortSelector{vid: ids[0], pid: ids[1]}
+		if len(ids) == 3 {
+			selector.serialNumber = ids[2]
+		}
+		return selector, nil
+	}
+
+	if strings.HasPrefix(name, "/") {
+		return PortSelector{path: name}, nil
+	}
+
+	return PortSelector{prefix: []string{"/dev/" + name}}, nil
+}
+
+func (sel PortSelector) equal(other PortSelector) bool {
+	return slices.Equal(sel.prefix, other.prefix) &&
+		sel.vid == other.vid &&
+		sel.pid == other.pid &&
+		sel.serialNumber == other.serialNumber &&
+		sel.path == other.path &&
+		sel.network == other.network &&
+		sel.address == other.address
+}
+
+// isRemote is true for a port of a terminal server over TCP
+func (sel PortSelector) isRemote() bool {
+	return sel.network != ""
+}
+
+func (sel PortSelector) String() string {
+	if sel.isRemote() {
+		return sel.network + "://" + sel.address
+	}
+	if sel.vid != "" {
+		usb := "usb:" + sel.vid + ":" + sel.pid
+		if sel.serialNumber != "" {
+			usb += ":" + sel.serialNumber
+		}
+		return usb
+	}
+	if sel.path != "" {
+		return sel.path
+	}
+	return strings.Join(sel.prefix, " ")
+}
+
+// mayMatch is true if the device could be the selected port.
+// Only a prefix can be checked with the device name alone.
+func (sel PortSelector) mayMatch(device string) bool {
+	if sel.isRemote() {
+		return false
+	}
+	if sel.vid != "" || sel.path != "" {
+		return true
+	}
+
+	for _, prefix := range sel.prefix {
+		if strings.HasPrefix(device, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the device name of the selected port
+func (sel PortSelector) find() (string, error) {
+	if sel.isRemote() {
+		return sel.String(), nil
+	}
+	if sel.vid != "" {
+		return sel.findUsb()
+	}
+	if sel.path != "" {
+		return sel.findPath()
+	}
+	return sel.findPrefix()
+}
+
+func (sel PortSelector) findUsb() (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+
+	portList := make([]string, 0)
+	for _, port := range ports {
+		if !port.IsUSB {
+			continue
+		}
+		if !strings.EqualFold(port.VID, sel.vid) || !strings.EqualFold(port.PID, sel.pid) {
+			continue
+		}
+		if sel.serialNumber != "" && port.SerialNumber != sel.serialNumber {
+			continue
+		}
+		portList = append(portList, port.Name)
+	}
+
+	if len(portList) != 1 {
+		return "", errors.New("no or multiple ports found for " + sel.String())
+	}
+	return portList[0], nil
+}
+
+// findPath resolves a symlink such as /dev/serial/by-id/* to its device
+func (sel PortSelector) findPath() (string, error) {
+	device, err := filepath.EvalSymlinks(sel.path)
+	if err != nil {
+		return "", errors.New("no port found for " + sel.path)
+	}
+
+	_, err = os.Stat(device)
+	if err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+func (sel PortSelector) findPrefix() (string, error) {
+	ports, err := serial.GetPortsList()
+	if err != nil {
+		return "", err
+	}
+
+	portList := make([]string, 0)
+
+	for _, port := range ports {
+		if sel.isExactPort(port) {
+			// NOTE : An exact port name wins over prefix matches (ttyACM1 vs ttyACM10)
+			portList = []string{port}
+			break
+		}
+
+		for i := 0; i < len(sel.prefix); i++ {
+			prefix := sel.prefix[i]
+			if len(port) >= len(prefix) && port[:len(prefix)] == prefix {
+				portList = append(portList, port)
+				break
+			}
+		}
+	}
+
+	if len(portList) != 1 {
+		return "", errors.New("no or multiple ports found")
+	}
+	return portList[0], nil
+}
+
+func (sel PortSelector) isExactPort(port string) bool {
+	for _, prefix := range sel.prefix {
+		if port == prefix {
+			return true
+		}
+	}
+	return false
+}
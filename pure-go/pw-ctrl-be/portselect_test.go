@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePortSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector PortSelector
+		remote   bool
+		err      string
+	}{
+		{"ttyACM", PortSelector{prefix: []string{"/dev/ttyACM"}}, false, ""},
+		{"ttyACM0", PortSelector{prefix: []string{"/dev/ttyACM0"}}, false, ""},
+		{"usb:2341:0043", PortSelector{vid: "2341", pid: "0043"}, false, ""},
+		{"usb:2341:0043:75833353035351F0C1A1", PortSelector{vid: "2341", pid: "0043", serialNumber: "75833353035351F0C1A1"}, false, ""},
+		{"/dev/serial/by-id/usb-Arduino_Uno_7583-if00", PortSelector{path: "/dev/serial/by-id/usb-Arduino_Uno_7583-if00"}, false, ""},
+		{"/dev/ttyUSB3", PortSelector{path: "/dev/ttyUSB3"}, false, ""},
+		{"tcp://10.0.0.5:4001", PortSelector{network: "tcp", address: "10.0.0.5:4001"}, true, ""},
+		{"tcp://[fe80::1]:4001", PortSelector{network: "tcp", address: "[fe80::1]:4001"}, true, ""},
+		{"rfc2217://ser2net.local:2001", PortSelector{network: "rfc2217", address: "ser2net.local:2001"}, true, ""},
+		{"usb:", PortSelector{}, false, "invalid usb port"},
+		{"usb:2341", PortSelector{}, false, "invalid usb port"},
+		{"usb:2341:", PortSelector{}, false, "invalid usb port"},
+		{"usb::0043", PortSelector{}, false, "invalid usb port"},
+		{"usb:2341:0043:A1:B2", PortSelector{}, false, "invalid usb port"},
+		{"tcp://10.0.0.5", PortSelector{}, false, "invalid tcp port"},
+		{"tcp://", PortSelector{}, false, "invalid tcp port"},
+		{"rfc2217://10.0.0.5:4001:1", PortSelector{}, false, "invalid rfc2217 port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := parsePortSelector(tt.name)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(selector, tt.selector) {
+				t.Errorf("selector = %+v, want %+v", selector, tt.selector)
+			}
+			if selector.isRemote() != tt.remote {
+				t.Errorf("isRemote = %v, want %v", selector.isRemote(), tt.remote)
+			}
+			if !selector.equal(tt.selector) {
+				t.Error("not equal to itself")
+			}
+
+			// NOTE : The selector is shown as given, except a name without /dev/
+			want := tt.name
+			if len(tt.selector.prefix) > 0 {
+				want = "/dev/" + tt.name
+			}
+			if selector.String() != want {
+				t.Errorf("String() = %q, want %q", selector.String(), want)
+			}
+		})
+	}
+}
+
+func TestPortSelectorEqual(t *testing.T) {
+	selectors := []string{"ttyACM", "ttyACM0", "usb:2341:0043", "usb:2341:0043:A1", "usb:2341:0042", "/dev/ttyACM0", "tcp://10.0.0.5:4001", "rfc2217://10.0.0.5:4001"}
+
+	for i, a := range selectors {
+		for j, b := range selectors {
+			selectorA, _ := parsePortSelector(a)
+			selectorB, _ := parsePortSelector(b)
+			if selectorA.equal(selectorB) != (i == j) {
+				t.Errorf("%v equal %v = %v", a, b, selectorA.equal(selectorB))
+			}
+		}
+	}
+}
+
+func TestPortSelectorMayMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		device string
+		match  bool
+	}{
+		{"ttyACM", "/dev/ttyACM3", true},
+		{"ttyACM", "/dev/ttyUSB0", false},
+		{"ttyACM1", "/dev/ttyACM10", true},
+		{"usb:2341:0043", "/dev/ttyUSB0", true},
+		{"/dev/serial/by-id/usb-x", "/dev/ttyACM0", true},
+		{"tcp://10.0.0.5:4001", "/dev/ttyACM0", false},
+	}
+
+	for _, tt := range tests {
+		selector, err := parsePortSelector(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := selector.mayMatch(tt.device); match != tt.match {
+			t.Errorf("%v mayMatch %v = %v, want %v", tt.name, tt.device, match, tt.match)
+		}
+	}
+}
+
+func TestPortSelectorFindPath(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "ttyACM7")
+	if err := os.WriteFile(device, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	byId := filepath.Join(dir, "usb-Arduino_Uno_7583-if00")
+	if err := os.Symlink("ttyACM7", byId); err != nil {
+		t.Skip("no symlinks : ", err)
+	}
+
+	// NOTE : A by-id link resolves to the device it points to now
+	selector, _ := parsePortSelector(byId)
+	found, err := selector.find()
+	if err != nil || found != device {
+		t.Fatalf("find() = %q, %v, want %q", found, err, device)
+	}
+
+	os.Remove(device)
+	if _, err := selector.find(); err == nil {
+		t.Error("found a dangling link")
+	}
+
+	selector, _ = parsePortSelector("tcp://10.0.0.5:4001")
+	if found, err := selector.find(); err != nil || found != "tcp://10.0.0.5:4001" {
+		t.Errorf("find() = %q, %v", found, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+// PowerState is the power state of a workstation decoded from the MCU code
+type PowerState string
+
+const (
+	POWER_OFF               PowerState = "off"
+	POWER_ON                PowerState = "on"
+	POWER_TRANSITIONING_OFF PowerState = "transitioning-off"
+	POWER_TRANSITIONING_ON  PowerState = "transitioning-on"
+	POWER_FAILED            PowerState = "failed"
+	POWER_UNKNOWN           PowerState = "unknown"
+)
+
+// MCU response codes
+const (
+	CODE_OFF             = '0'
+	CODE_ON              = '1'
+	CODE_TURNING_OFF     = '2'
+	CODE_TURNING_ON      = '3'
+	CODE_POWER_FAIL      = '8'
+	CODE_UNKNOWN_COMMAND = '9'
+)
+
+// McuResponseV2 keeps the data bool of McuResponse for old clients
+// and adds the full power state with the raw MCU code
+type McuResponseV2 struct {
+	Data           bool       `json:"data"`
+	PowerState     PowerState `json:"powerState"`
+	McuCode        string     `json:"mcuCode"`
+	State          string     `json:"state"`
+	ElapsedSeconds int        `json:"elapsedSeconds"`
+}
+
+// decodePowerState maps the MCU response frame to a PowerState
+//   - 0 : off
+//   - 1 : on
+//   - 2 : being turned off
+//   - 3 : being turned on
+//   - 8 : failed to power on/off
+//   - 9 : unknown command or wrong rack-number
+func decodePowerState(response string) PowerState {
+	if len(response) == 0 {
+		return POWER_UNKNOWN
+	}
+
+	switch response[0] {
+	case CODE_OFF:
+		return POWER_OFF
+	case CODE_ON:
+		return POWER_ON
+	case CODE_TURNING_OFF:
+		return POWER_TRANSITIONING_OFF
+	case CODE_TURNING_ON:
+		return POWER_TRANSITIONING_ON
+	case CODE_POWER_FAIL:
+		return POWER_FAILED
+	}
+	return POWER_UNKNOWN
+}
+
+// isOn is the legacy data bool : true for on or being turned on
+func (s PowerState) isOn() bool {
+	return s == POWER_ON || s == POWER_TRANSITIONING_ON
+}
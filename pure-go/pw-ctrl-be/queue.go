@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority classes of the command queue
+type Priority int
+
+const (
+	PRIORITY_POWER  Priority = iota // S, Q, E and initialize
+	PRIORITY_STATUS                 // C
+	PRIORITY_COUNT
+)
+
+// McuCommand is a request waiting in the command queue.
+// Identical status checks share one McuCommand, one waiter per caller.
+type McuCommand struct {
+	cmd        string
+	initialize bool
+	priority   Priority
+	waiters    []chan McuResult
+	running    bool
+}
+
+type McuResult struct {
+	code     int
+	response string
+	err      error
+}
+
+// CommandQueue serializes all access to the MCU.
+// A single worker goroutine owns the port and runs the queued commands,
+// FIFO within each priority lane; callers wait for their turn until
+// their deadline. Power commands go ahead of status checks, but after
+// statusEvery_ power commands in a row a waiting status check is served.
+// A status check identical to a queued or running one joins it instead
+// of making another MCU round-trip.
+// With a network driver there is no port to share : the worker runs each
+// command in its own goroutine, one at a time per workstation only. A
+// command for a workstation still busy is skipped until it is done, so a
+// status check served after statusEvery_ power commands is the first one
+// whose workstation is free.
+type CommandQueue struct {
+	pwctl    *PwCtrl
+	laneSize int
+
+	mutex       sync.Mutex
+	lanes       [PRIORITY_COUNT][]*McuCommand
+	statusCmds  map[string]*McuCommand
+	busy        map[string]bool
+	powerStreak int
+	ready       chan struct{}
+	closed      bool
+}
+
+var queueSize_ = 32
+var commandTimeOut_ = 15 * time.Second
+var statusEvery_ = 4
+
+func NewCommandQueue(pwctl *PwCtrl, size int) *CommandQueue {
+	return &CommandQueue{
+		pwctl:      pwctl,
+		laneSize:   size,
+		statusCmds: make(map[string]*McuCommand),
+		busy:       make(map[string]bool),
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// workstation is the id the command is for, "" for initialize
+func (command *McuCommand) workstation() string {
+	if len(command.cmd) < 1 {
+		return ""
+	}
+	return command.cmd[1:]
+}
+
+func commandPriority(cmdStr string) Priority {
+	if len(cmdStr) > 0 && cmdStr[0] == 'C' {
+		return PRIORITY_STATUS
+	}
+	return PRIORITY_POWER
+}
+
+// start runs the worker until the context is cancelled
+func (q *CommandQueue) start(ctx context.Context) {
+	go func() {
+		for {
+			command := q.next()
+			if command != nil {
+				if command.initialize || q.pwctl.usesPort() {
+					q.execute(command)
+				} else {
+					go q.execute(command)
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.ready:
+			}
+		}
+	}()
+}
+
+// next pops the command to run, or nil if the queue is empty or only has
+// commands for workstations with a command still running
+func (q *CommandQueue) next() *McuCommand {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	power := q.lanes[PRIORITY_POWER]
+	status := q.lanes[PRIORITY_STATUS]
+
+	if len(status) == 0 {
+		q.powerStreak = 0
+	}
+
+	lanes := []Priority{PRIORITY_POWER, PRIORITY_STATUS}
+	if len(power) == 0 || (len(status) > 0 && q.powerStreak >= statusEvery_) {
+		lanes = []Priority{PRIORITY_STATUS, PRIORITY_POWER}
+	}
+
+	for _, lane := range lanes {
+		queued := q.lanes[lane]
+		for i, command := range queued {
+			if q.busy[command.workstation()] {
+				continue
+			}
+
+			copy(queued[i:], queued[i+1:])
+			queued[len(queued)-1] = nil
+			q.lanes[lane] = queued[:len(queued)-1]
+
+			if lane == PRIORITY_POWER {
+				q.powerStreak++
+			} else {
+				q.powerStreak = 0
+			}
+			q.busy[command.workstation()] = true
+			command.running = true
+			return command
+		}
+	}
+	return nil
+}
+
+func (q *CommandQueue) execute(command *McuCommand) {
+	q.pwctl.portMutex.Lock()
+
+	var result McuResult
+	if command.initialize {
+		result.code, result.err = q.pwctl.intializeConnection()
+	} else {
+		result.code, result.err = q.pwctl.setCommand(command.cmd, &result.response)
+	}
+
+	q.pwctl.portMutex.Unlock()
+
+	q.mutex.Lock()
+	if q.statusCmds[command.cmd] == command {
+		delete(q.statusCmds, command.cmd)
+	}
+	delete(q.busy, command.workstation())
+	waiters := command.waiters
+	command.waiters = nil
+	q.mutex.Unlock()
+
+	// NOTE : The next command for the workstation may be waiting
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	for _, waiter := range waiters {
+		waiter <- result
+	}
+}
+
+// submit queues a command and waits for its result or the context deadline
+func (q *CommandQueue) submit(ctx context.Context, cmdStr string) (int, string, error) {
+	return q.enqueue(ctx, &McuCommand{
+		cmd:      cmdStr,
+		priority: commandPriority(cmdStr),
+	})
+}
+
+// submitInitialize queues a re-initialization of the port
+func (q *CommandQueue) submitInitialize(ctx context.Context) (int, error) {
+	code, _, err := q.enqueue(ctx, &McuCommand{
+		initialize: true,
+		priority:   PRIORITY_POWER,
+	})
+	return code, err
+}
+
+func (q *CommandQueue) enqueue(ctx context.Context, command *McuCommand) (int, string, error) {
+	waiter := make(chan McuResult, 1)
+
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return ERROR_NO_CONTROLLER, "", errors.New("controller removed")
+	}
+	if command.priority == PRIORITY_STATUS && q.statusCmds[command.cmd] != nil {
+		// NOTE : Join the identical status check in the queue or in progress
+		command = q.statusCmds[command.cmd]
+	} else {
+		if len(q.lanes[command.priority]) >= q.laneSize {
+			q.mutex.Unlock()
+			return ERROR_QUEUE_FULL, "", errors.New("command queue is full")
+		}
+		q.lanes[command.priority] = append(q.lanes[command.priority], command)
+		if command.priority == PRIORITY_STATUS {
+			q.statusCmds[command.cmd] = command
+		}
+	}
+	command.waiters = append(command.waiters, waiter)
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	select {
+	case result := <-waiter:
+		return result.code, result.response, result.err
+	case <-ctx.Done():
+		q.remove(command, waiter)
+		return ERROR_DEADLINE_EXCEEDED, "", errors.New("deadline exceeded while waiting for MCU")
+	}
+}
+
+// setSize changes the lane size, queued commands are kept
+func (q *CommandQueue) setSize(size int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.laneSize = size
+}
+
+// close fails the queued commands and rejects new ones.
+// A running command still completes.
+func (q *CommandQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	waiters := make([]chan McuResult, 0)
+	for lane := range q.lanes {
+		for _, command := range q.lanes[lane] {
+			waiters = append(waiters, command.waiters...)
+			command.waiters = nil
+		}
+		q.lanes[lane] = nil
+	}
+	for cmd, command := range q.statusCmds {
+		if !command.running {
+			delete(q.statusCmds, cmd)
+		}
+	}
+	q.mutex.Unlock()
+
+	result := McuResult{code: ERROR_NO_CONTROLLER, err: errors.New("controller removed")}
+	for _, waiter := range waiters {
+		waiter <- result
+	}
+}
+
+// remove drops the waiter of a caller who gave up, and the command
+// itself if it is still queued without any other waiter
+func (q *CommandQueue) remove(command *McuCommand, waiter chan McuResult) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i, w := range command.waiters {
+		if w == waiter {
+			command.waiters = append(command.waiters[:i], command.waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(command.waiters) > 0 || command.running {
+		return
+	}
+
+	if q.statusCmds[command.cmd] == command {
+		delete(q.statusCmds, command.cmd)
+	}
+
+	lane := q.lanes[command.priority]
+	for i, queued := range lane {
+		if queued == command {
+			q.lanes[command.priority] = append(lane[:i], lane[i+1:]...)
+			return
+		}
+	}
+}
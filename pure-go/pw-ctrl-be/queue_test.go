@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// queuedCount is the number of commands waiting in the lanes
+func queuedCount(q *CommandQueue) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.lanes[PRIORITY_POWER]) + len(q.lanes[PRIORITY_STATUS])
+}
+
+// waiterCount is the number of callers waiting for a queued command
+func waiterCount(q *CommandQueue) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := 0
+	for _, lane := range q.lanes {
+		for _, command := range lane {
+			n += len(command.waiters)
+		}
+	}
+	return n
+}
+
+// submitAsync submits the command in the background and waits until
+// the given number of callers wait in the queue
+func submitAsync(t *testing.T, q *CommandQueue, cmdStr string, waiters int) <-chan McuResult {
+	t.Helper()
+
+	done := make(chan McuResult, 1)
+	go func() {
+		var result McuResult
+		result.code, result.response, result.err = q.submit(context.Background(), cmdStr)
+		done <- result
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for waiterCount(q) < waiters {
+		if time.Now().After(deadline) {
+			t.Fatal("not queued : ", cmdStr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestQueueSubmit(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+
+	code, response, err := q.submit(ctx, "C0001")
+	if code != SUCCESS || err != nil || response != "1" {
+		t.Fatalf("code = %v, response = %q, err = %v", code, response, err)
+	}
+	if written := string(transport.Written()); written != "C0001" {
+		t.Errorf("written = %q, want %q", written, "C0001")
+	}
+}
+
+func TestQueuePowerBeforeStatus(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	// NOTE : Queue before the worker starts, the order is then up to the lanes
+	status := submitAsync(t, q, "C0001", 1)
+	power := submitAsync(t, q, "S0002", 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+
+	for _, done := range []<-chan McuResult{status, power} {
+		result := <-done
+		if result.code != SUCCESS {
+			t.Fatalf("code = %v, err = %v", result.code, result.err)
+		}
+	}
+	if written := string(transport.Written()); written != "S0002C0001" {
+		t.Errorf("written = %q, want the power command first", written)
+	}
+}
+
+func TestQueueStatusEvery(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	var results []<-chan McuResult
+	results = append(results, submitAsync(t, q, "C0001", 1))
+	for i, cmdStr := range []string{"S0001", "S0002", "S0003", "S0004", "S0005"} {
+		results = append(results, submitAsync(t, q, cmdStr, i+2))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+
+	for _, done := range results {
+		<-done
+	}
+	// NOTE : The status check waits for statusEvery_ power commands at most
+	want := "S0001S0002S0003S0004C0001S0005"
+	if written := string(transport.Written()); written != want {
+		t.Errorf("written = %q, want %q", written, want)
+	}
+}
+
+func TestQueueJoinsIdenticalStatus(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("0\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	first := submitAsync(t, q, "C0001", 1)
+	second := submitAsync(t, q, "C0001", 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.start(ctx)
+
+	for _, done := range []<-chan McuResult{first, second} {
+		result := <-done
+		if result.code != SUCCESS || result.response != "0" {
+			t.Fatalf("code = %v, response = %q, err = %v", result.code, result.response, result.err)
+		}
+	}
+	if written := string(transport.Written()); written != "C0001" {
+		t.Errorf("written = %q, want a single status check", written)
+	}
+}
+
+func TestQueueJoinedCallerGivesUp(t *testing.T) {
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	first := submitAsync(t, q, "C0001", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	code, _, err := q.submit(ctx, "C0001")
+	if code != ERROR_DEADLINE_EXCEEDED || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_DEADLINE_EXCEEDED", code, err)
+	}
+
+	// NOTE : The command stays queued for the caller still waiting
+	if queued, waiters := queuedCount(q), waiterCount(q); queued != 1 || waiters != 1 {
+		t.Fatalf("%v commands and %v waiters queued, want 1 and 1", queued, waiters)
+	}
+
+	workerCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	q.start(workerCtx)
+
+	if result := <-first; result.code != SUCCESS {
+		t.Fatalf("code = %v, err = %v", result.code, result.err)
+	}
+	if written := string(transport.Written()); written != "C0001" {
+		t.Errorf("written = %q, want a single status check", written)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	pwctl, _ := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, 1)
+
+	// NOTE : No worker, the first command fills the status lane
+	submitAsync(t, q, "C0001", 1)
+
+	code, _, err := q.submit(context.Background(), "C0002")
+	if code != ERROR_QUEUE_FULL || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_QUEUE_FULL", code, err)
+	}
+
+	// The power lane is bounded on its own
+	submitAsync(t, q, "S0001", 2)
+}
+
+func TestQueueDeadline(t *testing.T) {
+	pwctl, _ := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+	q := NewCommandQueue(pwctl, queueSize_)
+
+	// NOTE : No worker, the command stays queued until the caller gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	code, _, err := q.submit(ctx, "C0001")
+	if code != ERROR_DEADLINE_EXCEEDED || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_DEADLINE_EXCEEDED", code, err)
+	}
+	if n := queuedCount(q); n != 0 {
+		t.Errorf("%v commands left queued", n)
+	}
+}
+
+// blockingDriver is a network driver answering each command with "1" once
+// it is released. It records how many commands of a workstation run at once.
+type blockingDriver struct {
+	started chan string
+	release chan struct{}
+
+	mutex   sync.Mutex
+	running map[string]int
+	overlap bool
+	calls   int
+}
+
+func newBlockingDriver() *blockingDriver {
+	return &blockingDriver{
+		started: make(chan string, 16),
+		release: make(chan struct{}),
+		running: make(map[string]int),
+	}
+}
+
+func (d *blockingDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	workstation := cmdStr[1:]
+
+	d.mutex.Lock()
+	d.calls++
+	d.running[workstation]++
+	if d.running[workstation] > 1 {
+		d.overlap = true
+	}
+	d.mutex.Unlock()
+
+	d.started <- cmdStr
+	select {
+	case <-d.release:
+	case <-time.After(time.Until(deadline)):
+	}
+
+	d.mutex.Lock()
+	d.running[workstation]--
+	d.mutex.Unlock()
+	return "1", SUCCESS, nil
+}
+
+func (d *blockingDriver) Name() string {
+	return "blocking"
+}
+
+func (d *blockingDriver) UsesPort() bool {
+	return false
+}
+
+// expectStarted waits for the driver to start the command
+func (d *blockingDriver) expectStarted(t *testing.T, cmdStr string) {
+	t.Helper()
+
+	select {
+	case started := <-d.started:
+		if started != cmdStr {
+			t.Fatalf("started %v, want %v", started, cmdStr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v not started", cmdStr)
+	}
+}
+
+// expectIdle checks that the driver starts no other command for a while
+func (d *blockingDriver) expectIdle(t *testing.T) {
+	t.Helper()
+
+	select {
+	case started := <-d.started:
+		t.Fatalf("%v started while its workstation is busy", started)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// newNetworkPwCtrl returns a PwCtrl with the network driver
+func newNetworkPwCtrl(t *testing.T, driver Driver) *PwCtrl {
+	t.Helper()
+
+	pwctl := NewPwCtrl(PortSelector{}, &serial.Mode{}, 1, 0)
+	pwctl.driver = driver
+	pwctl.readDeadlines = ReadDeadlines{status: 2 * time.Second, power: 2 * time.Second}
+
+	pwctl.portMutex.Lock()
+	_, err := pwctl.intializeConnection()
+	pwctl.portMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pwctl
+}
+
+func startQueue(t *testing.T, pwctl *PwCtrl) *CommandQueue {
+	t.Helper()
+
+	q := NewCommandQueue(pwctl, queueSize_)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.start(ctx)
+	return q
+}
+
+func expectResult(t *testing.T, done <-chan McuResult, response string) {
+	t.Helper()
+
+	select {
+	case result := <-done:
+		if result.code != SUCCESS || result.response != response {
+			t.Fatalf("code = %v, response = %q, err = %v", result.code, result.response, result.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no result")
+	}
+}
+
+func TestQueueNetworkWorkstationsInParallel(t *testing.T) {
+	driver := newBlockingDriver()
+	q := startQueue(t, newNetworkPwCtrl(t, driver))
+
+	first := submitAsync(t, q, "S0001", 0)
+	driver.expectStarted(t, "S0001")
+
+	// NOTE : The first command still runs, the second one starts meanwhile
+	second := submitAsync(t, q, "S0002", 0)
+	driver.expectStarted(t, "S0002")
+
+	driver.release <- struct{}{}
+	driver.release <- struct{}{}
+	expectResult(t, first, "1")
+	expectResult(t, second, "1")
+}
+
+func TestQueueNetworkWorkstationSerialized(t *testing.T) {
+	driver := newBlockingDriver()
+	q := startQueue(t, newNetworkPwCtrl(t, driver))
+
+	first := submitAsync(t, q, "S0001", 0)
+	driver.expectStarted(t, "S0001")
+
+	// NOTE : Queued behind the running command of the same workstation,
+	// the command of another workstation is not held back by it
+	second := submitAsync(t, q, "Q0001", 1)
+	other := submitAsync(t, q, "S0002", 0)
+	driver.expectStarted(t, "S0002")
+	driver.expectIdle(t)
+
+	driver.release <- struct{}{}
+	driver.release <- struct{}{}
+	driver.expectStarted(t, "Q0001")
+	driver.release <- struct{}{}
+
+	for _, done := range []<-chan McuResult{first, second, other} {
+		expectResult(t, done, "1")
+	}
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	if driver.overlap {
+		t.Error("two commands of a workstation ran at once")
+	}
+}
+
+func TestQueueNetworkStatusJoinsRunning(t *testing.T) {
+	driver := newBlockingDriver()
+	q := startQueue(t, newNetworkPwCtrl(t, driver))
+
+	first := submitAsync(t, q, "C0001", 0)
+	driver.expectStarted(t, "C0001")
+
+	// NOTE : The identical status check joins the running one, it is neither
+	// queued behind it nor run alongside it
+	second := make(chan McuResult, 1)
+	go func() {
+		var result McuResult
+		result.code, result.response, result.err = q.submit(context.Background(), "C0001")
+		second <- result
+	}()
+	driver.expectIdle(t)
+	if n := queuedCount(q); n != 0 {
+		t.Fatalf("%v commands queued, want the running one joined", n)
+	}
+
+	driver.release <- struct{}{}
+	expectResult(t, first, "1")
+	expectResult(t, second, "1")
+
+	// A status check after the result is a new exchange
+	third := submitAsync(t, q, "C0001", 0)
+	driver.expectStarted(t, "C0001")
+	driver.release <- struct{}{}
+	expectResult(t, third, "1")
+
+	driver.mutex.Lock()
+	defer driver.mutex.Unlock()
+	if driver.calls != 2 {
+		t.Errorf("%v exchanges, want 2", driver.calls)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the state of the reconnect state machine of a port
+//
+//	disconnected -> connecting -> connected
+//	                    |   ^          |
+//	                    v   |          v
+//	                   backoff <---- (error)
+//
+// closed is final, the controller was removed by a reload.
+// standby is a port left to the leader replica (HA).
+type ConnectionState string
+
+const (
+	CONNECTION_DISCONNECTED ConnectionState = "disconnected"
+	CONNECTION_CONNECTING   ConnectionState = "connecting"
+	CONNECTION_CONNECTED    ConnectionState = "connected"
+	CONNECTION_BACKOFF      ConnectionState = "backoff"
+	CONNECTION_CLOSED       ConnectionState = "closed"
+	CONNECTION_STANDBY      ConnectionState = "standby"
+)
+
+// ConnectionStatus is what the reconnect state machine reports
+type ConnectionStatus struct {
+	Name          string          `json:"name"`
+	State         ConnectionState `json:"state"`
+	PortName      string          `json:"portName"`
+	Port          string          `json:"port"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError"`
+	LastErrorAt   time.Time       `json:"lastErrorAt"`
+	LastSuccessAt time.Time       `json:"lastSuccessAt"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	BackoffMs     int64           `json:"backoffMs"`
+}
+
+// ReconnectTracker records the connection attempts of a PwCtrl.
+// It has its own mutex so the state can be read while the port is busy.
+type ReconnectTracker struct {
+	mutex  sync.Mutex
+	status ConnectionStatus
+}
+
+var reconnectInitial_ = 1 * time.Second
+var reconnectMax_ = 60 * time.Second
+var reconnectMultiplier_ = 2.0
+var reconnectJitter_ = 0.2
+
+func NewReconnectTracker() *ReconnectTracker {
+	return &ReconnectTracker{status: ConnectionStatus{State: CONNECTION_DISCONNECTED}}
+}
+
+// reconnectBackoff is the wait after the given number of failed attempts,
+// growing by reconnectMultiplier_ up to reconnectMax_ and spread by
+// +/- reconnectJitter_ so that controllers do not retry in lockstep
+func reconnectBackoff(attempts int) time.Duration {
+	backoff := float64(reconnectInitial_) * math.Pow(reconnectMultiplier_, float64(max(attempts-1, 0)))
+	backoff = math.Min(backoff, float64(reconnectMax_))
+	backoff *= 1 + reconnectJitter_*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+func (t *ReconnectTracker) connecting(port string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.status.State = CONNECTION_CONNECTING
+	t.status.Port = port
+	t.status.Attempts++
+	t.status.NextAttemptAt = time.Time{}
+	t.status.BackoffMs = 0
+}
+
+func (t *ReconnectTracker) connected(portName string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.status.State = CONNECTION_CONNECTED
+	t.status.PortName = portName
+	t.status.Attempts = 0
+	t.status.LastSuccessAt = time.Now()
+}
+
+// failed records the error which took the connection down or failed an attempt
+func (t *ReconnectTracker) failed(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.status.State == CONNECTION_CONNECTED || t.status.State == CONNECTION_CONNECTING {
+		t.status.State = CONNECTION_DISCONNECTED
+	}
+	t.status.LastError = err.Error()
+	t.status.LastErrorAt = time.Now()
+}
+
+// backoff records the wait before the next attempt and returns it
+func (t *ReconnectTracker) backoff() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	backoff := reconnectBackoff(t.status.Attempts)
+	t.status.State = CONNECTION_BACKOFF
+	t.status.NextAttemptAt = time.Now().Add(backoff)
+	t.status.BackoffMs = backoff.Milliseconds()
+	return backoff
+}
+
+// resetBackoff starts the backoff over, ex) when the device reappears
+func (t *ReconnectTracker) resetBackoff() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.status.Attempts = 0
+}
+
+func (t *ReconnectTracker) standby() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.status.State = CONNECTION_STANDBY
+	t.status.Attempts = 0
+	t.status.NextAttemptAt = time.Time{}
+}
+
+func (t *ReconnectTracker) closed() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.status.State = CONNECTION_CLOSED
+	t.status.NextAttemptAt = time.Time{}
+}
+
+func (t *ReconnectTracker) snapshot() ConnectionStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.status
+}
+
+// connected tells if the port is initialized without waiting for portMutex,
+// which is held during a command. connectInitialized is only read under it.
+func (pwctl *PwCtrl) connected() bool {
+	return pwctl.reconnect.snapshot().State == CONNECTION_CONNECTED
+}
+
+func (ctrl *Controller) connectionStatus() ConnectionStatus {
+	status := ctrl.pwctl.reconnect.snapshot()
+	status.Name = ctrl.name
+	return status
+}
+
+// notConnectedDetails tells why each not connected controller is down
+func notConnectedDetails() []string {
+	details := make([]string, 0)
+	for _, controller := range controllerList() {
+		if controller.pwctl.connected() {
+			continue
+		}
+
+		status := controller.connectionStatus()
+		detail := status.Name + " : " + string(status.State)
+		if status.Attempts > 0 {
+			detail += " (attempt " + strconv.Itoa(status.Attempts) + ")"
+		}
+		if status.LastError != "" {
+			detail += " : " + status.LastError
+		}
+		details = append(details, detail)
+	}
+	return details
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setBackoff sets the reconnect parameters for the test
+func setBackoff(t *testing.T, initial time.Duration, maximum time.Duration, multiplier float64, jitter float64) {
+	t.Helper()
+
+	savedInitial, savedMax := reconnectInitial_, reconnectMax_
+	savedMultiplier, savedJitter := reconnectMultiplier_, reconnectJitter_
+	reconnectInitial_, reconnectMax_ = initial, maximum
+	reconnectMultiplier_, reconnectJitter_ = multiplier, jitter
+	t.Cleanup(func() {
+		reconnectInitial_, reconnectMax_ = savedInitial, savedMax
+		reconnectMultiplier_, reconnectJitter_ = savedMultiplier, savedJitter
+	})
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	setBackoff(t, 100*time.Millisecond, time.Second, 2, 0.2)
+
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+		{5000, time.Second},
+	}
+
+	for _, tt := range tests {
+		low := time.Duration(float64(tt.backoff) * 0.8)
+		high := time.Duration(float64(tt.backoff) * 1.2)
+
+		shortest, longest := high, low
+		for i := 0; i < 1000; i++ {
+			backoff := reconnectBackoff(tt.attempts)
+			if backoff < low || backoff > high {
+				t.Fatalf("reconnectBackoff(%v) = %v, want %v~%v", tt.attempts, backoff, low, high)
+			}
+			shortest = min(shortest, backoff)
+			longest = max(longest, backoff)
+		}
+
+		// NOTE : The jitter spreads the backoff over both sides of the base
+		if shortest >= tt.backoff || longest <= tt.backoff {
+			t.Errorf("reconnectBackoff(%v) spread %v~%v, want around %v", tt.attempts, shortest, longest, tt.backoff)
+		}
+	}
+}
+
+func TestReconnectTracker(t *testing.T) {
+	setBackoff(t, 100*time.Millisecond, 400*time.Millisecond, 2, 0)
+
+	tracker := NewReconnectTracker()
+	attempt := func() time.Duration {
+		tracker.connecting("ttyACM")
+		tracker.failed(errors.New("no such device"))
+		return tracker.backoff()
+	}
+
+	for i, want := range []time.Duration{100, 200, 400, 400} {
+		backoff := attempt()
+		if backoff != want*time.Millisecond {
+			t.Errorf("attempt %v : backoff = %v, want %v", i+1, backoff, want*time.Millisecond)
+		}
+	}
+	status := tracker.snapshot()
+	if status.State != CONNECTION_BACKOFF || status.Attempts != 4 || status.BackoffMs != 400 || status.LastError != "no such device" {
+		t.Errorf("status = %+v", status)
+	}
+
+	// A successful connect starts the backoff over
+	tracker.connecting("ttyACM")
+	tracker.connected("ttyACM0")
+	status = tracker.snapshot()
+	if status.State != CONNECTION_CONNECTED || status.Attempts != 0 || status.PortName != "ttyACM0" {
+		t.Errorf("status = %+v", status)
+	}
+	if backoff := attempt(); backoff != 100*time.Millisecond {
+		t.Errorf("backoff after connecting = %v, want %v", backoff, 100*time.Millisecond)
+	}
+
+	attempt()
+	tracker.resetBackoff()
+	if backoff := attempt(); backoff != 100*time.Millisecond {
+		t.Errorf("backoff after reset = %v, want %v", backoff, 100*time.Millisecond)
+	}
+}
+
+func TestReIntializeConnectionBackoff(t *testing.T) {
+	setBackoff(t, 50*time.Millisecond, 100*time.Millisecond, 2, 0)
+
+	pwctl, transport := newMemoryPwCtrl(t, mcuReply("1\r\n"))
+
+	var mutex sync.Mutex
+	var attempts []time.Time
+	failures := 0
+	pwctl.newTransport = func(pwctl *PwCtrl) (Transport, int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		attempts = append(attempts, time.Now())
+		if failures > 0 {
+			failures--
+			return nil, ERROR_NO_PORT_FOUND, errors.New("no such device")
+		}
+		pwctl.portName = transport.Name()
+		return transport, SUCCESS, nil
+	}
+
+	// outage fails the port and waits until it is back after the failed attempts.
+	// It returns the waits between the attempts.
+	outage := func(failed int) []time.Duration {
+		mutex.Lock()
+		attempts = nil
+		failures = failed
+		mutex.Unlock()
+
+		pwctl.portMutex.Lock()
+		pwctl.startReIntializing(errors.New("unplugged"))
+		pwctl.portMutex.Unlock()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !pwctl.connected() {
+			if time.Now().After(deadline) {
+				t.Fatal("not reconnected")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		waits := make([]time.Duration, 0)
+		for i := 1; i < len(attempts); i++ {
+			waits = append(waits, attempts[i].Sub(attempts[i-1]))
+		}
+		return waits
+	}
+
+	checkWaits := func(waits []time.Duration, want []time.Duration) {
+		t.Helper()
+
+		if len(waits) != len(want) {
+			t.Fatalf("waits = %v, want %v", waits, want)
+		}
+		for i := range want {
+			// NOTE : A busy machine may wake up late, never early
+			if waits[i] < want[i] || waits[i] > want[i]+want[i]/2+20*time.Millisecond {
+				t.Errorf("waits = %v, want %v", waits, want)
+				return
+			}
+		}
+	}
+
+	// Growing up to reconnectMax_
+	checkWaits(outage(4), []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond})
+
+	status := pwctl.reconnect.snapshot()
+	if status.Attempts != 0 || status.LastError != "no such device" {
+		t.Errorf("after reconnecting : status = %+v", status)
+	}
+
+	// The next outage starts over from reconnectInitial_
+	checkWaits(outage(1), []time.Duration{50 * time.Millisecond})
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------
+// Redfish driver for BMCs (ComputerSystem.Reset)
+//---------------------------------------------------------
+
+const REDFISH_SYSTEMS = "/redfish/v1/Systems"
+
+// NOTE : A Redfish response is small, more than this is not a Redfish service
+const REDFISH_MAX_BODY = 1 << 20
+
+// Redfish PowerState values
+const (
+	REDFISH_ON           = "On"
+	REDFISH_OFF          = "Off"
+	REDFISH_POWERING_ON  = "PoweringOn"
+	REDFISH_POWERING_OFF = "PoweringOff"
+	REDFISH_PAUSED       = "Paused"
+)
+
+// RedfishTarget is the Redfish service of the BMC of a workstation
+type RedfishTarget struct {
+	url      string
+	system   string
+	user     string
+	password string
+	insecure bool
+}
+
+// RedfishDriver controls the workstations of its inventory with the
+// ComputerSystem.Reset action of their BMCs.
+//   - S : reset type On, answered with 3 (being turned on)
+//   - Q : reset type GracefulShutdown, answered with 2
+//   - E : reset type ForceOff, answered with 2
+//   - C : PowerState of the ComputerSystem, answered with 0~3
+//
+// A reset to the current state is not sent, some BMCs refuse it.
+// A workstation not in the inventory is answered with 9.
+type RedfishDriver struct {
+	targets map[int]RedfishTarget
+}
+
+// RedfishSystem is the part of a ComputerSystem resource used by the driver
+type RedfishSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    struct {
+		Reset struct {
+			Target string `json:"target"`
+		} `json:"#ComputerSystem.Reset"`
+	} `json:"Actions"`
+}
+
+type RedfishCollection struct {
+	Members []struct {
+		Id string `json:"@odata.id"`
+	} `json:"Members"`
+}
+
+type RedfishError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// redfishDriver validates the inventory and returns the driver
+func redfishDriver(workstations []WorkstationConfig) (Driver, error) {
+	if len(workstations) == 0 {
+		return nil, errors.New("redfish : no workstations")
+	}
+
+	d := RedfishDriver{targets: make(map[int]RedfishTarget)}
+	for _, ws := range workstations {
+		id := strconv.Itoa(ws.Id)
+		if _, found := d.targets[ws.Id]; found {
+			return nil, errors.New("redfish : duplicate workstation : " + id)
+		}
+		if ws.Host == "" {
+			return nil, errors.New("redfish : workstation " + id + " : no host")
+		}
+
+		// NOTE : https unless the host has a scheme
+		base := ws.Host
+		if !strings.Contains(base, "://") {
+			base = "https://" + base
+		}
+		parsed, err := url.Parse(base)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, errors.New("redfish : workstation " + id + " : invalid host : " + ws.Host)
+		}
+		if ws.System != "" && !strings.HasPrefix(ws.System, "/") {
+			return nil, errors.New("redfish : workstation " + id + " : invalid system : " + ws.System)
+		}
+
+		d.targets[ws.Id] = RedfishTarget{
+			url:      parsed.Scheme + "://" + parsed.Host,
+			system:   ws.System,
+			user:     ws.User,
+			password: ws.Password,
+			insecure: ws.Insecure,
+		}
+	}
+	return d, nil
+}
+
+func (d RedfishDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	letter, id, err := parseCommand(cmdStr)
+	if err != nil {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	target, found := d.targets[id]
+	if !found {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	var resetType string
+	var response byte
+	switch letter {
+	case 'S':
+		resetType, response = "On", CODE_TURNING_ON
+	case 'Q':
+		resetType, response = "GracefulShutdown", CODE_TURNING_OFF
+	case 'E':
+		resetType, response = "ForceOff", CODE_TURNING_OFF
+	case 'C':
+	default:
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	client := target.client(ctx)
+
+	systemPath, system, err := client.computerSystem()
+	if err != nil {
+		return "", ERROR_NETWORK, err
+	}
+
+	code, err := redfishPowerCode(system.PowerState)
+	if err != nil {
+		return "", ERROR_NETWORK, err
+	}
+	if letter == 'C' {
+		return string(code), SUCCESS, nil
+	}
+	if (letter == 'S' && code == CODE_ON) || (letter != 'S' && code == CODE_OFF) {
+		return string(code), SUCCESS, nil
+	}
+
+	action := system.Actions.Reset.Target
+	if action == "" {
+		action = systemPath + "/Actions/ComputerSystem.Reset"
+	}
+	err = client.do(http.MethodPost, action, map[string]string{"ResetType": resetType}, nil)
+	if err != nil {
+		return "", ERROR_NETWORK, err
+	}
+	return string(response), SUCCESS, nil
+}
+
+func (d RedfishDriver) Name() string {
+	return DRIVER_REDFISH
+}
+
+func (d RedfishDriver) UsesPort() bool {
+	return false
+}
+
+// redfishPowerCode maps the PowerState to the MCU response code
+func redfishPowerCode(powerState string) (byte, error) {
+	switch powerState {
+	case REDFISH_ON, REDFISH_PAUSED:
+		return CODE_ON, nil
+	case REDFISH_OFF:
+		return CODE_OFF, nil
+	case REDFISH_POWERING_ON:
+		return CODE_TURNING_ON, nil
+	case REDFISH_POWERING_OFF:
+		return CODE_TURNING_OFF, nil
+	}
+	return 0, errors.New("Redfish : unknown power state : " + powerState)
+}
+
+//---------------------------------------------------------
+// Redfish client
+//---------------------------------------------------------
+
+// RedfishClient runs the requests of one command against a Redfish service
+type RedfishClient struct {
+	ctx    context.Context
+	http   *http.Client
+	target RedfishTarget
+}
+
+// NOTE : The client is built per command, the driver is compared with
+// reflect.DeepEqual on reload and keeps no connection
+func (target RedfishTarget) client(ctx context.Context) *RedfishClient {
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+	}
+	if target.insecure {
+		// NOTE : BMCs mostly come with a self-signed certificate
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &RedfishClient{
+		ctx:    ctx,
+		http:   &http.Client{Transport: transport},
+		target: target,
+	}
+}
+
+// computerSystem reads the ComputerSystem of the target, the first member
+// of the Systems collection when the inventory does not name it
+func (c *RedfishClient) computerSystem() (string, RedfishSystem, error) {
+	var system RedfishSystem
+
+	path := c.target.system
+	if path == "" {
+		var systems RedfishCollection
+		err := c.do(http.MethodGet, REDFISH_SYSTEMS, nil, &systems)
+		if err != nil {
+			return "", system, err
+		}
+		if len(systems.Members) == 0 || systems.Members[0].Id == "" {
+			return "", system, errors.New("Redfish : no ComputerSystem at " + c.target.url)
+		}
+		path = systems.Members[0].Id
+	}
+
+	err := c.do(http.MethodGet, path, nil, &system)
+	return path, system, err
+}
+
+// do sends the request with basic authentication and decodes the JSON response into result
+func (c *RedfishClient) do(method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, method, c.target.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.target.user, c.target.password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("OData-Version", "4.0")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, REDFISH_MAX_BODY))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		message := "Redfish : " + method + " " + path + " : " + resp.Status
+		var redfishErr RedfishError
+		if json.Unmarshal(data, &redfishErr) == nil && redfishErr.Error.Message != "" {
+			message += " : " + redfishErr.Error.Message
+		}
+		return errors.New(message)
+	}
+
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return errors.New("Redfish : " + method + " " + path + " : " + err.Error())
+	}
+	return nil
+}
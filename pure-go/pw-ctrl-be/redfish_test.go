@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedfish is a Redfish service with a single ComputerSystem
+type testRedfish struct {
+	server   *httptest.Server
+	user     string
+	password string
+
+	mutex       sync.Mutex
+	powerState  string
+	members     []string
+	resetTarget string
+	resets      []string
+}
+
+func newTestRedfish(t *testing.T, powerState string) *testRedfish {
+	t.Helper()
+
+	rf := &testRedfish{
+		user:        "admin",
+		password:    "secret",
+		powerState:  powerState,
+		members:     []string{"/redfish/v1/Systems/1"},
+		resetTarget: "/redfish/v1/Systems/1/Actions/ComputerSystem.Reset",
+	}
+	rf.server = httptest.NewServer(http.HandlerFunc(rf.serve))
+	t.Cleanup(rf.server.Close)
+	return rf
+}
+
+func (rf *testRedfish) serve(w http.ResponseWriter, r *http.Request) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user != rf.user || password != rf.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"code":"Base.1.8.GeneralError","message":"Invalid username or password"}}`))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == REDFISH_SYSTEMS:
+		var systems RedfishCollection
+		for _, member := range rf.members {
+			systems.Members = append(systems.Members, struct {
+				Id string `json:"@odata.id"`
+			}{member})
+		}
+		json.NewEncoder(w).Encode(systems)
+
+	case r.Method == http.MethodGet && r.URL.Path == "/redfish/v1/Systems/1":
+		var system RedfishSystem
+		system.PowerState = rf.powerState
+		system.Actions.Reset.Target = rf.resetTarget
+		json.NewEncoder(w).Encode(system)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/redfish/v1/Systems/1/Actions/ComputerSystem.Reset":
+		var body map[string]string
+		if json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rf.resets = append(rf.resets, body["ResetType"])
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (rf *testRedfish) set(powerState string) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	rf.powerState = powerState
+	rf.resets = nil
+}
+
+func (rf *testRedfish) resetTypes() []string {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	return append([]string(nil), rf.resets...)
+}
+
+func redfishExchange(t *testing.T, rf *testRedfish, ws WorkstationConfig, cmdStr string) (string, int, error) {
+	t.Helper()
+
+	ws.Id = 700
+	ws.Host = rf.server.URL
+	driver, err := redfishDriver([]WorkstationConfig{ws})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return driver.Exchange(nil, cmdStr, time.Now().Add(2*time.Second))
+}
+
+func TestRedfishPowerCode(t *testing.T) {
+	tests := []struct {
+		powerState string
+		code       byte
+		ok         bool
+	}{
+		{REDFISH_ON, CODE_ON, true},
+		{REDFISH_PAUSED, CODE_ON, true},
+		{REDFISH_OFF, CODE_OFF, true},
+		{REDFISH_POWERING_ON, CODE_TURNING_ON, true},
+		{REDFISH_POWERING_OFF, CODE_TURNING_OFF, true},
+		{"", 0, false},
+		{"on", 0, false},
+		{"Standby", 0, false},
+	}
+
+	for _, tt := range tests {
+		code, err := redfishPowerCode(tt.powerState)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q : err = %v", tt.powerState, err)
+			continue
+		}
+		if code != tt.code {
+			t.Errorf("%q : code = %q, want %q", tt.powerState, code, tt.code)
+		}
+	}
+}
+
+func TestRedfishExchange(t *testing.T) {
+	tests := []struct {
+		name       string
+		powerState string
+		cmd        string
+		response   string
+		resets     []string
+	}{
+		{"status on", REDFISH_ON, "C0700", "1", nil},
+		{"status paused", REDFISH_PAUSED, "C0700", "1", nil},
+		{"status off", REDFISH_OFF, "C0700", "0", nil},
+		{"status powering on", REDFISH_POWERING_ON, "C0700", "3", nil},
+		{"status powering off", REDFISH_POWERING_OFF, "C0700", "2", nil},
+		{"turn on", REDFISH_OFF, "S0700", "3", []string{"On"}},
+		{"shut down", REDFISH_ON, "Q0700", "2", []string{"GracefulShutdown"}},
+		{"force off", REDFISH_ON, "E0700", "2", []string{"ForceOff"}},
+		{"force off while powering on", REDFISH_POWERING_ON, "E0700", "2", []string{"ForceOff"}},
+		{"already on", REDFISH_ON, "S0700", "1", nil},
+		{"already off", REDFISH_OFF, "Q0700", "0", nil},
+		{"already forced off", REDFISH_OFF, "E0700", "0", nil},
+		{"unknown workstation", REDFISH_ON, "C0701", "9", nil},
+		{"unknown command", REDFISH_ON, "X0700", "9", nil},
+	}
+
+	rf := newTestRedfish(t, REDFISH_OFF)
+	ws := WorkstationConfig{User: rf.user, Password: rf.password}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rf.set(tt.powerState)
+
+			response, code, err := redfishExchange(t, rf, ws, tt.cmd)
+			if code != SUCCESS || err != nil {
+				t.Fatalf("code = %v, err = %v", code, err)
+			}
+			if response != tt.response {
+				t.Errorf("response = %v, want %v", response, tt.response)
+			}
+			resets := rf.resetTypes()
+			if strings.Join(resets, ",") != strings.Join(tt.resets, ",") {
+				t.Errorf("resets = %v, want %v", resets, tt.resets)
+			}
+		})
+	}
+}
+
+func TestRedfishExchangeDefaultResetTarget(t *testing.T) {
+	rf := newTestRedfish(t, REDFISH_OFF)
+	// NOTE : Without the action target, the reset is posted to the standard path
+	rf.mutex.Lock()
+	rf.resetTarget = ""
+	rf.mutex.Unlock()
+	ws := WorkstationConfig{User: rf.user, Password: rf.password}
+
+	response, code, err := redfishExchange(t, rf, ws, "S0700")
+	if code != SUCCESS || err != nil || response != "3" {
+		t.Fatalf("response = %v, code = %v, err = %v", response, code, err)
+	}
+	if resets := rf.resetTypes(); len(resets) != 1 || resets[0] != "On" {
+		t.Errorf("resets = %v, want [On]", resets)
+	}
+}
+
+func TestRedfishExchangeSystem(t *testing.T) {
+	rf := newTestRedfish(t, REDFISH_ON)
+	// NOTE : The inventory names the system, the Systems collection is not read
+	rf.mutex.Lock()
+	rf.members = nil
+	rf.mutex.Unlock()
+	ws := WorkstationConfig{User: rf.user, Password: rf.password, System: "/redfish/v1/Systems/1"}
+
+	response, code, err := redfishExchange(t, rf, ws, "C0700")
+	if code != SUCCESS || err != nil || response != "1" {
+		t.Fatalf("response = %v, code = %v, err = %v", response, code, err)
+	}
+}
+
+func TestRedfishExchangeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		members    []string
+		powerState string
+		err        string
+	}{
+		{"wrong password", "admin", "wrong", nil, REDFISH_ON, "401 Unauthorized : Invalid username or password"},
+		{"no members", "admin", "secret", []string{}, REDFISH_ON, "no ComputerSystem at"},
+		{"empty member", "admin", "secret", []string{""}, REDFISH_ON, "no ComputerSystem at"},
+		{"missing member", "admin", "secret", []string{"/redfish/v1/Systems/2"}, REDFISH_ON, "404 Not Found"},
+		{"unknown power state", "admin", "secret", nil, "Standby", "unknown power state : Standby"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rf := newTestRedfish(t, tt.powerState)
+			if tt.members != nil {
+				rf.mutex.Lock()
+				rf.members = tt.members
+				rf.mutex.Unlock()
+			}
+			ws := WorkstationConfig{User: tt.user, Password: tt.password}
+
+			_, code, err := redfishExchange(t, rf, ws, "S0700")
+			if code != ERROR_NETWORK || err == nil {
+				t.Fatalf("code = %v, err = %v, want ERROR_NETWORK", code, err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+			if resets := rf.resetTypes(); len(resets) != 0 {
+				t.Errorf("resets = %v, want none", resets)
+			}
+		})
+	}
+}
+
+func TestRedfishExchangeDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	driver, err := redfishDriver([]WorkstationConfig{{Id: 700, Host: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, code, err := driver.Exchange(nil, "C0700", time.Now().Add(50*time.Millisecond))
+	if code != ERROR_NETWORK || err == nil {
+		t.Fatalf("code = %v, err = %v, want ERROR_NETWORK", code, err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("returned after %v, want the deadline", elapsed)
+	}
+}
+
+func TestRedfishDriverConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		ws   []WorkstationConfig
+		url  string
+		err  string
+	}{
+		{"https by default", []WorkstationConfig{{Id: 1, Host: "10.0.0.1"}}, "https://10.0.0.1", ""},
+		{"http", []WorkstationConfig{{Id: 1, Host: "http://10.0.0.1:8000/ignored"}}, "http://10.0.0.1:8000", ""},
+		{"no workstations", nil, "", "no workstations"},
+		{"no host", []WorkstationConfig{{Id: 1}}, "", "no host"},
+		{"duplicate", []WorkstationConfig{{Id: 1, Host: "a"}, {Id: 1, Host: "b"}}, "", "duplicate workstation : 1"},
+		{"invalid scheme", []WorkstationConfig{{Id: 1, Host: "ftp://10.0.0.1"}}, "", "invalid host"},
+		{"invalid system", []WorkstationConfig{{Id: 1, Host: "a", System: "Systems/1"}}, "", "invalid system"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver, err := redfishDriver(tt.ws)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url := driver.(RedfishDriver).targets[1].url; url != tt.url {
+				t.Errorf("url = %v, want %v", url, tt.url)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// ReloadResult tells what a reload did to each controller
+type ReloadResult struct {
+	Kept            []string `json:"kept"`
+	Reopened        []string `json:"reopened"`
+	Added           []string `json:"added"`
+	Removed         []string `json:"removed"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+var reloadMutex sync.Mutex
+
+// watchReload reloads the configuration on SIGHUP
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			logger.Info("SIGHUP received, reloading configuration")
+			_, code, err := reloadConfig()
+			if err != nil {
+				logger.Infof("Failed to reload configuration (%v) : %v", code, err.Error())
+			}
+		}
+	}()
+}
+
+// reloadConfig reads the configuration again and applies it.
+//   - An unchanged controller keeps its port, queue and routes.
+//   - A controller whose port, line setting or driver changed is
+//     reopened. The running command completes first because the port
+//     is reopened under portMutex; queued commands wait for the new port.
+//   - A removed controller fails its queued commands and closes its port.
+//
+// The listen address, base path and swagger host need a restart.
+func reloadConfig() (ReloadResult, int, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	result := ReloadResult{
+		Kept:            make([]string, 0),
+		Reopened:        make([]string, 0),
+		Added:           make([]string, 0),
+		Removed:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+
+	cfg, err := readConfig(configArgs_)
+	if err != nil {
+		return result, ERROR_CONFIG, err
+	}
+
+	// NOTE : Discovery replaces the routes of the controllers it probes
+	if lastDiscovery().Running {
+		return result, ERROR_RELOAD_BUSY, errors.New("discovery is running")
+	}
+
+	err = validateControllers(cfg)
+	if err != nil {
+		return result, ERROR_CONFIG, err
+	}
+
+	pwctls := make([]*PwCtrl, len(cfg.Controllers))
+	for i, cc := range cfg.Controllers {
+		pwctls[i], err = cc.newPwCtrl(cfg)
+		if err != nil {
+			return result, ERROR_CONFIG, err
+		}
+	}
+
+	if cfg.Listen != config_.Listen {
+		result.RestartRequired = append(result.RestartRequired, "listen")
+	}
+	if cfg.BasePath != config_.BasePath {
+		result.RestartRequired = append(result.RestartRequired, "basePath")
+	}
+	if cfg.SwaggerHost != config_.SwaggerHost {
+		result.RestartRequired = append(result.RestartRequired, "swaggerHost")
+	}
+	if cfg.HA != config_.HA {
+		result.RestartRequired = append(result.RestartRequired, "ha")
+	}
+
+	cfg.applyGlobals()
+
+	current := make(map[string]*Controller)
+	for _, controller := range controllerList() {
+		current[controller.name] = controller
+	}
+
+	controllers := make([]*Controller, 0, len(cfg.Controllers))
+	routes := make([]Route, 0)
+	autoControllers := make([]*Controller, 0)
+
+	for i, cc := range cfg.Controllers {
+		autoDiscover := len(cc.Routes) == 1 && cc.Routes[0] == "auto"
+
+		controller, found := current[cc.Name]
+		if found {
+			delete(current, cc.Name)
+			controller.queue.setSize(queueSize_)
+
+			if controller.pwctl.reconfigure(pwctls[i]) {
+				result.Reopened = append(result.Reopened, cc.Name)
+			} else {
+				result.Kept = append(result.Kept, cc.Name)
+			}
+		} else {
+			controller = NewController(cc.Name, pwctls[i])
+			controller.start(context.Background())
+			if !controller.pwctl.standby {
+				go controller.queue.submitInitialize(context.Background())
+			}
+			result.Added = append(result.Added, cc.Name)
+		}
+
+		if autoDiscover {
+			// NOTE : Keep the discovered routes of a controller which was already discovering
+			if found && controller.autoDiscover {
+				routes = append(routes, routes_.routesOf(controller)...)
+			} else {
+				autoControllers = append(autoControllers, controller)
+			}
+		} else {
+			for _, spec := range cc.Routes {
+				first, last, _ := parseRoute(spec)
+				routes = append(routes, Route{spec, first, last, controller})
+			}
+		}
+		controller.autoDiscover = autoDiscover
+		controllers = append(controllers, controller)
+	}
+
+	routes_.reset(routes)
+	setControllerList(controllers)
+	config_ = cfg
+
+	for name, controller := range current {
+		controller.stop()
+		result.Removed = append(result.Removed, name)
+	}
+
+	if len(autoControllers) > 0 && beginDiscovery(discoveryFirstId_, discoveryLastId_) {
+		go discoverRoutes(context.Background(), autoControllers, discoveryFirstId_, discoveryLastId_)
+	}
+
+	logger.Infof("Configuration reloaded : kept %v, reopened %v, added %v, removed %v",
+		result.Kept, result.Reopened, result.Added, result.Removed)
+	if len(result.RestartRequired) > 0 {
+		logger.Infof("Restart required to apply : %v", result.RestartRequired)
+	}
+
+	return result, SUCCESS, nil
+}
+
+// reconfigure takes the port setting of the new PwCtrl.
+// It returns true if the port was reopened.
+func (pwctl *PwCtrl) reconfigure(newPwctl *PwCtrl) bool {
+	pwctl.portMutex.Lock()
+	defer pwctl.portMutex.Unlock()
+
+	// NOTE : The read deadlines are set on every read, no reopen is needed
+	pwctl.readTimeOut = newPwctl.readTimeOut
+	pwctl.readMinByte = newPwctl.readMinByte
+	pwctl.readDeadlines = newPwctl.readDeadlines
+
+	if pwctl.portSelector.equal(newPwctl.portSelector) &&
+		*pwctl.serialMode == *newPwctl.serialMode &&
+		reflect.DeepEqual(pwctl.driver, newPwctl.driver) {
+		return false
+	}
+
+	pwctl.portSelector = newPwctl.portSelector
+	pwctl.serialMode = newPwctl.serialMode
+	pwctl.driver = newPwctl.driver
+	if pwctl.standby {
+		return false
+	}
+
+	_, err := pwctl.intializeConnection()
+	if err != nil {
+		pwctl.startReIntializing(err)
+	}
+	return true
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------
+// SNMP driver (switched PDUs)
+//---------------------------------------------------------
+
+const SNMP_PORT = "161"
+
+// SNMP versions, as encoded in the message
+const (
+	SNMP_VERSION_1  = 0
+	SNMP_VERSION_2C = 1
+)
+
+// BER tags and SNMP PDU types
+const (
+	BER_INTEGER      = 0x02
+	BER_OCTET_STRING = 0x04
+	BER_NULL         = 0x05
+	BER_OID          = 0x06
+	BER_SEQUENCE     = 0x30
+
+	SNMP_GET_REQUEST  = 0xa0
+	SNMP_GET_RESPONSE = 0xa2
+	SNMP_SET_REQUEST  = 0xa3
+
+	// NOTE : SNMPv2c answers these in place of the value
+	SNMP_NO_SUCH_OBJECT   = 0x80
+	SNMP_NO_SUCH_INSTANCE = 0x81
+)
+
+// SNMP error status answered as an unknown workstation
+const (
+	SNMP_NO_SUCH_NAME = 2
+	SNMP_NO_CREATION  = 11
+)
+
+// NOTE : UDP, a request is sent again if no response arrives within this
+var snmpRetryInterval_ = 1 * time.Second
+
+// SnmpOutletModel is the outlet OIDs and values of a PDU vendor MIB.
+// The outlet number is appended to the OIDs, or replaces {outlet}.
+type SnmpOutletModel struct {
+	ControlOid string `yaml:"controlOid"`
+	StatusOid  string `yaml:"statusOid"`
+	// Values written to the control OID
+	SetOn  *int `yaml:"setOn"`
+	SetOff *int `yaml:"setOff"`
+	// Values read from the status OID
+	StateOn  *int `yaml:"stateOn"`
+	StateOff *int `yaml:"stateOff"`
+}
+
+func intRef(value int) *int {
+	return &value
+}
+
+// snmpModels_ are the outlet MIBs of the supported PDUs
+var snmpModels_ = map[string]SnmpOutletModel{
+	// PowerNet-MIB : rPDUOutletControlOutletCommand (immediateOn, immediateOff)
+	// and rPDUOutletStatusOutletState (outletStatusOn, outletStatusOff)
+	"apc": {
+		ControlOid: ".1.3.6.1.4.1.318.1.1.12.3.3.1.1.4",
+		StatusOid:  ".1.3.6.1.4.1.318.1.1.12.3.5.1.1.4",
+		SetOn:      intRef(1),
+		SetOff:     intRef(2),
+		StateOn:    intRef(1),
+		StateOff:   intRef(2),
+	},
+	// PDU2-MIB of the first PDU : switchingOperation (on, off) and the
+	// onOff sensor state of the outlet (on, off)
+	"raritan": {
+		ControlOid: ".1.3.6.1.4.1.13742.6.4.1.2.1.2.1",
+		StatusOid:  ".1.3.6.1.4.1.13742.6.5.4.3.1.3.1.{outlet}.14",
+		SetOn:      intRef(1),
+		SetOff:     intRef(0),
+		StateOn:    intRef(7),
+		StateOff:   intRef(8),
+	},
+}
+
+// SnmpConfig is the switched PDU of a controller. The workstations of the
+// inventory are mapped to its outlets.
+type SnmpConfig struct {
+	// <host>[:<udp port>], port 161 by default
+	Host string `yaml:"host"`
+	// 1 or 2c (default)
+	Version string `yaml:"version"`
+	// public and private by default
+	Community      string `yaml:"community"`
+	WriteCommunity string `yaml:"writeCommunity"`
+	// apc (default) or raritan, the OIDs and values below override the model
+	Model           string `yaml:"model"`
+	SnmpOutletModel `yaml:",inline"`
+}
+
+// SnmpDriver switches a workstation with an outlet of a PDU over SNMP.
+//   - S : SET of the control OID to the on value, answered with 1
+//   - Q, E : SET of the control OID to the off value, answered with 0.
+//     An outlet has no graceful shutdown.
+//   - C : GET of the status OID, answered with 0 or 1
+//
+// A workstation not in the inventory, or an outlet the PDU does not have,
+// is answered with 9.
+type SnmpDriver struct {
+	address        string
+	version        int
+	community      string
+	writeCommunity string
+	controlOid     string
+	statusOid      string
+	setOn          int
+	setOff         int
+	stateOn        int
+	stateOff       int
+	outlets        map[int]int
+}
+
+// driver validates the PDU and the inventory and returns the driver
+func (sc SnmpConfig) driver(workstations []WorkstationConfig) (Driver, error) {
+	if sc.Host == "" {
+		return nil, errors.New("snmp : no host")
+	}
+	if len(workstations) == 0 {
+		return nil, errors.New("snmp : no workstations")
+	}
+
+	d := SnmpDriver{
+		address:        withDefaultPort(sc.Host, SNMP_PORT),
+		community:      sc.Community,
+		writeCommunity: sc.WriteCommunity,
+		outlets:        make(map[int]int),
+	}
+	if d.community == "" {
+		d.community = "public"
+	}
+	if d.writeCommunity == "" {
+		d.writeCommunity = "private"
+	}
+
+	switch sc.Version {
+	case "", "2c":
+		d.version = SNMP_VERSION_2C
+	case "1":
+		d.version = SNMP_VERSION_1
+	default:
+		return nil, errors.New("snmp : invalid version : " + sc.Version + " (1 or 2c)")
+	}
+
+	modelName := strings.ToLower(sc.Model)
+	if modelName == "" {
+		modelName = "apc"
+	}
+	model, found := snmpModels_[modelName]
+	if !found {
+		return nil, errors.New("snmp : unknown model : " + sc.Model)
+	}
+
+	d.controlOid = model.ControlOid
+	if sc.ControlOid != "" {
+		d.controlOid = sc.ControlOid
+	}
+	d.statusOid = model.StatusOid
+	if sc.StatusOid != "" {
+		d.statusOid = sc.StatusOid
+	}
+	for _, oid := range []string{d.controlOid, d.statusOid} {
+		if _, err := berOid(outletOid(oid, 1)); err != nil {
+			return nil, errors.New("snmp : " + err.Error())
+		}
+	}
+
+	d.setOn = *model.SetOn
+	if sc.SetOn != nil {
+		d.setOn = *sc.SetOn
+	}
+	d.setOff = *model.SetOff
+	if sc.SetOff != nil {
+		d.setOff = *sc.SetOff
+	}
+	d.stateOn = *model.StateOn
+	if sc.StateOn != nil {
+		d.stateOn = *sc.StateOn
+	}
+	d.stateOff = *model.StateOff
+	if sc.StateOff != nil {
+		d.stateOff = *sc.StateOff
+	}
+
+	for _, ws := range workstations {
+		id := strconv.Itoa(ws.Id)
+		if _, found := d.outlets[ws.Id]; found {
+			return nil, errors.New("snmp : duplicate workstation : " + id)
+		}
+		if ws.Outlet < 1 {
+			return nil, errors.New("snmp : workstation " + id + " : no outlet")
+		}
+		d.outlets[ws.Id] = ws.Outlet
+	}
+	return d, nil
+}
+
+func (d SnmpDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	letter, id, err := parseCommand(cmdStr)
+	if err != nil {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	outlet, found := d.outlets[id]
+	if !found {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	switch letter {
+	case 'S', 'Q', 'E':
+		set, response := d.setOff, byte(CODE_OFF)
+		if letter == 'S' {
+			set, response = d.setOn, CODE_ON
+		}
+		_, found, err = d.request(SNMP_SET_REQUEST, outletOid(d.controlOid, outlet), set, deadline)
+		if err != nil {
+			return "", ERROR_NETWORK, err
+		}
+		if !found {
+			return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+		}
+		return string(response), SUCCESS, nil
+	case 'C':
+		value, found, err := d.request(SNMP_GET_REQUEST, outletOid(d.statusOid, outlet), 0, deadline)
+		if err != nil {
+			return "", ERROR_NETWORK, err
+		}
+		if !found {
+			return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+		}
+		switch value {
+		case int64(d.stateOn):
+			return string(CODE_ON), SUCCESS, nil
+		case int64(d.stateOff):
+			return string(CODE_OFF), SUCCESS, nil
+		}
+		return "", ERROR_NETWORK, errors.New("SNMP : unknown state " + strconv.FormatInt(value, 10) + " of outlet " + strconv.Itoa(outlet))
+	}
+	return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+}
+
+func (d SnmpDriver) Name() string {
+	return DRIVER_SNMP
+}
+
+func (d SnmpDriver) UsesPort() bool {
+	return false
+}
+
+// outletOid returns the OID of the outlet
+func outletOid(oid string, outlet int) string {
+	if strings.Contains(oid, "{outlet}") {
+		return strings.ReplaceAll(oid, "{outlet}", strconv.Itoa(outlet))
+	}
+	return oid + "." + strconv.Itoa(outlet)
+}
+
+// request sends a GET, or a SET of the integer value, and returns the integer
+// value of the response. found is false if the agent has no such object.
+func (d SnmpDriver) request(pduType byte, oid string, value int, deadline time.Time) (int64, bool, error) {
+	encodedOid, err := berOid(oid)
+	if err != nil {
+		return 0, false, err
+	}
+
+	community := d.community
+	encodedValue := berTlv(BER_NULL, nil)
+	if pduType == SNMP_SET_REQUEST {
+		community = d.writeCommunity
+		encodedValue = berTlv(BER_INTEGER, berInt(int64(value)))
+	}
+
+	requestId := rand.Int31()
+	varbind := berTlv(BER_SEQUENCE, append(berTlv(BER_OID, encodedOid), encodedValue...))
+	pdu := berTlv(BER_INTEGER, berInt(int64(requestId)))
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(0))...)
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(0))...)
+	pdu = append(pdu, berTlv(BER_SEQUENCE, varbind)...)
+
+	message := berTlv(BER_INTEGER, berInt(int64(d.version)))
+	message = append(message, berTlv(BER_OCTET_STRING, []byte(community))...)
+	message = append(message, berTlv(pduType, pdu)...)
+	message = berTlv(BER_SEQUENCE, message)
+
+	response, err := d.transact(message, requestId, deadline)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if response.errorStatus == SNMP_NO_SUCH_NAME || response.errorStatus == SNMP_NO_CREATION {
+		return 0, false, nil
+	}
+	if response.errorStatus != 0 {
+		return 0, false, errors.New("SNMP : " + oid + " : error status " + strconv.FormatInt(response.errorStatus, 10))
+	}
+	if response.valueTag == SNMP_NO_SUCH_OBJECT || response.valueTag == SNMP_NO_SUCH_INSTANCE {
+		return 0, false, nil
+	}
+	if response.valueTag != BER_INTEGER {
+		return 0, false, errors.New("SNMP : " + oid + " : not an integer : tag " + hexByte(response.valueTag))
+	}
+	return berParseInt(response.value), true, nil
+}
+
+// SnmpResponse is the part of a GetResponse used by the driver
+type SnmpResponse struct {
+	requestId   int64
+	errorStatus int64
+	valueTag    byte
+	value       []byte
+}
+
+// transact sends the message until the response to the request id arrives
+func (d SnmpDriver) transact(message []byte, requestId int32, deadline time.Time) (SnmpResponse, error) {
+	conn, err := net.Dial("udp", d.address)
+	if err != nil {
+		return SnmpResponse{}, err
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		_, err = conn.Write(message)
+		if err != nil {
+			return SnmpResponse{}, err
+		}
+
+		retryAt := time.Now().Add(snmpRetryInterval_)
+		if retryAt.After(deadline) {
+			retryAt = deadline
+		}
+		conn.SetReadDeadline(retryAt)
+		for {
+			n, err := conn.Read(buff)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return SnmpResponse{}, err
+			}
+
+			response, err := parseSnmpResponse(buff[:n])
+			if err != nil {
+				logger.Infof("SNMP : %v : %v", d.address, err)
+				continue
+			}
+			if response.requestId == int64(requestId) {
+				return response, nil
+			}
+		}
+	}
+	// NOTE : An agent drops a request with a wrong community
+	return SnmpResponse{}, errors.New("SNMP : no response from " + d.address + " (community ?)")
+}
+
+// parseSnmpResponse decodes a GetResponse message with one variable binding
+func parseSnmpResponse(data []byte) (SnmpResponse, error) {
+	var response SnmpResponse
+
+	tag, message, _, err := berRead(data)
+	if err != nil {
+		return response, errors.New("invalid message : " + err.Error())
+	}
+	if tag != BER_SEQUENCE {
+		return response, errors.New("invalid message")
+	}
+
+	var content []byte
+	fields := []byte{BER_INTEGER, BER_OCTET_STRING, SNMP_GET_RESPONSE}
+	for _, expected := range fields {
+		tag, content, message, err = berRead(message)
+		if err != nil || tag != expected {
+			return response, errors.New("invalid message header")
+		}
+	}
+
+	pdu := content
+	var values [3]int64
+	for i := range values {
+		tag, content, pdu, err = berRead(pdu)
+		if err != nil || tag != BER_INTEGER {
+			return response, errors.New("invalid PDU")
+		}
+		values[i] = berParseInt(content)
+	}
+	response.requestId = values[0]
+	response.errorStatus = values[1]
+
+	tag, varbinds, _, err := berRead(pdu)
+	if err != nil || tag != BER_SEQUENCE {
+		return response, errors.New("invalid variable bindings")
+	}
+	tag, varbind, _, err := berRead(varbinds)
+	if err != nil || tag != BER_SEQUENCE {
+		return response, errors.New("invalid variable binding")
+	}
+	tag, _, varbind, err = berRead(varbind)
+	if err != nil || tag != BER_OID {
+		return response, errors.New("invalid variable binding")
+	}
+	response.valueTag, response.value, _, err = berRead(varbind)
+	if err != nil {
+		return response, errors.New("invalid value")
+	}
+	return response, nil
+}
+
+//---------------------------------------------------------
+// BER encoding
+//---------------------------------------------------------
+
+func berTlv(tag byte, content []byte) []byte {
+	tlv := []byte{tag}
+	length := len(content)
+	switch {
+	case length < 0x80:
+		tlv = append(tlv, byte(length))
+	case length < 0x100:
+		tlv = append(tlv, 0x81, byte(length))
+	default:
+		tlv = append(tlv, 0x82, byte(length>>8), byte(length))
+	}
+	return append(tlv, content...)
+}
+
+// berInt is the shortest two's complement of the value
+func berInt(value int64) []byte {
+	length := 1
+	for v := value; v > 127 || v < -128; v >>= 8 {
+		length++
+	}
+
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = byte(value)
+		value >>= 8
+	}
+	return encoded
+}
+
+func berParseInt(content []byte) int64 {
+	var value int64
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// berOid encodes a dotted OID (ex: .1.3.6.1.2.1.1.1.0)
+func berOid(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, errors.New("invalid OID : " + oid)
+	}
+
+	ids := make([]uint64, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid OID : " + oid)
+		}
+		ids[i] = id
+	}
+	if ids[0] > 2 || (ids[0] < 2 && ids[1] > 39) {
+		return nil, errors.New("invalid OID : " + oid)
+	}
+
+	// NOTE : The first two ids are encoded in one, then base 128 with the
+	// high bit set on every byte but the last
+	var encoded []byte
+	for _, id := range append([]uint64{ids[0]*40 + ids[1]}, ids[2:]...) {
+		chunk := []byte{byte(id & 0x7f)}
+		for id >>= 7; id > 0; id >>= 7 {
+			chunk = append([]byte{byte(id&0x7f) | 0x80}, chunk...)
+		}
+		encoded = append(encoded, chunk...)
+	}
+	return encoded, nil
+}
+
+// berRead splits the first TLV off the data
+func berRead(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated")
+	}
+
+	tag := data[0]
+	length := int(data[1])
+	offset := 2
+	if length&0x80 != 0 {
+		// NOTE : A message fits a UDP datagram, a length takes at most 2 bytes
+		size := length & 0x7f
+		if size == 0 {
+			return 0, nil, nil, errors.New("indefinite length")
+		}
+		if size > 2 {
+			return 0, nil, nil, errors.New("length of " + strconv.Itoa(size) + " bytes, at most 2 supported")
+		}
+		if len(data) < 2+size {
+			return 0, nil, nil, errors.New("truncated")
+		}
+		length = 0
+		for _, b := range data[2 : 2+size] {
+			length = length<<8 | int(b)
+		}
+		offset += size
+	}
+
+	if len(data) < offset+length {
+		return 0, nil, nil, errors.New("truncated")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
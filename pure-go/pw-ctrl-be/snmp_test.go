@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBerInt(t *testing.T) {
+	tests := []struct {
+		value   int64
+		encoded string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "0080"},
+		{255, "00ff"},
+		{256, "0100"},
+		{32767, "7fff"},
+		{32768, "008000"},
+		{-1, "ff"},
+		{-128, "80"},
+		{-129, "ff7f"},
+		{-256, "ff00"},
+		{-32768, "8000"},
+		{-32769, "ff7fff"},
+		{math.MaxInt32, "7fffffff"},
+		{math.MinInt32, "80000000"},
+		{math.MaxUint32, "00ffffffff"},
+		{math.MaxInt64, "7fffffffffffffff"},
+		{math.MinInt64, "8000000000000000"},
+	}
+
+	for _, tt := range tests {
+		encoded := berInt(tt.value)
+		if !bytes.Equal(encoded, unhex(t, tt.encoded)) {
+			t.Errorf("%v : encoded % x, want %v", tt.value, encoded, tt.encoded)
+		}
+		if value := berParseInt(encoded); value != tt.value {
+			t.Errorf("%v : parsed %v", tt.value, value)
+		}
+	}
+}
+
+func TestBerTlv(t *testing.T) {
+	tests := []struct {
+		length int
+		header string
+	}{
+		{0, "0400"},
+		{1, "0401"},
+		{127, "047f"},
+		{128, "048180"},
+		{255, "0481ff"},
+		{256, "04820100"},
+		{1500, "048205dc"},
+		{65535, "0482ffff"},
+	}
+
+	for _, tt := range tests {
+		content := bytes.Repeat([]byte{0xa5}, tt.length)
+		tlv := berTlv(BER_OCTET_STRING, content)
+
+		header := unhex(t, tt.header)
+		if !bytes.HasPrefix(tlv, header) || len(tlv) != len(header)+tt.length {
+			t.Errorf("%v : header % x, want %v", tt.length, tlv[:len(header)], tt.header)
+			continue
+		}
+
+		// NOTE : The rest is left for the next TLV
+		tag, read, rest, err := berRead(append(tlv, 0x05, 0x00))
+		if err != nil || tag != BER_OCTET_STRING || !bytes.Equal(read, content) || !bytes.Equal(rest, []byte{0x05, 0x00}) {
+			t.Errorf("%v : read tag %#x, %v bytes, rest % x, err %v", tt.length, tag, len(read), rest, err)
+		}
+	}
+}
+
+func TestBerRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		content string
+		err     string
+	}{
+		{"short form", "020105", "05", ""},
+		{"long form", "02810105", "05", ""},
+		{"empty content", "0500", "", ""},
+		{"empty", "", "", "truncated"},
+		{"tag only", "02", "", "truncated"},
+		{"truncated content", "020301", "", "truncated"},
+		{"truncated length", "3082ff", "", "truncated"},
+		{"truncated long content", "0482010001", "", "truncated"},
+		{"indefinite length", "30800000", "", "indefinite length"},
+		{"3 byte length", "3083000001ff", "", "length of 3 bytes, at most 2 supported"},
+		{"4 byte length", "308400000001ff", "", "length of 4 bytes, at most 2 supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, content, _, err := berRead(unhex(t, tt.data))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, unhex(t, tt.content)) {
+				t.Errorf("content = % x, want %v", content, tt.content)
+			}
+		})
+	}
+}
+
+func TestBerOid(t *testing.T) {
+	tests := []struct {
+		oid     string
+		encoded string
+	}{
+		{".1.3.6.1.2.1.1.1.0", "2b06010201010100"},
+		{"1.3.6.1.2.1.1.1.0", "2b06010201010100"},
+		{"0.0", "00"},
+		{"1.39", "4f"},
+		{"2.40", "78"},
+		// NOTE : The first byte of 2.999 is more than 127, it takes two bytes
+		{"2.999.3", "883703"},
+		{".1.3.6.1.4.1.318.1.1.12.3.3.1.1.4.8", "2b06010401823e01010c030301010408"},
+		{".1.3.6.1.4.1.13742.6.4.1.2.1.2.1.24", "2b06010401eb2e0604010201020118"},
+		{".1.3.127.128.16383.16384", "2b7f8100ff7f818000"},
+		{".1.3.4294967295", "2b8fffffff7f"},
+	}
+
+	for _, tt := range tests {
+		encoded, err := berOid(tt.oid)
+		if err != nil {
+			t.Errorf("%v : %v", tt.oid, err)
+			continue
+		}
+		if !bytes.Equal(encoded, unhex(t, tt.encoded)) {
+			t.Errorf("%v : encoded % x, want %v", tt.oid, encoded, tt.encoded)
+		}
+	}
+
+	invalid := []string{"", ".", "1", "1.", "1..3", "1.3.x", "1.-3", "3.1", "1.40", "0.40", "1.3.4294967296"}
+	for _, oid := range invalid {
+		if encoded, err := berOid(oid); err == nil {
+			t.Errorf("%q : encoded % x, want an error", oid, encoded)
+		}
+	}
+}
+
+// snmpMessage is an SNMPv2c message of the PDU type with one variable binding
+func snmpMessage(pduType byte, requestId int64, errorStatus int64, oid []byte, value []byte) []byte {
+	varbind := berTlv(BER_SEQUENCE, append(berTlv(BER_OID, oid), value...))
+	pdu := berTlv(BER_INTEGER, berInt(requestId))
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(errorStatus))...)
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(1))...)
+	pdu = append(pdu, berTlv(BER_SEQUENCE, varbind)...)
+
+	message := berTlv(BER_INTEGER, berInt(SNMP_VERSION_2C))
+	message = append(message, berTlv(BER_OCTET_STRING, []byte("public"))...)
+	message = append(message, berTlv(pduType, pdu)...)
+	return berTlv(BER_SEQUENCE, message)
+}
+
+func TestParseSnmpResponse(t *testing.T) {
+	oid, _ := berOid(".1.3.6.1.4.1.318.1.1.12.3.5.1.1.4.1")
+
+	tests := []struct {
+		name        string
+		message     []byte
+		requestId   int64
+		errorStatus int64
+		valueTag    byte
+		value       int64
+	}{
+		{"integer", snmpMessage(SNMP_GET_RESPONSE, 42, 0, oid, berTlv(BER_INTEGER, berInt(1))), 42, 0, BER_INTEGER, 1},
+		{"negative integer", snmpMessage(SNMP_GET_RESPONSE, 42, 0, oid, berTlv(BER_INTEGER, berInt(-70000))), 42, 0, BER_INTEGER, -70000},
+		{"large request id", snmpMessage(SNMP_GET_RESPONSE, math.MaxInt32, 0, oid, berTlv(BER_INTEGER, berInt(2))), math.MaxInt32, 0, BER_INTEGER, 2},
+		{"no such object", snmpMessage(SNMP_GET_RESPONSE, 7, 0, oid, berTlv(SNMP_NO_SUCH_OBJECT, nil)), 7, 0, SNMP_NO_SUCH_OBJECT, 0},
+		{"no such instance", snmpMessage(SNMP_GET_RESPONSE, 7, 0, oid, berTlv(SNMP_NO_SUCH_INSTANCE, nil)), 7, 0, SNMP_NO_SUCH_INSTANCE, 0},
+		{"no such name", snmpMessage(SNMP_GET_RESPONSE, 7, SNMP_NO_SUCH_NAME, oid, berTlv(BER_NULL, nil)), 7, SNMP_NO_SUCH_NAME, BER_NULL, 0},
+		{"general error", snmpMessage(SNMP_GET_RESPONSE, 7, 5, oid, berTlv(BER_INTEGER, berInt(1))), 7, 5, BER_INTEGER, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := parseSnmpResponse(tt.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.requestId != tt.requestId || response.errorStatus != tt.errorStatus || response.valueTag != tt.valueTag {
+				t.Errorf("got %+v", response)
+			}
+			if value := berParseInt(response.value); value != tt.value {
+				t.Errorf("value = %v, want %v", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestParseSnmpResponseInvalid(t *testing.T) {
+	oid, _ := berOid(".1.3.6.1.2.1.1.1.0")
+	value := berTlv(BER_INTEGER, berInt(1))
+	message := snmpMessage(SNMP_GET_RESPONSE, 1, 0, oid, value)
+
+	tests := []struct {
+		name    string
+		message []byte
+		err     string
+	}{
+		{"empty", nil, "invalid message : truncated"},
+		{"truncated", message[:len(message)-1], "invalid message : truncated"},
+		{"not a sequence", berTlv(BER_OCTET_STRING, message[2:]), "invalid message"},
+		{"long length", append([]byte{BER_SEQUENCE, 0x83, 0x00, 0x00, byte(len(message) - 2)}, message[2:]...),
+			"invalid message : length of 3 bytes, at most 2 supported"},
+		{"request", snmpMessage(SNMP_GET_REQUEST, 1, 0, oid, value), "invalid message header"},
+		{"no variable bindings", berTlv(BER_SEQUENCE, append(berTlv(BER_INTEGER, berInt(1)),
+			append(berTlv(BER_OCTET_STRING, []byte("public")), berTlv(SNMP_GET_RESPONSE, bytes.Repeat(berTlv(BER_INTEGER, berInt(0)), 3))...)...)),
+			"invalid variable bindings"},
+		{"no value", snmpMessage(SNMP_GET_RESPONSE, 1, 0, oid, nil), "invalid value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := parseSnmpResponse(tt.message)
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("err = %v, want %v (%+v)", err, tt.err, response)
+			}
+		})
+	}
+}
+
+//---------------------------------------------------------
+// Loopback SNMP agent
+//---------------------------------------------------------
+
+// testSnmpAgent answers every request with the error status and value of its OID
+type testSnmpAgent struct {
+	conn *net.UDPConn
+
+	mutex   sync.Mutex
+	replies map[string]func() (int64, []byte)
+	sets    []int64
+}
+
+func newTestSnmpAgent(t *testing.T) *testSnmpAgent {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &testSnmpAgent{conn: conn, replies: make(map[string]func() (int64, []byte))}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			if response := agent.handle(buff[:n]); response != nil {
+				conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+	return agent
+}
+
+func (agent *testSnmpAgent) reply(oid string, errorStatus int64, value []byte) {
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	agent.replies[oid] = func() (int64, []byte) { return errorStatus, value }
+}
+
+func (agent *testSnmpAgent) handle(message []byte) []byte {
+	_, message, _, _ = berRead(message)
+	_, _, message, _ = berRead(message)
+	_, _, message, _ = berRead(message)
+	pduType, pdu, _, err := berRead(message)
+	if err != nil {
+		return nil
+	}
+	_, requestId, pdu, _ := berRead(pdu)
+	_, _, pdu, _ = berRead(pdu)
+	_, _, pdu, _ = berRead(pdu)
+	_, varbinds, _, _ := berRead(pdu)
+	_, varbind, _, _ := berRead(varbinds)
+	_, oid, varbind, _ := berRead(varbind)
+	valueTag, value, _, err := berRead(varbind)
+	if err != nil {
+		return nil
+	}
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+
+	if pduType == SNMP_SET_REQUEST && valueTag == BER_INTEGER {
+		agent.sets = append(agent.sets, berParseInt(value))
+	}
+	for name, reply := range agent.replies {
+		encoded, _ := berOid(name)
+		if bytes.Equal(encoded, oid) {
+			errorStatus, value := reply()
+			return snmpMessage(SNMP_GET_RESPONSE, berParseInt(requestId), errorStatus, oid, value)
+		}
+	}
+	return snmpMessage(SNMP_GET_RESPONSE, berParseInt(requestId), 0, oid, berTlv(SNMP_NO_SUCH_OBJECT, nil))
+}
+
+func TestSnmpExchange(t *testing.T) {
+	agent := newTestSnmpAgent(t)
+	config := SnmpConfig{Host: agent.conn.LocalAddr().String()}
+	driver, err := config.driver([]WorkstationConfig{{Id: 800, Outlet: 1}, {Id: 801, Outlet: 2}, {Id: 802, Outlet: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := snmpModels_["apc"].StatusOid
+	control := snmpModels_["apc"].ControlOid
+	tests := []struct {
+		name        string
+		cmd         string
+		oid         string
+		errorStatus int64
+		value       []byte
+		response    string
+		err         string
+	}{
+		{"on", "C0800", status + ".1", 0, berTlv(BER_INTEGER, berInt(1)), "1", ""},
+		{"off", "C0800", status + ".1", 0, berTlv(BER_INTEGER, berInt(2)), "0", ""},
+		{"unknown state", "C0800", status + ".1", 0, berTlv(BER_INTEGER, berInt(-3)), "", "unknown state -3 of outlet 1"},
+		{"not an integer", "C0800", status + ".1", 0, berTlv(BER_OCTET_STRING, []byte("on")), "", "not an integer : tag 0x04"},
+		{"no such instance", "C0801", status + ".2", 0, berTlv(SNMP_NO_SUCH_INSTANCE, nil), "9", ""},
+		{"no such object", "C0802", status + ".3", 0, berTlv(SNMP_NO_SUCH_OBJECT, nil), "9", ""},
+		{"no such name", "C0801", status + ".2", SNMP_NO_SUCH_NAME, berTlv(BER_NULL, nil), "9", ""},
+		{"general error", "C0801", status + ".2", 5, berTlv(BER_NULL, nil), "", "error status 5"},
+		{"turn on", "S0800", control + ".1", 0, berTlv(BER_INTEGER, berInt(1)), "1", ""},
+		{"shut down", "Q0800", control + ".1", 0, berTlv(BER_INTEGER, berInt(2)), "0", ""},
+		{"no creation", "S0802", control + ".3", SNMP_NO_CREATION, berTlv(BER_INTEGER, berInt(1)), "9", ""},
+		{"not writable", "E0802", control + ".3", 17, berTlv(BER_INTEGER, berInt(2)), "", "error status 17"},
+		{"unknown workstation", "C0803", "", 0, nil, "9", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.oid != "" {
+				agent.reply(tt.oid, tt.errorStatus, tt.value)
+			}
+
+			response, code, err := driver.Exchange(nil, tt.cmd, time.Now().Add(2*time.Second))
+			if tt.err != "" {
+				if code != ERROR_NETWORK || err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("code = %v, err = %v, want %q", code, err, tt.err)
+				}
+				return
+			}
+			if code != SUCCESS || err != nil {
+				t.Fatalf("code = %v, err = %v", code, err)
+			}
+			if response != tt.response {
+				t.Errorf("response = %v, want %v", response, tt.response)
+			}
+		})
+	}
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	// NOTE : apc turns an outlet on with 1 and off with 2
+	want := []int64{1, 2, 1, 2}
+	if !slices.Equal(agent.sets, want) {
+		t.Errorf("set values = %v, want %v", agent.sets, want)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+//---------------------------------------------------------
+// Serial-over-TCP transport (ser2net raw and RFC 2217)
+//---------------------------------------------------------
+
+// Telnet commands and the COM-PORT-OPTION of RFC 2217
+const (
+	TELNET_SE   = 240
+	TELNET_SB   = 250
+	TELNET_WILL = 251
+	TELNET_WONT = 252
+	TELNET_DO   = 253
+	TELNET_DONT = 254
+	TELNET_IAC  = 255
+
+	TELNET_BINARY   = 0
+	TELNET_SGA      = 3
+	TELNET_COM_PORT = 44
+
+	COM_PORT_SET_BAUDRATE = 1
+	COM_PORT_SET_DATASIZE = 2
+	COM_PORT_SET_PARITY   = 3
+	COM_PORT_SET_STOPSIZE = 4
+	COM_PORT_SET_CONTROL  = 5
+	COM_PORT_PURGE_DATA   = 12
+	// NOTE : The access server answers with the command + 100
+	COM_PORT_SERVER_OFFSET = 100
+)
+
+var tcpDialTimeOut_ = 5 * time.Second
+var tcpKeepAlive_ = 15 * time.Second
+
+// TcpTransport is a remote serial port behind a terminal server.
+// In raw mode the bytes go over TCP as they are and the line setting is
+// configured on the server. With RFC 2217 the line setting of serial.Mode
+// is negotiated with Telnet COM-PORT-OPTION.
+type TcpTransport struct {
+	address     string
+	rfc2217     bool
+	mode        *serial.Mode
+	readTimeOut time.Duration
+	conn        net.Conn
+	telnet      *TelnetDecoder
+}
+
+func NewTcpTransport(address string, rfc2217 bool, mode *serial.Mode, readTimeOut time.Duration) *TcpTransport {
+	return &TcpTransport{
+		address:     address,
+		rfc2217:     rfc2217,
+		mode:        mode,
+		readTimeOut: readTimeOut,
+	}
+}
+
+// tcpTransportFactory returns a transport for a tcp:// or rfc2217:// port
+func tcpTransportFactory(pwctl *PwCtrl) (Transport, int, error) {
+	selector := pwctl.portSelector
+	pwctl.portName = selector.String()
+
+	readTimeOut := time.Duration(pwctl.readTimeOut) * time.Second
+	return NewTcpTransport(selector.address, selector.network == "rfc2217", pwctl.serialMode, readTimeOut), SUCCESS, nil
+}
+
+func (t *TcpTransport) Open() error {
+	t.Close()
+
+	dialer := net.Dialer{Timeout: tcpDialTimeOut_, KeepAlive: tcpKeepAlive_}
+	conn, err := dialer.Dial("tcp", t.address)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.telnet = nil
+
+	if t.rfc2217 {
+		t.telnet = NewTelnetDecoder(conn)
+		err = t.negotiate()
+		if err != nil {
+			t.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// negotiate enables COM-PORT-OPTION and sets the line setting.
+// It fails if the server refuses the option or does not ack the settings.
+func (t *TcpTransport) negotiate() error {
+	_, err := t.conn.Write([]byte{
+		TELNET_IAC, TELNET_WILL, TELNET_COM_PORT,
+		TELNET_IAC, TELNET_WILL, TELNET_BINARY,
+		TELNET_IAC, TELNET_DO, TELNET_BINARY,
+		TELNET_IAC, TELNET_DO, TELNET_SGA,
+	})
+	if err != nil {
+		return err
+	}
+
+	baud := uint32(t.mode.BaudRate)
+	settings := [][]byte{
+		{COM_PORT_SET_BAUDRATE, byte(baud >> 24), byte(baud >> 16), byte(baud >> 8), byte(baud)},
+		{COM_PORT_SET_DATASIZE, byte(t.mode.DataBits)},
+		{COM_PORT_SET_PARITY, comPortParity(t.mode.Parity)},
+		{COM_PORT_SET_STOPSIZE, comPortStopBits(t.mode.StopBits)},
+		// NOTE : No flow control
+		{COM_PORT_SET_CONTROL, 1},
+	}
+	for _, setting := range settings {
+		err = t.subnegotiate(setting)
+		if err != nil {
+			return err
+		}
+	}
+
+	// NOTE : Wait until the server accepted the option and acked every setting
+	deadline := time.Now().Add(tcpDialTimeOut_)
+	buff := make([]byte, 64)
+	for !t.telnet.comPortRefused && !(t.telnet.comPortAccepted && t.telnet.acks >= len(settings)) {
+		if !time.Now().Before(deadline) {
+			return errors.New("RFC 2217 : no response to COM-PORT-OPTION from " + t.address)
+		}
+		t.conn.SetReadDeadline(deadline)
+		_, err = t.telnet.read(buff)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+	}
+	if t.telnet.comPortRefused {
+		return errors.New("RFC 2217 : COM-PORT-OPTION refused by " + t.address)
+	}
+	return nil
+}
+
+func (t *TcpTransport) subnegotiate(data []byte) error {
+	msg := []byte{TELNET_IAC, TELNET_SB, TELNET_COM_PORT}
+	msg = append(msg, escapeIac(data)...)
+	msg = append(msg, TELNET_IAC, TELNET_SE)
+	_, err := t.conn.Write(msg)
+	return err
+}
+
+// Read returns (0, nil) when the read timeout expires, like a serial port
+func (t *TcpTransport) Read(buff []byte) (int, error) {
+	if t.conn == nil {
+		return 0, errors.New("tcp port not opened")
+	}
+
+	t.conn.SetReadDeadline(time.Now().Add(t.readTimeOut))
+	for {
+		var n int
+		var err error
+		if t.telnet != nil {
+			n, err = t.telnet.read(buff)
+		} else {
+			n, err = t.conn.Read(buff)
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, nil
+		}
+		if err != nil || n > 0 {
+			return n, err
+		}
+		// NOTE : Only telnet commands were received, wait for data
+	}
+}
+
+func (t *TcpTransport) Write(data []byte) (int, error) {
+	if t.conn == nil {
+		return 0, errors.New("tcp port not opened")
+	}
+
+	if t.telnet != nil {
+		_, err := t.conn.Write(escapeIac(data))
+		if err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	return t.conn.Write(data)
+}
+
+// ResetInputBuffer drops the bytes already received, and with RFC 2217
+// asks the server to purge its receive buffer too
+func (t *TcpTransport) ResetInputBuffer() error {
+	if t.conn == nil {
+		return errors.New("tcp port not opened")
+	}
+
+	if t.telnet != nil {
+		err := t.subnegotiate([]byte{COM_PORT_PURGE_DATA, 1})
+		if err != nil {
+			return err
+		}
+	}
+
+	buff := make([]byte, 256)
+	for {
+		t.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		var n int
+		var err error
+		if t.telnet != nil {
+			n, err = t.telnet.read(buff)
+		} else {
+			n, err = t.conn.Read(buff)
+		}
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			logger.Infof("Dropped %v bytes of %v", n, t.Name())
+		}
+	}
+}
+
+func (t *TcpTransport) ResetOutputBuffer() error {
+	if t.conn == nil {
+		return errors.New("tcp port not opened")
+	}
+
+	if t.telnet != nil {
+		return t.subnegotiate([]byte{COM_PORT_PURGE_DATA, 2})
+	}
+	return nil
+}
+
+func (t *TcpTransport) SetReadTimeout(timeout time.Duration) error {
+	t.readTimeOut = timeout
+	return nil
+}
+
+func (t *TcpTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	t.telnet = nil
+	return err
+}
+
+func (t *TcpTransport) Name() string {
+	if t.rfc2217 {
+		return "rfc2217://" + t.address
+	}
+	return "tcp://" + t.address
+}
+
+func comPortParity(parity serial.Parity) byte {
+	switch parity {
+	case serial.OddParity:
+		return 2
+	case serial.EvenParity:
+		return 3
+	case serial.MarkParity:
+		return 4
+	case serial.SpaceParity:
+		return 5
+	}
+	return 1
+}
+
+func comPortStopBits(stopBits serial.StopBits) byte {
+	switch stopBits {
+	case serial.TwoStopBits:
+		return 2
+	case serial.OnePointFiveStopBits:
+		return 3
+	}
+	return 1
+}
+
+// escapeIac doubles the IAC bytes of the data
+func escapeIac(data []byte) []byte {
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		escaped = append(escaped, b)
+		if b == TELNET_IAC {
+			escaped = append(escaped, TELNET_IAC)
+		}
+	}
+	return escaped
+}
+
+//---------------------------------------------------------
+// Telnet decoder
+//---------------------------------------------------------
+
+const (
+	telnetData = iota
+	telnetIac
+	telnetOption
+	telnetSub
+	telnetSubIac
+)
+
+// TelnetDecoder removes the telnet commands from the received bytes,
+// answers the option negotiation and tracks the COM-PORT-OPTION state.
+// The state survives across reads, a command may be split over reads.
+type TelnetDecoder struct {
+	conn    net.Conn
+	state   int
+	command byte
+	sub     []byte
+
+	comPortAccepted bool
+	comPortRefused  bool
+	acks            int
+}
+
+func NewTelnetDecoder(conn net.Conn) *TelnetDecoder {
+	return &TelnetDecoder{conn: conn}
+}
+
+// read reads from the connection and returns the data bytes only
+func (d *TelnetDecoder) read(buff []byte) (int, error) {
+	raw := make([]byte, len(buff))
+	n, err := d.conn.Read(raw)
+
+	data := 0
+	for _, b := range raw[:n] {
+		switch d.state {
+		case telnetData:
+			if b == TELNET_IAC {
+				d.state = telnetIac
+			} else {
+				buff[data] = b
+				data++
+			}
+		case telnetIac:
+			switch b {
+			case TELNET_IAC:
+				buff[data] = b
+				data++
+				d.state = telnetData
+			case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+				d.command = b
+				d.state = telnetOption
+			case TELNET_SB:
+				d.sub = d.sub[:0]
+				d.state = telnetSub
+			default:
+				d.state = telnetData
+			}
+		case telnetOption:
+			d.negotiated(d.command, b)
+			d.state = telnetData
+		case telnetSub:
+			if b == TELNET_IAC {
+				d.state = telnetSubIac
+			} else {
+				d.sub = append(d.sub, b)
+			}
+		case telnetSubIac:
+			if b == TELNET_SE {
+				d.subnegotiated(d.sub)
+				d.state = telnetData
+			} else {
+				d.sub = append(d.sub, b)
+				d.state = telnetSub
+			}
+		}
+	}
+	return data, err
+}
+
+// negotiated answers an option command of the server.
+// Only COM-PORT-OPTION, BINARY and SGA are agreed.
+func (d *TelnetDecoder) negotiated(command byte, option byte) {
+	supported := option == TELNET_COM_PORT || option == TELNET_BINARY || option == TELNET_SGA
+
+	switch command {
+	case TELNET_DO:
+		if option == TELNET_COM_PORT {
+			d.comPortAccepted = true
+		}
+		if !supported {
+			d.conn.Write([]byte{TELNET_IAC, TELNET_WONT, option})
+		}
+	case TELNET_DONT, TELNET_WONT:
+		// NOTE : Some servers refuse the option with WONT instead of DONT
+		if option == TELNET_COM_PORT {
+			d.comPortRefused = true
+		}
+	case TELNET_WILL:
+		if !supported {
+			d.conn.Write([]byte{TELNET_IAC, TELNET_DONT, option})
+		}
+	}
+}
+
+// subnegotiated counts the acks of the line settings
+func (d *TelnetDecoder) subnegotiated(sub []byte) {
+	if len(sub) < 2 || sub[0] != TELNET_COM_PORT {
+		return
+	}
+
+	switch sub[1] - COM_PORT_SERVER_OFFSET {
+	case COM_PORT_SET_BAUDRATE, COM_PORT_SET_DATASIZE, COM_PORT_SET_PARITY, COM_PORT_SET_STOPSIZE, COM_PORT_SET_CONTROL:
+		d.acks++
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// telnetPipe returns a decoder on one end of a pipe and the server end.
+// replies returns what the decoder sent back once the decoder end is closed.
+func telnetPipe(t *testing.T) (*TelnetDecoder, net.Conn, func() []byte) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	var mutex sync.Mutex
+	var replies []byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buff := make([]byte, 64)
+		for {
+			n, err := server.Read(buff)
+			mutex.Lock()
+			replies = append(replies, buff[:n]...)
+			mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return NewTelnetDecoder(client), server, func() []byte {
+		client.Close()
+		<-done
+		mutex.Lock()
+		defer mutex.Unlock()
+		return replies
+	}
+}
+
+func TestTelnetDecoderRead(t *testing.T) {
+	ack := func(command byte, value ...byte) []byte {
+		sub := append([]byte{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, command + COM_PORT_SERVER_OFFSET}, value...)
+		return append(sub, TELNET_IAC, TELNET_SE)
+	}
+	var acks []byte
+	for _, command := range []byte{COM_PORT_SET_BAUDRATE, COM_PORT_SET_DATASIZE, COM_PORT_SET_PARITY, COM_PORT_SET_STOPSIZE, COM_PORT_SET_CONTROL} {
+		acks = append(acks, ack(command, 1)...)
+	}
+
+	tests := []struct {
+		name     string
+		reads    [][]byte
+		data     string
+		accepted bool
+		refused  bool
+		acks     int
+		replies  []byte
+	}{
+		{"plain data", [][]byte{[]byte("1\r\n")}, "1\r\n", false, false, 0, nil},
+		{"escaped IAC", [][]byte{{'1', TELNET_IAC, TELNET_IAC, '2'}}, "1\xff2", false, false, 0, nil},
+		{"IAC split across reads", [][]byte{{'1', TELNET_IAC}, {TELNET_IAC, '2'}}, "1\xff2", false, false, 0, nil},
+		{"option split across reads", [][]byte{{'1', TELNET_IAC}, {TELNET_DO}, {TELNET_COM_PORT, '2'}}, "12", true, false, 0, nil},
+		{"other command", [][]byte{{TELNET_IAC, 241, '1'}}, "1", false, false, 0, nil},
+		{"refused with DONT", [][]byte{{TELNET_IAC, TELNET_DONT, TELNET_COM_PORT}}, "", false, true, 0, nil},
+		{"refused with WONT", [][]byte{{TELNET_IAC, TELNET_WONT, TELNET_COM_PORT}}, "", false, true, 0, nil},
+		{"unsupported WILL", [][]byte{{TELNET_IAC, TELNET_WILL, 1}}, "", false, false, 0, []byte{TELNET_IAC, TELNET_DONT, 1}},
+		{"unsupported DO", [][]byte{{TELNET_IAC, TELNET_DO, 24}}, "", false, false, 0, []byte{TELNET_IAC, TELNET_WONT, 24}},
+		{"supported options", [][]byte{{TELNET_IAC, TELNET_WILL, TELNET_BINARY, TELNET_IAC, TELNET_DO, TELNET_SGA}}, "", false, false, 0, nil},
+		{"baud rate ack", [][]byte{ack(COM_PORT_SET_BAUDRATE, 0, 0, 0x25, 0x80)}, "", false, false, 1, nil},
+		{"ack of every setting", [][]byte{append(acks, '1')}, "1", false, false, 5, nil},
+		{"purge ack not counted", [][]byte{ack(COM_PORT_PURGE_DATA, 1)}, "", false, false, 0, nil},
+		{"client ack not counted", [][]byte{{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, COM_PORT_SET_BAUDRATE, 0, 0, 0x25, 0x80, TELNET_IAC, TELNET_SE}}, "", false, false, 0, nil},
+		{"subnegotiation split across reads", [][]byte{
+			{'1', TELNET_IAC, TELNET_SB, TELNET_COM_PORT, COM_PORT_SET_BAUDRATE + COM_PORT_SERVER_OFFSET, 0},
+			{0, 0x25},
+			{0x80, TELNET_IAC},
+			{TELNET_SE, '2'},
+		}, "12", false, false, 1, nil},
+		{"escaped IAC in a subnegotiation", [][]byte{
+			{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, COM_PORT_SET_BAUDRATE + COM_PORT_SERVER_OFFSET, 0, 0, TELNET_IAC},
+			{TELNET_IAC, TELNET_IAC, TELNET_IAC, TELNET_IAC, TELNET_SE, '1'},
+		}, "1", false, false, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder, server, replies := telnetPipe(t)
+
+			var data []byte
+			buff := make([]byte, 64)
+			for _, chunk := range tt.reads {
+				written := make(chan error, 1)
+				go func() {
+					_, err := server.Write(chunk)
+					written <- err
+				}()
+
+				// NOTE : A pipe hands over one write per read
+				n, err := decoder.read(buff)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = append(data, buff[:n]...)
+				if err := <-written; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(data) != tt.data {
+				t.Errorf("data = %q, want %q", data, tt.data)
+			}
+			if decoder.comPortAccepted != tt.accepted || decoder.comPortRefused != tt.refused || decoder.acks != tt.acks {
+				t.Errorf("accepted = %v, refused = %v, acks = %v, want %v, %v, %v",
+					decoder.comPortAccepted, decoder.comPortRefused, decoder.acks, tt.accepted, tt.refused, tt.acks)
+			}
+			if got := replies(); !bytes.Equal(got, tt.replies) {
+				t.Errorf("replies = % x, want % x", got, tt.replies)
+			}
+		})
+	}
+}
+
+// negotiation is what the client sends to open the port in the mode
+func negotiation(mode *serial.Mode) []byte {
+	msg := []byte{
+		TELNET_IAC, TELNET_WILL, TELNET_COM_PORT,
+		TELNET_IAC, TELNET_WILL, TELNET_BINARY,
+		TELNET_IAC, TELNET_DO, TELNET_BINARY,
+		TELNET_IAC, TELNET_DO, TELNET_SGA,
+	}
+	baud := uint32(mode.BaudRate)
+	settings := [][]byte{
+		{COM_PORT_SET_BAUDRATE, byte(baud >> 24), byte(baud >> 16), byte(baud >> 8), byte(baud)},
+		{COM_PORT_SET_DATASIZE, byte(mode.DataBits)},
+		{COM_PORT_SET_PARITY, comPortParity(mode.Parity)},
+		{COM_PORT_SET_STOPSIZE, comPortStopBits(mode.StopBits)},
+		{COM_PORT_SET_CONTROL, 1},
+	}
+	for _, setting := range settings {
+		msg = append(msg, TELNET_IAC, TELNET_SB, TELNET_COM_PORT)
+		msg = append(msg, escapeIac(setting)...)
+		msg = append(msg, TELNET_IAC, TELNET_SE)
+	}
+	return msg
+}
+
+// comPortServer reads the negotiation of the client, then sends the
+// replies and keeps reading until the client closes the connection.
+// It returns what the client sent.
+func comPortServer(server net.Conn, expected int, replies ...[]byte) <-chan []byte {
+	received := make(chan []byte, 1)
+	go func() {
+		request := make([]byte, expected)
+		n, _ := io.ReadFull(server, request)
+		received <- request[:n]
+
+		for _, reply := range replies {
+			if _, err := server.Write(reply); err != nil {
+				return
+			}
+		}
+		io.Copy(io.Discard, server)
+	}()
+	return received
+}
+
+func TestTcpTransportNegotiate(t *testing.T) {
+	timeOut := tcpDialTimeOut_
+	tcpDialTimeOut_ = 200 * time.Millisecond
+	t.Cleanup(func() {
+		tcpDialTimeOut_ = timeOut
+	})
+
+	comPortAck := func(command byte, value ...byte) []byte {
+		sub := append([]byte{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, command + COM_PORT_SERVER_OFFSET}, escapeIac(value)...)
+		return append(sub, TELNET_IAC, TELNET_SE)
+	}
+	accept := []byte{TELNET_IAC, TELNET_DO, TELNET_COM_PORT}
+	acks := [][]byte{
+		comPortAck(COM_PORT_SET_BAUDRATE, 0, 0, 0x25, 0x80),
+		comPortAck(COM_PORT_SET_DATASIZE, 8),
+		comPortAck(COM_PORT_SET_PARITY, 1),
+		comPortAck(COM_PORT_SET_STOPSIZE, 1),
+		comPortAck(COM_PORT_SET_CONTROL, 1),
+	}
+
+	mode8N1 := &serial.Mode{BaudRate: 9600, DataBits: 8, Parity: serial.NoParity, StopBits: serial.OneStopBit}
+	tests := []struct {
+		name    string
+		mode    *serial.Mode
+		request string
+		replies [][]byte
+		err     string
+	}{
+		{"accepted", mode8N1, "", append([][]byte{accept}, acks...), ""},
+		{"acks before the option", mode8N1, "", append(acks, accept), ""},
+		{"acks split", mode8N1, "", [][]byte{accept, bytes.Join(acks, nil)[:7], bytes.Join(acks, nil)[7:]}, ""},
+		{"refused with DONT", mode8N1, "", [][]byte{{TELNET_IAC, TELNET_DONT, TELNET_COM_PORT}}, "COM-PORT-OPTION refused"},
+		{"refused with WONT", mode8N1, "", [][]byte{{TELNET_IAC, TELNET_WONT, TELNET_COM_PORT}}, "COM-PORT-OPTION refused"},
+		{"no acks", mode8N1, "", [][]byte{accept}, "no response to COM-PORT-OPTION"},
+		{"missing ack", mode8N1, "", append([][]byte{accept}, acks[:4]...), "no response to COM-PORT-OPTION"},
+		{"no reply", mode8N1, "", nil, "no response to COM-PORT-OPTION"},
+		{"7E2", &serial.Mode{BaudRate: 115200, DataBits: 7, Parity: serial.EvenParity, StopBits: serial.TwoStopBits},
+			"\xff\xfa\x2c\x01\x00\x01\xc2\x00\xff\xf0\xff\xfa\x2c\x02\x07\xff\xf0\xff\xfa\x2c\x03\x03\xff\xf0\xff\xfa\x2c\x04\x02\xff\xf0",
+			append([][]byte{accept}, acks...), ""},
+		{"baud rate with an IAC byte", &serial.Mode{BaudRate: 0x1ff, DataBits: 8},
+			"\xff\xfa\x2c\x01\x00\x00\x01\xff\xff\xff\xf0",
+			append([][]byte{accept}, acks...), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			expected := negotiation(tt.mode)
+			received := comPortServer(server, len(expected), tt.replies...)
+
+			transport := NewTcpTransport("pipe", true, tt.mode, time.Second)
+			transport.conn = client
+			transport.telnet = NewTelnetDecoder(client)
+			err := transport.negotiate()
+
+			if request := <-received; !bytes.Equal(request, expected) {
+				t.Errorf("request = % x, want % x", request, expected)
+			} else if !strings.Contains(string(request), tt.request) {
+				t.Errorf("request = % x, want the settings % x", request, tt.request)
+			}
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTcpTransportRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	transport := NewTcpTransport("pipe", true, &serial.Mode{}, 100*time.Millisecond)
+	transport.conn = client
+	transport.telnet = NewTelnetDecoder(client)
+
+	go func() {
+		// NOTE : A read of telnet commands only does not end the read
+		server.Write([]byte{TELNET_IAC, TELNET_WILL, TELNET_BINARY})
+		server.Write([]byte{'1', TELNET_IAC, TELNET_IAC, '\r', '\n'})
+	}()
+
+	buff := make([]byte, 64)
+	n, err := transport.Read(buff)
+	if err != nil || string(buff[:n]) != "1\xff\r\n" {
+		t.Fatalf("read %q, err = %v", buff[:n], err)
+	}
+
+	// Like a serial port, nothing before the read timeout is not an error
+	n, err = transport.Read(buff)
+	if n != 0 || err != nil {
+		t.Fatalf("read %q, err = %v, want nothing", buff[:n], err)
+	}
+
+	// The data written is escaped
+	written := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 4)
+		io.ReadFull(server, data)
+		written <- data
+	}()
+	if n, err := transport.Write([]byte{'S', TELNET_IAC, '1'}); n != 3 || err != nil {
+		t.Fatalf("wrote %v, err = %v", n, err)
+	}
+	if data := <-written; !bytes.Equal(data, []byte{'S', TELNET_IAC, TELNET_IAC, '1'}) {
+		t.Errorf("written % x", data)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"grida/pwctrlbe/portlock"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Transport is the byte carrier between PwCtrl and the MCU.
+// A read with no data available blocks until the read timeout
+// and then returns (0, nil), the same as go.bug.st/serial.
+type Transport interface {
+	Open() error
+	Read(buff []byte) (int, error)
+	Write(data []byte) (int, error)
+	ResetInputBuffer() error
+	ResetOutputBuffer() error
+	SetReadTimeout(timeout time.Duration) error
+	Close() error
+	Name() string
+}
+
+// TransportFactory creates the transport to be opened by intializeConnection.
+// The returned code is one of the error codes when err is not nil.
+type TransportFactory func(pwctl *PwCtrl) (Transport, int, error)
+
+//---------------------------------------------------------
+// Serial transport (go.bug.st/serial)
+//---------------------------------------------------------
+
+type SerialTransport struct {
+	portName    string
+	mode        *serial.Mode
+	readTimeOut time.Duration
+	port        serial.Port
+	lock        *portlock.Lock
+}
+
+func NewSerialTransport(portName string, mode *serial.Mode, readTimeOut time.Duration) *SerialTransport {
+	return &SerialTransport{
+		portName:    portName,
+		mode:        mode,
+		readTimeOut: readTimeOut,
+	}
+}
+
+// portTransportFactory connects to a remote port for tcp:// and rfc2217://
+// ports, and opens a local serial port otherwise
+func portTransportFactory(pwctl *PwCtrl) (Transport, int, error) {
+	if pwctl.portSelector.isRemote() {
+		return tcpTransportFactory(pwctl)
+	}
+	return serialTransportFactory(pwctl)
+}
+
+// serialTransportFactory finds the serial port with the prefixes and
+// returns a transport for it
+func serialTransportFactory(pwctl *PwCtrl) (Transport, int, error) {
+	err := pwctl.findSerialPort()
+	if err != nil {
+		return nil, ERROR_NO_PORT_FOUND, err
+	}
+
+	readTimeOut := time.Duration(pwctl.readTimeOut) * time.Second
+	return NewSerialTransport(pwctl.portName, pwctl.serialMode, readTimeOut), SUCCESS, nil
+}
+
+// Open locks the device and opens it. The lock is held until Close,
+// so another backend or the test CLI cannot interleave commands.
+func (t *SerialTransport) Open() error {
+	t.Close()
+
+	lock, err := portlock.Acquire(t.portName)
+	if err != nil {
+		return err
+	}
+
+	port, err := serial.Open(t.portName, t.mode)
+	if err != nil {
+		lock.Unlock()
+		return err
+	}
+
+	err = port.SetReadTimeout(t.readTimeOut)
+	if err != nil {
+		port.Close()
+		lock.Unlock()
+		return err
+	}
+
+	t.port = port
+	t.lock = lock
+	return nil
+}
+
+func (t *SerialTransport) Read(buff []byte) (int, error) {
+	if t.port == nil {
+		return 0, errors.New("serial port not opened")
+	}
+	return t.port.Read(buff)
+}
+
+func (t *SerialTransport) Write(data []byte) (int, error) {
+	if t.port == nil {
+		return 0, errors.New("serial port not opened")
+	}
+	return t.port.Write(data)
+}
+
+func (t *SerialTransport) ResetInputBuffer() error {
+	if t.port == nil {
+		return errors.New("serial port not opened")
+	}
+	return t.port.ResetInputBuffer()
+}
+
+func (t *SerialTransport) ResetOutputBuffer() error {
+	if t.port == nil {
+		return errors.New("serial port not opened")
+	}
+	return t.port.ResetOutputBuffer()
+}
+
+func (t *SerialTransport) SetReadTimeout(timeout time.Duration) error {
+	if t.port == nil {
+		return errors.New("serial port not opened")
+	}
+	t.readTimeOut = timeout
+	return t.port.SetReadTimeout(timeout)
+}
+
+func (t *SerialTransport) Close() error {
+	if t.port == nil {
+		return nil
+	}
+	err := t.port.Close()
+	t.port = nil
+
+	t.lock.Unlock()
+	t.lock = nil
+	return err
+}
+
+func (t *SerialTransport) Name() string {
+	return t.portName
+}
+
+//---------------------------------------------------------
+// In-memory transport
+//---------------------------------------------------------
+
+// MemoryResponder returns the bytes the MCU would send back for
+// the data written to the transport. nil means no response.
+type MemoryResponder func(data []byte) []byte
+
+// MemoryTransport is a Transport without hardware. Every write is handed
+// to the responder and its answer is queued for the next reads.
+type MemoryTransport struct {
+	name        string
+	responder   MemoryResponder
+	readTimeOut time.Duration
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	opened  bool
+	inBuff  []byte
+	written []byte
+}
+
+func NewMemoryTransport(name string, responder MemoryResponder, readTimeOut time.Duration) *MemoryTransport {
+	t := &MemoryTransport{
+		name:        name,
+		responder:   responder,
+		readTimeOut: readTimeOut,
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+// memoryTransportFactory always hands out the same in-memory transport
+func memoryTransportFactory(t *MemoryTransport) TransportFactory {
+	return func(pwctl *PwCtrl) (Transport, int, error) {
+		pwctl.portName = t.Name()
+		return t, SUCCESS, nil
+	}
+}
+
+func (t *MemoryTransport) Open() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.opened = true
+	t.inBuff = nil
+	return nil
+}
+
+func (t *MemoryTransport) Read(buff []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.opened {
+		return 0, errors.New("memory transport not opened")
+	}
+
+	// NOTE : Wake up the waiting reader when the timeout expires
+	deadline := time.Now().Add(t.readTimeOut)
+	timer := time.AfterFunc(t.readTimeOut, func() {
+		t.mutex.Lock()
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for len(t.inBuff) == 0 && t.opened && time.Now().Before(deadline) {
+		t.cond.Wait()
+	}
+
+	if !t.opened {
+		return 0, errors.New("memory transport closed")
+	}
+
+	n := copy(buff, t.inBuff)
+	t.inBuff = t.inBuff[n:]
+	return n, nil
+}
+
+func (t *MemoryTransport) Write(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.opened {
+		return 0, errors.New("memory transport not opened")
+	}
+
+	t.written = append(t.written, data...)
+	if t.responder != nil {
+		t.inBuff = append(t.inBuff, t.responder(data)...)
+		t.cond.Broadcast()
+	}
+	return len(data), nil
+}
+
+// Inject queues bytes as if they were sent by the MCU without a command
+func (t *MemoryTransport) Inject(data []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.inBuff = append(t.inBuff, data...)
+	t.cond.Broadcast()
+}
+
+// Written returns all bytes written to the transport so far
+func (t *MemoryTransport) Written() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return append([]byte(nil), t.written...)
+}
+
+func (t *MemoryTransport) ResetInputBuffer() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.opened {
+		return errors.New("memory transport not opened")
+	}
+	t.inBuff = nil
+	return nil
+}
+
+func (t *MemoryTransport) ResetOutputBuffer() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.opened {
+		return errors.New("memory transport not opened")
+	}
+	return nil
+}
+
+func (t *MemoryTransport) SetReadTimeout(timeout time.Duration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.readTimeOut = timeout
+	return nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.opened = false
+	t.inBuff = nil
+	t.cond.Broadcast()
+	return nil
+}
+
+func (t *MemoryTransport) Name() string {
+	return t.name
+}
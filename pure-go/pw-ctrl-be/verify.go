@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var verifyPollInterval_ = 1 * time.Second
+var verifyTimeOut_ = 60 * time.Second
+
+// targetPowerState returns the state a power command should end up in
+func targetPowerState(cmdStr string) (PowerState, bool) {
+	if len(cmdStr) == 0 {
+		return POWER_UNKNOWN, false
+	}
+
+	switch cmdStr[0] {
+	case 'S':
+		return POWER_ON, true
+	case 'Q', 'E':
+		return POWER_OFF, true
+	}
+	return POWER_UNKNOWN, false
+}
+
+// verifyTimeOut reads the verification timeout in seconds from the query
+func verifyTimeOut(param string) time.Duration {
+	seconds, err := strconv.Atoi(param)
+	if err != nil || seconds <= 0 {
+		return verifyTimeOut_
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// verifyPowerState polls the state of the workstation with C<id> until
+// it reaches the target or the context expires, and returns the last
+// state with its MCU response.
+func verifyPowerState(ctx context.Context, queue *CommandQueue, powerCmd string, target PowerState) (PowerState, string, int, error) {
+	statusCmd := "C" + powerCmd[1:]
+	powerState := POWER_UNKNOWN
+	lastMesg := ""
+
+	for {
+		//---------------------------------------------------------
+		// NOTE : CODE=8 and wrong states are expected for a while
+		// right after a power on/off command, so they are polled again
+		//---------------------------------------------------------
+		code, mesg, err := queue.submit(ctx, statusCmd)
+		if err == nil {
+			powerState = decodePowerState(mesg)
+			lastMesg = mesg
+			if powerState == target {
+				return powerState, lastMesg, SUCCESS, nil
+			}
+		} else if code == ERROR_UNKNOWN_CMD {
+			return POWER_UNKNOWN, mesg, code, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return powerState, lastMesg, ERROR_VERIFY_TIMEOUT,
+				errors.New("power state not reached : expected " + string(target) + ", last " + string(powerState))
+		case <-time.After(verifyPollInterval_):
+		}
+	}
+}
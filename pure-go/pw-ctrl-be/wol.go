@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+//---------------------------------------------------------
+// Wake-on-LAN driver (workstations without relay wiring)
+//---------------------------------------------------------
+
+const WOL_PORT = "9"
+
+// NOTE : A refused connection is an answer too, ssh is tried by default
+const REACHABILITY_PORT = "22"
+
+// WolTarget is a workstation woken by a magic packet
+type WolTarget struct {
+	mac       net.HardwareAddr
+	broadcast string
+	host      string
+}
+
+// WolDriver powers on the workstations of its inventory with Wake-on-LAN.
+//   - S : sends the magic packet, answered with 3 (being turned on)
+//   - C : 1 if the host is reachable, 0 otherwise
+//   - Q, E : answered with 9, there is no way to power off
+//
+// A workstation not in the inventory is answered with 9.
+type WolDriver struct {
+	targets map[int]WolTarget
+}
+
+// wolDriver validates the inventory and returns the driver
+func wolDriver(workstations []WorkstationConfig) (Driver, error) {
+	if len(workstations) == 0 {
+		return nil, errors.New("wol : no workstations")
+	}
+
+	d := WolDriver{targets: make(map[int]WolTarget)}
+	for _, ws := range workstations {
+		id := strconv.Itoa(ws.Id)
+		if _, found := d.targets[ws.Id]; found {
+			return nil, errors.New("wol : duplicate workstation : " + id)
+		}
+
+		mac, err := net.ParseMAC(ws.Mac)
+		if err != nil {
+			return nil, errors.New("wol : workstation " + id + " : " + err.Error())
+		}
+		if ws.Host == "" {
+			return nil, errors.New("wol : workstation " + id + " : no host to check")
+		}
+
+		broadcast := ws.Broadcast
+		if broadcast == "" {
+			broadcast = "255.255.255.255"
+		}
+		d.targets[ws.Id] = WolTarget{
+			mac:       mac,
+			broadcast: withDefaultPort(broadcast, WOL_PORT),
+			host:      withDefaultPort(ws.Host, REACHABILITY_PORT),
+		}
+	}
+	return d, nil
+}
+
+func (d WolDriver) Exchange(pwctl *PwCtrl, cmdStr string, deadline time.Time) (string, int, error) {
+	letter, id, err := parseCommand(cmdStr)
+	if err != nil {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	target, found := d.targets[id]
+	if !found {
+		return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+	}
+
+	switch letter {
+	case 'S':
+		err = sendMagicPacket(target.mac, target.broadcast)
+		if err != nil {
+			return "", ERROR_NETWORK, err
+		}
+		return string(CODE_TURNING_ON), SUCCESS, nil
+	case 'C':
+		if reachable(target.host, time.Until(deadline)) {
+			return string(CODE_ON), SUCCESS, nil
+		}
+		return string(CODE_OFF), SUCCESS, nil
+	}
+	return string(CODE_UNKNOWN_COMMAND), SUCCESS, nil
+}
+
+func (d WolDriver) Name() string {
+	return DRIVER_WOL
+}
+
+func (d WolDriver) UsesPort() bool {
+	return false
+}
+
+// sendMagicPacket sends 6 bytes of 0xff and 16 times the MAC address
+func sendMagicPacket(mac net.HardwareAddr, broadcast string) error {
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+
+	conn, err := net.Dial("udp", broadcast)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packet)
+	return err
+}
+
+// reachable is true if the host answers a TCP connection, accepted or refused
+func reachable(address string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return true
+}
+
+// withDefaultPort adds the port to an address without one
+func withDefaultPort(address string, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(address, port)
+}
@@ -0,0 +1,5 @@
+module grida/pwctrlsim
+
+go 1.22.2
+
+require golang.org/x/sys v0.21.0
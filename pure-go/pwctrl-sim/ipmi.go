@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// RMCP+ session and IPMI message constants
+const (
+	RMCP_VERSION        = 0x06
+	RMCP_NO_ACK         = 0xff
+	RMCP_CLASS_IPMI     = 0x07
+	IPMI_AUTH_RMCP_PLUS = 0x06
+
+	IPMI_PAYLOAD_IPMI                  = 0x00
+	IPMI_PAYLOAD_OPEN_SESSION_REQUEST  = 0x10
+	IPMI_PAYLOAD_OPEN_SESSION_RESPONSE = 0x11
+	IPMI_PAYLOAD_RAKP1                 = 0x12
+	IPMI_PAYLOAD_RAKP2                 = 0x13
+	IPMI_PAYLOAD_RAKP3                 = 0x14
+	IPMI_PAYLOAD_RAKP4                 = 0x15
+	IPMI_PAYLOAD_SESSION               = 0xc0
+
+	IPMI_NETFN_CHASSIS   = 0x00
+	IPMI_NETFN_APP       = 0x06
+	IPMI_CHASSIS_STATUS  = 0x01
+	IPMI_CHASSIS_CONTROL = 0x02
+	IPMI_CLOSE_SESSION   = 0x3c
+
+	// RMCP+ status codes
+	RMCP_STATUS_INVALID_SESSION_ID    = 0x02
+	RMCP_STATUS_NO_CIPHER_SUITE       = 0x11
+	RMCP_STATUS_UNAUTHORIZED_NAME     = 0x0d
+	RMCP_STATUS_INVALID_INTEGRITY     = 0x0f
+	IPMI_COMPLETION_INVALID_COMMAND   = 0xc1
+	IPMI_COMPLETION_INVALID_DATA      = 0xcc
+	IPMI_COMPLETION_INSUFFICIENT_ROLE = 0xd4
+)
+
+// Cipher suite 3 : RAKP-HMAC-SHA1, HMAC-SHA1-96, AES-CBC-128
+var ipmiCipherSuite = []byte{
+	0x00, 0, 0, 0x08, 0x01, 0, 0, 0,
+	0x01, 0, 0, 0x08, 0x01, 0, 0, 0,
+	0x02, 0, 0, 0x08, 0x01, 0, 0, 0,
+}
+
+var ipmiGuid = []byte("pwctrl-sim-bmc-0")
+
+// BmcSession is an RMCP+ session of a console with the BMC
+type BmcSession struct {
+	consoleId uint32
+	bmcId     uint32
+	rm        []byte
+	rc        []byte
+	role      byte
+	user      []byte
+	sik       []byte
+	k1        []byte
+	k2        []byte
+	active    bool
+	sequence  uint32
+}
+
+// Bmc emulates the BMC of one workstation over IPMI v2.0 (RMCP+)
+type Bmc struct {
+	sim      *McuSim
+	id       int
+	conn     net.PacketConn
+	user     string
+	password string
+	sessions map[uint32]*BmcSession
+}
+
+// listenIpmi starts a BMC per workstation : workstation first+i on port+i
+func (sim *McuSim) listenIpmi(address string, user string, password string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	basePort, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, len(sim.workstations))
+	for i := range sim.workstations {
+		conn, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(basePort+i)))
+		if err != nil {
+			return err
+		}
+
+		bmc := &Bmc{
+			sim:      sim,
+			id:       sim.firstId + i,
+			conn:     conn,
+			user:     user,
+			password: password,
+			sessions: make(map[uint32]*BmcSession),
+		}
+		go func() {
+			done <- bmc.serve()
+		}()
+	}
+	return <-done
+}
+
+func (bmc *Bmc) serve() error {
+	buff := make([]byte, 1024)
+	for {
+		n, addr, err := bmc.conn.ReadFrom(buff)
+		if err != nil {
+			return err
+		}
+
+		response := bmc.handle(buff[:n])
+		if response != nil {
+			bmc.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (bmc *Bmc) handle(packet []byte) []byte {
+	if len(packet) < 16 || packet[0] != RMCP_VERSION || packet[3] != RMCP_CLASS_IPMI || packet[4] != IPMI_AUTH_RMCP_PLUS {
+		return nil
+	}
+	length := int(binary.LittleEndian.Uint16(packet[14:16]))
+	if len(packet) < 16+length {
+		return nil
+	}
+	payload := packet[16 : 16+length]
+
+	switch packet[5] {
+	case IPMI_PAYLOAD_OPEN_SESSION_REQUEST:
+		return bmc.openSession(payload)
+	case IPMI_PAYLOAD_RAKP1:
+		return bmc.rakp1(payload)
+	case IPMI_PAYLOAD_RAKP3:
+		return bmc.rakp3(payload)
+	case IPMI_PAYLOAD_SESSION:
+		return bmc.message(packet, payload)
+	}
+	return nil
+}
+
+func (bmc *Bmc) openSession(payload []byte) []byte {
+	if len(payload) < 32 {
+		return nil
+	}
+	consoleId := binary.LittleEndian.Uint32(payload[4:8])
+
+	if !bytes.Equal(payload[8:32], ipmiCipherSuite) {
+		return bmc.setupResponse(IPMI_PAYLOAD_OPEN_SESSION_RESPONSE, []byte{payload[0], RMCP_STATUS_NO_CIPHER_SUITE, 0, 0})
+	}
+
+	session := &BmcSession{
+		consoleId: consoleId,
+		bmcId:     binary.LittleEndian.Uint32(ipmiRandom(4)) | 1,
+	}
+	bmc.sessions[session.bmcId] = session
+
+	response := []byte{payload[0], 0, 0x04, 0}
+	response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+	response = binary.LittleEndian.AppendUint32(response, session.bmcId)
+	response = append(response, ipmiCipherSuite...)
+	return bmc.setupResponse(IPMI_PAYLOAD_OPEN_SESSION_RESPONSE, response)
+}
+
+func (bmc *Bmc) rakp1(payload []byte) []byte {
+	if len(payload) < 28 || len(payload) < 28+int(payload[27]) {
+		return nil
+	}
+
+	session := bmc.sessions[binary.LittleEndian.Uint32(payload[4:8])]
+	if session == nil {
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP2, []byte{payload[0], RMCP_STATUS_INVALID_SESSION_ID, 0, 0})
+	}
+
+	session.rm = append([]byte(nil), payload[8:24]...)
+	session.role = payload[24]
+	session.user = append([]byte(nil), payload[28:28+int(payload[27])]...)
+	if string(session.user) != bmc.user {
+		delete(bmc.sessions, session.bmcId)
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP2, []byte{payload[0], RMCP_STATUS_UNAUTHORIZED_NAME, 0, 0})
+	}
+
+	kuid := []byte(bmc.password)
+	session.rc = ipmiRandom(16)
+	roleUser := append([]byte{session.role, byte(len(session.user))}, session.user...)
+	session.sik = ipmiHmac(kuid, session.rm, session.rc, roleUser)
+	session.k1 = ipmiHmac(session.sik, bytes.Repeat([]byte{0x01}, 20))
+	session.k2 = ipmiHmac(session.sik, bytes.Repeat([]byte{0x02}, 20))
+
+	response := []byte{payload[0], 0, 0, 0}
+	response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+	response = append(response, session.rc...)
+	response = append(response, ipmiGuid...)
+	response = append(response, ipmiHmac(kuid, le32(session.consoleId), le32(session.bmcId), session.rm, session.rc, ipmiGuid, roleUser)...)
+	return bmc.setupResponse(IPMI_PAYLOAD_RAKP2, response)
+}
+
+func (bmc *Bmc) rakp3(payload []byte) []byte {
+	if len(payload) < 28 {
+		return nil
+	}
+
+	session := bmc.sessions[binary.LittleEndian.Uint32(payload[4:8])]
+	if session == nil || session.rc == nil {
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP4, []byte{payload[0], RMCP_STATUS_INVALID_SESSION_ID, 0, 0})
+	}
+
+	roleUser := append([]byte{session.role, byte(len(session.user))}, session.user...)
+	expected := ipmiHmac([]byte(bmc.password), session.rc, le32(session.consoleId), roleUser)
+	if !hmac.Equal(expected, payload[8:28]) {
+		fmt.Println("- IPMI ", bmc.id, " : wrong password")
+		delete(bmc.sessions, session.bmcId)
+		return bmc.setupResponse(IPMI_PAYLOAD_RAKP4, []byte{payload[0], RMCP_STATUS_INVALID_INTEGRITY, 0, 0})
+	}
+	session.active = true
+
+	response := []byte{payload[0], 0, 0, 0}
+	response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+	response = append(response, ipmiHmac(session.sik, session.rm, le32(session.bmcId), ipmiGuid)[:12]...)
+	return bmc.setupResponse(IPMI_PAYLOAD_RAKP4, response)
+}
+
+// message handles an IPMI request in an active session
+func (bmc *Bmc) message(packet []byte, payload []byte) []byte {
+	session := bmc.sessions[binary.LittleEndian.Uint32(packet[6:10])]
+	if session == nil || !session.active || !ipmiVerify(session.k1, packet[4:]) {
+		return nil
+	}
+
+	request, err := ipmiDecrypt(session.k2[:16], payload)
+	if err != nil || len(request) < 7 {
+		return nil
+	}
+
+	netFn := request[1] >> 2
+	command := request[5]
+	data := request[6 : len(request)-1]
+
+	completion, responseData := bmc.execute(session, netFn, command, data)
+	fmt.Printf("- IPMI %v : netfn %#02x cmd %#02x % x -> %#02x % x\n", bmc.id, netFn, command, data, completion, responseData)
+
+	message := []byte{request[3], (netFn | 1) << 2}
+	message = append(message, ipmiChecksum(message))
+	body := append([]byte{request[0], request[4], command, completion}, responseData...)
+	message = append(message, body...)
+	message = append(message, ipmiChecksum(body))
+
+	encrypted, err := ipmiEncrypt(session.k2[:16], message)
+	if err != nil {
+		return nil
+	}
+
+	session.sequence++
+	response := []byte{IPMI_AUTH_RMCP_PLUS, IPMI_PAYLOAD_SESSION}
+	response = binary.LittleEndian.AppendUint32(response, session.consoleId)
+	response = binary.LittleEndian.AppendUint32(response, session.sequence)
+	response = binary.LittleEndian.AppendUint16(response, uint16(len(encrypted)))
+	response = append(response, encrypted...)
+	response = ipmiSign(session.k1, response)
+	return append(rmcpHeader(), response...)
+}
+
+func (bmc *Bmc) execute(session *BmcSession, netFn byte, command byte, data []byte) (byte, []byte) {
+	switch {
+	case netFn == IPMI_NETFN_CHASSIS && command == IPMI_CHASSIS_STATUS:
+		// NOTE : The chassis is powered while it is on or shutting down
+		state := bmc.sim.execute(fmt.Sprintf("C%04d", bmc.id))
+		power := byte(0)
+		if state == CODE_ON || state == CODE_TURNING_OFF {
+			power = 0x01
+		}
+		return 0, []byte{power, 0, 0}
+
+	case netFn == IPMI_NETFN_CHASSIS && command == IPMI_CHASSIS_CONTROL:
+		if session.role&0x0f < 0x03 {
+			return IPMI_COMPLETION_INSUFFICIENT_ROLE, nil
+		}
+		if len(data) < 1 {
+			return IPMI_COMPLETION_INVALID_DATA, nil
+		}
+		switch data[0] {
+		case 0x00:
+			bmc.sim.execute(fmt.Sprintf("E%04d", bmc.id))
+		case 0x01:
+			bmc.sim.execute(fmt.Sprintf("S%04d", bmc.id))
+		case 0x05:
+			bmc.sim.execute(fmt.Sprintf("Q%04d", bmc.id))
+		default:
+			return IPMI_COMPLETION_INVALID_DATA, nil
+		}
+		return 0, nil
+
+	case netFn == IPMI_NETFN_APP && command == IPMI_CLOSE_SESSION:
+		delete(bmc.sessions, session.bmcId)
+		return 0, nil
+	}
+	return IPMI_COMPLETION_INVALID_COMMAND, nil
+}
+
+// setupResponse is a session setup payload outside of a session
+func (bmc *Bmc) setupResponse(payloadType byte, payload []byte) []byte {
+	packet := rmcpHeader()
+	packet = append(packet, IPMI_AUTH_RMCP_PLUS, payloadType, 0, 0, 0, 0, 0, 0, 0, 0)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(len(payload)))
+	return append(packet, payload...)
+}
+
+func rmcpHeader() []byte {
+	return []byte{RMCP_VERSION, 0, RMCP_NO_ACK, RMCP_CLASS_IPMI}
+}
+
+// ipmiSign adds the integrity pad, the next header and the HMAC-SHA1-96
+// auth code to the session packet starting at the auth type
+func ipmiSign(k1 []byte, packet []byte) []byte {
+	length := len(packet)
+	for (len(packet)+2)%4 != 0 {
+		packet = append(packet, 0xff)
+	}
+	packet = append(packet, byte(len(packet)-length), RMCP_CLASS_IPMI)
+	return append(packet, ipmiHmac(k1, packet)[:12]...)
+}
+
+func ipmiVerify(k1 []byte, packet []byte) bool {
+	if len(packet) < 12 {
+		return false
+	}
+	signed := packet[:len(packet)-12]
+	return hmac.Equal(ipmiHmac(k1, signed)[:12], packet[len(packet)-12:])
+}
+
+func ipmiEncrypt(key []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := append([]byte(nil), data...)
+	pad := 0
+	for (len(plain)+1)%aes.BlockSize != 0 {
+		pad++
+		plain = append(plain, byte(pad))
+	}
+	plain = append(plain, byte(pad))
+
+	iv := ipmiRandom(aes.BlockSize)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+	return append(iv, encrypted...), nil
+}
+
+func ipmiDecrypt(key []byte, data []byte) ([]byte, error) {
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted payload length")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[aes.BlockSize:])
+
+	pad := int(plain[len(plain)-1])
+	if pad >= aes.BlockSize {
+		return nil, errors.New("invalid confidentiality pad")
+	}
+	return plain[:len(plain)-1-pad], nil
+}
+
+func ipmiHmac(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func ipmiChecksum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+func ipmiRandom(n int) []byte {
+	random := make([]byte, n)
+	rand.Read(random)
+	return random
+}
+
+func le32(value uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, value)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// MCU response codes
+const (
+	CODE_OFF             = '0'
+	CODE_ON              = '1'
+	CODE_TURNING_OFF     = '2'
+	CODE_TURNING_ON      = '3'
+	CODE_POWER_FAIL      = '8'
+	CODE_UNKNOWN_COMMAND = '9'
+)
+
+type Workstation struct {
+	state byte
+	until time.Time
+}
+
+// McuSim keeps the power state of every workstation behind the MCU
+type McuSim struct {
+	mutex          sync.Mutex
+	firstId        int
+	workstations   []Workstation
+	transitionTime time.Duration
+	failRate       float64
+}
+
+var linkName_ string
+var wsFirst_ int
+var wsCount_ int
+var transitionTime_ time.Duration
+var latency_ time.Duration
+var failRate_ float64
+var split_ bool
+var listen_ string
+var rfc2217_ bool
+var modbus_ bool
+var slaveId_ int
+var ipmi_ string
+var ipmiUser_ string
+var ipmiPassword_ string
+var redfish_ string
+var redfishUser_ string
+var redfishPassword_ string
+var snmp_ string
+var snmpCommunity_ string
+var snmpWriteCommunity_ string
+
+func main() {
+	fmt.Println("******************************")
+	fmt.Println("Power-Controller MCU Simulator")
+	fmt.Println("******************************")
+
+	flag.StringVar(&linkName_, "link", "", "symlink to the pty (ex: /dev/ttyACM99)")
+	flag.IntVar(&wsFirst_, "first", 0, "first workstation id on the controller")
+	flag.IntVar(&wsCount_, "count", 64, "number of workstations on the controller")
+	flag.DurationVar(&transitionTime_, "transition", 3*time.Second, "time to complete a power on/shutdown")
+	flag.DurationVar(&latency_, "latency", 20*time.Millisecond, "delay before the MCU responds")
+	flag.Float64Var(&failRate_, "fail-rate", 0, "probability (0~1) of answering 8 to a power command")
+	flag.BoolVar(&split_, "split", false, "send the code and the CRLF in separate writes")
+	flag.StringVar(&listen_, "listen", "", "serve over TCP instead of a pty, like ser2net (ex: :4001)")
+	flag.BoolVar(&rfc2217_, "rfc2217", false, "negotiate RFC 2217 COM-PORT-OPTION on the TCP connections")
+	flag.BoolVar(&modbus_, "modbus", false, "emulate a Modbus RTU relay board instead of the MCU")
+	flag.IntVar(&slaveId_, "slave", 1, "Modbus slave id with -modbus")
+	flag.StringVar(&ipmi_, "ipmi", "", "emulate a BMC per workstation over IPMI v2.0 (RMCP+), workstation first+i on port+i (ex: 127.0.0.1:6230)")
+	flag.StringVar(&ipmiUser_, "ipmi-user", "admin", "IPMI user name")
+	flag.StringVar(&ipmiPassword_, "ipmi-password", "admin", "IPMI password")
+	flag.StringVar(&redfish_, "redfish", "", "emulate a Redfish service (plain HTTP) per workstation, workstation first+i on port+i (ex: 127.0.0.1:8000)")
+	flag.StringVar(&redfishUser_, "redfish-user", "admin", "Redfish user name")
+	flag.StringVar(&redfishPassword_, "redfish-password", "admin", "Redfish password")
+	flag.StringVar(&snmp_, "snmp", "", "emulate a switched PDU (APC rack PDU) over SNMPv1/v2c, outlet n feeds workstation first+n-1 (ex: 127.0.0.1:1161)")
+	flag.StringVar(&snmpCommunity_, "snmp-community", "public", "SNMP read community")
+	flag.StringVar(&snmpWriteCommunity_, "snmp-write-community", "private", "SNMP write community")
+	flag.Parse()
+
+	if ipmi_ != "" {
+		fmt.Println("- IPMI : ", ipmi_, "~ +", wsCount_-1, "user =", ipmiUser_)
+		fmt.Println("- Workstations : ", wsFirst_, "~", wsFirst_+wsCount_-1)
+
+		sim := NewMcuSim(wsFirst_, wsCount_, transitionTime_, failRate_)
+		waitStopped(func() error {
+			return sim.listenIpmi(ipmi_, ipmiUser_, ipmiPassword_)
+		})
+		return
+	}
+
+	if redfish_ != "" {
+		fmt.Println("- Redfish : ", redfish_, "~ +", wsCount_-1, "user =", redfishUser_)
+		fmt.Println("- Workstations : ", wsFirst_, "~", wsFirst_+wsCount_-1)
+
+		sim := NewMcuSim(wsFirst_, wsCount_, transitionTime_, failRate_)
+		waitStopped(func() error {
+			return sim.listenRedfish(redfish_, redfishUser_, redfishPassword_)
+		})
+		return
+	}
+
+	if snmp_ != "" {
+		fmt.Println("- SNMP : ", snmp_, "outlets 1 ~", wsCount_)
+		fmt.Println("- Workstations : ", wsFirst_, "~", wsFirst_+wsCount_-1)
+
+		sim := NewMcuSim(wsFirst_, wsCount_, transitionTime_, failRate_)
+		waitStopped(func() error {
+			return sim.listenSnmp(snmp_, snmpCommunity_, snmpWriteCommunity_)
+		})
+		return
+	}
+
+	if listen_ != "" {
+		fmt.Println("- Listening : ", listen_, "rfc2217 =", rfc2217_)
+		fmt.Println("- Workstations : ", wsFirst_, "~", wsFirst_+wsCount_-1)
+
+		sim := NewMcuSim(wsFirst_, wsCount_, transitionTime_, failRate_)
+		waitStopped(func() error {
+			return sim.listenTcp(listen_, rfc2217_)
+		})
+		return
+	}
+
+	master, slaveName, err := openPty()
+	if err != nil {
+		fmt.Println("ERROR : ", err)
+		return
+	}
+	defer master.Close()
+
+	// NOTE : Keep the slave side open ourselves so that reading the master
+	// does not fail with EIO whenever the backend closes the port
+	slave, err := os.OpenFile(slaveName, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		fmt.Println("ERROR : ", err)
+		return
+	}
+	defer slave.Close()
+
+	err = setRawMode(int(slave.Fd()))
+	if err != nil {
+		fmt.Println("ERROR : ", err)
+		return
+	}
+
+	portName := slaveName
+	if linkName_ != "" {
+		err = createLink(slaveName, linkName_)
+		if err != nil {
+			fmt.Println("ERROR : ", err)
+			return
+		}
+		defer os.Remove(linkName_)
+		portName = linkName_
+	}
+
+	fmt.Println("- Serial port : ", portName, "->", slaveName)
+	fmt.Println("- Workstations : ", wsFirst_, "~", wsFirst_+wsCount_-1)
+
+	sim := NewMcuSim(wsFirst_, wsCount_, transitionTime_, failRate_)
+	waitStopped(func() error {
+		return sim.run(master)
+	})
+}
+
+// waitStopped runs the server until it fails or a signal stops the simulator
+func waitStopped(run func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
+
+	select {
+	case sig := <-signals:
+		fmt.Println("- Stopped by ", sig)
+	case err := <-done:
+		fmt.Println("ERROR : ", err)
+	}
+}
+
+func NewMcuSim(first int, count int, transitionTime time.Duration, failRate float64) *McuSim {
+	sim := &McuSim{
+		firstId:        first,
+		workstations:   make([]Workstation, count),
+		transitionTime: transitionTime,
+		failRate:       failRate,
+	}
+	for i := range sim.workstations {
+		sim.workstations[i].state = CODE_OFF
+	}
+	return sim
+}
+
+// run serves the MCU protocol, or Modbus RTU with -modbus
+func (sim *McuSim) run(port io.ReadWriter) error {
+	if modbus_ {
+		return sim.serveModbus(port, byte(slaveId_))
+	}
+	return sim.serve(port)
+}
+
+// serve reads commands from the pty or a connection and writes back the MCU
+// responses. Commands are a letter followed by 4 digits, with or without a newline.
+func (sim *McuSim) serve(port io.ReadWriter) error {
+	buff := make([]byte, 64)
+	cmd := make([]byte, 0, 5)
+
+	for {
+		n, err := port.Read(buff)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range buff[:n] {
+			if b == '\r' || b == '\n' || b == ' ' {
+				if len(cmd) > 0 {
+					// NOTE : Command terminated before 5 characters
+					sim.respond(port, string(cmd), CODE_UNKNOWN_COMMAND)
+					cmd = cmd[:0]
+				}
+				continue
+			}
+
+			cmd = append(cmd, b)
+			if len(cmd) == 5 {
+				sim.respond(port, string(cmd), sim.execute(string(cmd)))
+				cmd = cmd[:0]
+			}
+		}
+	}
+}
+
+func (sim *McuSim) respond(port io.Writer, cmd string, code byte) {
+	time.Sleep(latency_)
+
+	fmt.Printf("- %v -> %c\n", cmd, code)
+
+	var err error
+	if split_ {
+		// NOTE : Emulate a response split over several reads
+		_, err = port.Write([]byte{code})
+		if err == nil {
+			time.Sleep(latency_)
+			_, err = port.Write([]byte{'\r', '\n'})
+		}
+	} else {
+		_, err = port.Write([]byte{code, '\r', '\n'})
+	}
+	if err != nil {
+		fmt.Println("ERROR : ", err)
+	}
+}
+
+// execute applies a command and returns the response code
+func (sim *McuSim) execute(cmd string) byte {
+	if len(cmd) != 5 {
+		return CODE_UNKNOWN_COMMAND
+	}
+
+	id, err := strconv.Atoi(cmd[1:])
+	id -= sim.firstId
+	if err != nil || id < 0 || id >= len(sim.workstations) {
+		return CODE_UNKNOWN_COMMAND
+	}
+
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	now := time.Now()
+	ws := &sim.workstations[id]
+	ws.settle(now)
+
+	switch cmd[0] {
+	case 'C':
+		return ws.state
+	case 'S':
+		if sim.failed() {
+			return CODE_POWER_FAIL
+		}
+		if ws.state == CODE_OFF || ws.state == CODE_TURNING_OFF {
+			ws.transit(CODE_TURNING_ON, now.Add(sim.transitionTime))
+		}
+		return ws.state
+	case 'Q':
+		if sim.failed() {
+			return CODE_POWER_FAIL
+		}
+		if ws.state == CODE_ON || ws.state == CODE_TURNING_ON {
+			ws.transit(CODE_TURNING_OFF, now.Add(sim.transitionTime))
+		}
+		return ws.state
+	case 'E':
+		if sim.failed() {
+			return CODE_POWER_FAIL
+		}
+		ws.state = CODE_OFF
+		return ws.state
+	}
+
+	return CODE_UNKNOWN_COMMAND
+}
+
+func (sim *McuSim) failed() bool {
+	return sim.failRate > 0 && rand.Float64() < sim.failRate
+}
+
+func (ws *Workstation) transit(state byte, until time.Time) {
+	ws.state = state
+	ws.until = until
+	ws.settle(time.Now())
+}
+
+// settle finishes a transition whose time has passed
+func (ws *Workstation) settle(now time.Time) {
+	if now.Before(ws.until) {
+		return
+	}
+
+	if ws.state == CODE_TURNING_ON {
+		ws.state = CODE_ON
+	} else if ws.state == CODE_TURNING_OFF {
+		ws.state = CODE_OFF
+	}
+}
+
+// openPty opens a new pseudo-terminal and returns the master and slave name
+func openPty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fd := int(master.Fd())
+
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+
+	return master, "/dev/pts/" + strconv.Itoa(n), nil
+}
+
+// setRawMode disables echo and line processing on the tty
+func setRawMode(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+// createLink points the link to the pty, replacing only an old symlink
+func createLink(target string, link string) error {
+	info, err := os.Lstat(link)
+	if err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return errors.New(link + " exists and is not a symlink")
+		}
+		err = os.Remove(link)
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Symlink(target, link)
+}
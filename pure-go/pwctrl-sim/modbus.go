@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Modbus function and exception codes
+const (
+	MODBUS_READ_COILS           = 0x01
+	MODBUS_READ_DISCRETE_INPUTS = 0x02
+	MODBUS_WRITE_SINGLE_COIL    = 0x05
+	MODBUS_EXCEPTION            = 0x80
+
+	MODBUS_ILLEGAL_FUNCTION     = 0x01
+	MODBUS_ILLEGAL_DATA_ADDRESS = 0x02
+	MODBUS_ILLEGAL_DATA_VALUE   = 0x03
+)
+
+// serveModbus emulates a Modbus RTU relay board in front of the workstations.
+// Coil n switches workstation first+n (on : S, off : Q) and discrete input n
+// is its power sense, on while it is on or shutting down.
+func (sim *McuSim) serveModbus(port io.ReadWriter, slave byte) error {
+	buff := make([]byte, 64)
+	pending := make([]byte, 0, 64)
+
+	for {
+		n, err := port.Read(buff)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, buff[:n]...)
+
+		// NOTE : Every request of the supported functions is 8 bytes
+		for len(pending) >= 8 {
+			request := pending[:8]
+			crc := modbusCrc(request[:6])
+			if request[6] != byte(crc) || request[7] != byte(crc>>8) {
+				pending = pending[1:]
+				continue
+			}
+			pending = pending[8:]
+
+			if request[0] != slave {
+				continue
+			}
+			response := sim.modbusResponse(request)
+
+			time.Sleep(latency_)
+			fmt.Printf("- modbus % x -> % x\n", request, response)
+			_, err = port.Write(response)
+			if err != nil {
+				fmt.Println("ERROR : ", err)
+			}
+		}
+	}
+}
+
+func (sim *McuSim) modbusResponse(request []byte) []byte {
+	function := request[1]
+	address := int(request[2])<<8 | int(request[3])
+	value := int(request[4])<<8 | int(request[5])
+
+	switch function {
+	case MODBUS_WRITE_SINGLE_COIL:
+		if value != 0xff00 && value != 0x0000 {
+			return modbusException(request, MODBUS_ILLEGAL_DATA_VALUE)
+		}
+		if address >= len(sim.workstations) {
+			return modbusException(request, MODBUS_ILLEGAL_DATA_ADDRESS)
+		}
+
+		letter := 'Q'
+		if value == 0xff00 {
+			letter = 'S'
+		}
+		sim.execute(fmt.Sprintf("%c%04d", letter, sim.firstId+address))
+
+		// NOTE : The response is the echo of the request
+		return append([]byte(nil), request...)
+
+	case MODBUS_READ_COILS, MODBUS_READ_DISCRETE_INPUTS:
+		if value < 1 || value > 2000 {
+			return modbusException(request, MODBUS_ILLEGAL_DATA_VALUE)
+		}
+		if address+value > len(sim.workstations) {
+			return modbusException(request, MODBUS_ILLEGAL_DATA_ADDRESS)
+		}
+
+		bits := make([]byte, (value+7)/8)
+		for i := 0; i < value; i++ {
+			state := sim.execute(fmt.Sprintf("C%04d", sim.firstId+address+i))
+
+			on := state == CODE_ON || state == CODE_TURNING_ON
+			if function == MODBUS_READ_DISCRETE_INPUTS {
+				on = state == CODE_ON || state == CODE_TURNING_OFF
+			}
+			if on {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+
+		response := append([]byte{request[0], function, byte(len(bits))}, bits...)
+		crc := modbusCrc(response)
+		return append(response, byte(crc), byte(crc>>8))
+	}
+
+	return modbusException(request, MODBUS_ILLEGAL_FUNCTION)
+}
+
+func modbusException(request []byte, code byte) []byte {
+	response := []byte{request[0], request[1] | MODBUS_EXCEPTION, code}
+	crc := modbusCrc(response)
+	return append(response, byte(crc), byte(crc>>8))
+}
+
+// modbusCrc is the CRC-16/MODBUS of the frame, sent low byte first
+func modbusCrc(frame []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range frame {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&0x0001 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
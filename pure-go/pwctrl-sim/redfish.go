@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const REDFISH_SYSTEMS = "/redfish/v1/Systems"
+const REDFISH_SYSTEM = REDFISH_SYSTEMS + "/1"
+const REDFISH_RESET = REDFISH_SYSTEM + "/Actions/ComputerSystem.Reset"
+
+// RedfishService emulates the Redfish service of the BMC of one workstation,
+// a single ComputerSystem with the Reset action
+type RedfishService struct {
+	sim      *McuSim
+	id       int
+	user     string
+	password string
+}
+
+// listenRedfish starts a Redfish service per workstation : workstation first+i on port+i
+func (sim *McuSim) listenRedfish(address string, user string, password string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	basePort, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, len(sim.workstations))
+	for i := range sim.workstations {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(basePort+i)))
+		if err != nil {
+			return err
+		}
+
+		service := &RedfishService{
+			sim:      sim,
+			id:       sim.firstId + i,
+			user:     user,
+			password: password,
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET "+REDFISH_SYSTEMS, service.systems)
+		mux.HandleFunc("GET "+REDFISH_SYSTEM, service.system)
+		mux.HandleFunc("POST "+REDFISH_RESET, service.reset)
+
+		go func() {
+			done <- http.Serve(listener, service.authenticated(mux))
+		}()
+	}
+	return <-done
+}
+
+// authenticated answers 401 to a request without the basic credentials
+func (rs *RedfishService) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != rs.user || password != rs.password {
+			fmt.Printf("- Redfish %v : %v %v -> 401\n", rs.id, r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Redfish"`)
+			rs.fail(w, http.StatusUnauthorized, "Base.1.8.NoValidSession", "Invalid user name or password")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rs *RedfishService) systems(w http.ResponseWriter, r *http.Request) {
+	rs.reply(w, map[string]any{
+		"@odata.id":           REDFISH_SYSTEMS,
+		"Name":                "Computer System Collection",
+		"Members":             []map[string]string{{"@odata.id": REDFISH_SYSTEM}},
+		"Members@odata.count": 1,
+	})
+}
+
+func (rs *RedfishService) system(w http.ResponseWriter, r *http.Request) {
+	state := rs.sim.execute(fmt.Sprintf("C%04d", rs.id))
+
+	powerState := "Off"
+	switch state {
+	case CODE_ON:
+		powerState = "On"
+	case CODE_TURNING_ON:
+		powerState = "PoweringOn"
+	case CODE_TURNING_OFF:
+		powerState = "PoweringOff"
+	}
+
+	fmt.Printf("- Redfish %v : GET system -> %v\n", rs.id, powerState)
+	rs.reply(w, map[string]any{
+		"@odata.id":  REDFISH_SYSTEM,
+		"Id":         "1",
+		"Name":       "Workstation " + strconv.Itoa(rs.id),
+		"PowerState": powerState,
+		"Actions": map[string]any{
+			"#ComputerSystem.Reset": map[string]any{
+				"target":                            REDFISH_RESET,
+				"ResetType@Redfish.AllowableValues": []string{"On", "GracefulShutdown", "ForceOff"},
+			},
+		},
+	})
+}
+
+func (rs *RedfishService) reset(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ResetType string
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		rs.fail(w, http.StatusBadRequest, "Base.1.8.MalformedJSON", err.Error())
+		return
+	}
+
+	var cmd string
+	switch body.ResetType {
+	case "On":
+		cmd = fmt.Sprintf("S%04d", rs.id)
+	case "GracefulShutdown":
+		cmd = fmt.Sprintf("Q%04d", rs.id)
+	case "ForceOff":
+		cmd = fmt.Sprintf("E%04d", rs.id)
+	default:
+		rs.fail(w, http.StatusBadRequest, "Base.1.8.ActionParameterValueNotInList", "Unsupported ResetType : "+body.ResetType)
+		return
+	}
+
+	code := rs.sim.execute(cmd)
+	fmt.Printf("- Redfish %v : reset %v -> %c\n", rs.id, body.ResetType, code)
+	if code == CODE_POWER_FAIL {
+		rs.fail(w, http.StatusInternalServerError, "Base.1.8.InternalError", "Power command failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rs *RedfishService) reply(w http.ResponseWriter, resource any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("OData-Version", "4.0")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// fail answers a Redfish error message
+func (rs *RedfishService) fail(w http.ResponseWriter, status int, messageId string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    messageId,
+			"message": message,
+		},
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// BER tags, SNMP PDU types and error status
+const (
+	BER_INTEGER      = 0x02
+	BER_OCTET_STRING = 0x04
+	BER_NULL         = 0x05
+	BER_OID          = 0x06
+	BER_SEQUENCE     = 0x30
+
+	SNMP_GET_REQUEST      = 0xa0
+	SNMP_GET_RESPONSE     = 0xa2
+	SNMP_SET_REQUEST      = 0xa3
+	SNMP_NO_SUCH_INSTANCE = 0x81
+
+	SNMP_VERSION_1  = 0
+	SNMP_VERSION_2C = 1
+
+	SNMP_NO_SUCH_NAME = 2
+	SNMP_BAD_VALUE    = 3
+	SNMP_GEN_ERR      = 5
+	SNMP_WRONG_VALUE  = 10
+	SNMP_NO_CREATION  = 11
+	SNMP_NOT_WRITABLE = 17
+)
+
+// PowerNet-MIB of an APC rack PDU, the outlet number is the last id
+const (
+	APC_OUTLET_CONTROL = "1.3.6.1.4.1.318.1.1.12.3.3.1.1.4"
+	APC_OUTLET_STATUS  = "1.3.6.1.4.1.318.1.1.12.3.5.1.1.4"
+
+	APC_IMMEDIATE_ON  = 1
+	APC_IMMEDIATE_OFF = 2
+	APC_STATUS_ON     = 1
+	APC_STATUS_OFF    = 2
+)
+
+// SnmpAgent emulates a switched PDU (APC rack PDU) : outlet n feeds
+// workstation first+n-1
+type SnmpAgent struct {
+	sim            *McuSim
+	community      string
+	writeCommunity string
+}
+
+// SnmpRequest is a decoded request with one variable binding
+type SnmpRequest struct {
+	version   int64
+	community string
+	pduType   byte
+	requestId []byte
+	oid       string
+	encoded   []byte
+	valueTag  byte
+	value     []byte
+}
+
+// listenSnmp serves SNMPv1/v2c GET and SET on the outlet OIDs
+func (sim *McuSim) listenSnmp(address string, community string, writeCommunity string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	agent := &SnmpAgent{sim: sim, community: community, writeCommunity: writeCommunity}
+	buff := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			return err
+		}
+
+		request, err := parseSnmpRequest(buff[:n])
+		if err != nil {
+			fmt.Println("- SNMP : ", addr, err)
+			continue
+		}
+
+		response := agent.handle(request)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (agent *SnmpAgent) handle(request SnmpRequest) []byte {
+	// NOTE : Like a real agent, a wrong community is dropped without a response
+	community := agent.community
+	if request.pduType == SNMP_SET_REQUEST {
+		community = agent.writeCommunity
+	}
+	if request.community != community {
+		fmt.Printf("- SNMP : wrong community %q, dropped\n", request.community)
+		return nil
+	}
+
+	errorStatus, valueTag, value := agent.execute(request)
+	fmt.Printf("- SNMP : %x %v -> status %v value %v\n", request.pduType, request.oid, errorStatus, berParseInt(value))
+
+	varbind := berTlv(BER_OID, request.encoded)
+	varbind = append(varbind, berTlv(valueTag, value)...)
+
+	pdu := berTlv(BER_INTEGER, request.requestId)
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(int64(errorStatus)))...)
+	errorIndex := 0
+	if errorStatus != 0 {
+		errorIndex = 1
+	}
+	pdu = append(pdu, berTlv(BER_INTEGER, berInt(int64(errorIndex)))...)
+	pdu = append(pdu, berTlv(BER_SEQUENCE, berTlv(BER_SEQUENCE, varbind))...)
+
+	message := berTlv(BER_INTEGER, berInt(request.version))
+	message = append(message, berTlv(BER_OCTET_STRING, []byte(request.community))...)
+	message = append(message, berTlv(SNMP_GET_RESPONSE, pdu)...)
+	return berTlv(BER_SEQUENCE, message)
+}
+
+// execute returns the error status and the value of the response
+func (agent *SnmpAgent) execute(request SnmpRequest) (int, byte, []byte) {
+	control := false
+	var outlet string
+	switch {
+	case strings.HasPrefix(request.oid, APC_OUTLET_CONTROL+"."):
+		control = true
+		outlet = strings.TrimPrefix(request.oid, APC_OUTLET_CONTROL+".")
+	case strings.HasPrefix(request.oid, APC_OUTLET_STATUS+"."):
+		outlet = strings.TrimPrefix(request.oid, APC_OUTLET_STATUS+".")
+	}
+
+	n, err := strconv.Atoi(outlet)
+	if err != nil || n < 1 || n > len(agent.sim.workstations) {
+		return agent.noSuchObject(request)
+	}
+	id := agent.sim.firstId + n - 1
+
+	if request.pduType == SNMP_SET_REQUEST {
+		if !control {
+			return SNMP_NOT_WRITABLE, request.valueTag, request.value
+		}
+		if request.valueTag != BER_INTEGER {
+			return agent.wrongValue(request)
+		}
+
+		var code byte
+		switch berParseInt(request.value) {
+		case APC_IMMEDIATE_ON:
+			code = agent.sim.execute(fmt.Sprintf("S%04d", id))
+		case APC_IMMEDIATE_OFF:
+			code = agent.sim.execute(fmt.Sprintf("E%04d", id))
+		default:
+			return agent.wrongValue(request)
+		}
+		if code == CODE_POWER_FAIL {
+			return SNMP_GEN_ERR, request.valueTag, request.value
+		}
+		return 0, request.valueTag, request.value
+	}
+
+	// NOTE : The relay of the outlet is closed from the power on until the
+	// end of the shutdown
+	state := agent.sim.execute(fmt.Sprintf("C%04d", id))
+	status := APC_STATUS_OFF
+	if state == CODE_ON || state == CODE_TURNING_ON {
+		status = APC_STATUS_ON
+	}
+	return 0, BER_INTEGER, berInt(int64(status))
+}
+
+func (agent *SnmpAgent) noSuchObject(request SnmpRequest) (int, byte, []byte) {
+	if request.version == SNMP_VERSION_1 {
+		return SNMP_NO_SUCH_NAME, request.valueTag, request.value
+	}
+	if request.pduType == SNMP_SET_REQUEST {
+		return SNMP_NO_CREATION, request.valueTag, request.value
+	}
+	return 0, SNMP_NO_SUCH_INSTANCE, nil
+}
+
+func (agent *SnmpAgent) wrongValue(request SnmpRequest) (int, byte, []byte) {
+	if request.version == SNMP_VERSION_1 {
+		return SNMP_BAD_VALUE, request.valueTag, request.value
+	}
+	return SNMP_WRONG_VALUE, request.valueTag, request.value
+}
+
+// parseSnmpRequest decodes a GET or SET message with one variable binding
+func parseSnmpRequest(data []byte) (SnmpRequest, error) {
+	var request SnmpRequest
+
+	tag, message, _, err := berRead(data)
+	if err != nil || tag != BER_SEQUENCE {
+		return request, errors.New("invalid message")
+	}
+
+	tag, content, message, err := berRead(message)
+	if err != nil || tag != BER_INTEGER {
+		return request, errors.New("invalid version")
+	}
+	request.version = berParseInt(content)
+	if request.version != SNMP_VERSION_1 && request.version != SNMP_VERSION_2C {
+		return request, errors.New("unsupported version " + strconv.FormatInt(request.version, 10))
+	}
+
+	tag, content, message, err = berRead(message)
+	if err != nil || tag != BER_OCTET_STRING {
+		return request, errors.New("invalid community")
+	}
+	request.community = string(content)
+
+	request.pduType, content, _, err = berRead(message)
+	if err != nil || (request.pduType != SNMP_GET_REQUEST && request.pduType != SNMP_SET_REQUEST) {
+		return request, errors.New("unsupported PDU")
+	}
+
+	pdu := content
+	for i := 0; i < 3; i++ {
+		tag, content, pdu, err = berRead(pdu)
+		if err != nil || tag != BER_INTEGER {
+			return request, errors.New("invalid PDU")
+		}
+		if i == 0 {
+			request.requestId = content
+		}
+	}
+
+	tag, varbinds, _, err := berRead(pdu)
+	if err != nil || tag != BER_SEQUENCE {
+		return request, errors.New("invalid variable bindings")
+	}
+	tag, varbind, rest, err := berRead(varbinds)
+	if err != nil || tag != BER_SEQUENCE || len(rest) > 0 {
+		return request, errors.New("one variable binding only")
+	}
+	tag, request.encoded, varbind, err = berRead(varbind)
+	if err != nil || tag != BER_OID {
+		return request, errors.New("invalid OID")
+	}
+	request.oid = berOidString(request.encoded)
+	request.valueTag, request.value, _, err = berRead(varbind)
+	if err != nil {
+		return request, errors.New("invalid value")
+	}
+	return request, nil
+}
+
+func berTlv(tag byte, content []byte) []byte {
+	tlv := []byte{tag}
+	length := len(content)
+	switch {
+	case length < 0x80:
+		tlv = append(tlv, byte(length))
+	case length < 0x100:
+		tlv = append(tlv, 0x81, byte(length))
+	default:
+		tlv = append(tlv, 0x82, byte(length>>8), byte(length))
+	}
+	return append(tlv, content...)
+}
+
+func berInt(value int64) []byte {
+	length := 1
+	for v := value; v > 127 || v < -128; v >>= 8 {
+		length++
+	}
+
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = byte(value)
+		value >>= 8
+	}
+	return encoded
+}
+
+func berParseInt(content []byte) int64 {
+	var value int64
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// berOidString decodes an OID into the dotted form without the leading dot
+func berOidString(encoded []byte) string {
+	var ids []string
+	var id uint64
+	for _, b := range encoded {
+		id = id<<7 | uint64(b&0x7f)
+		if b&0x80 != 0 {
+			continue
+		}
+		if len(ids) == 0 {
+			first := id / 40
+			if first > 2 {
+				first = 2
+			}
+			ids = append(ids, strconv.FormatUint(first, 10), strconv.FormatUint(id-first*40, 10))
+		} else {
+			ids = append(ids, strconv.FormatUint(id, 10))
+		}
+		id = 0
+	}
+	return strings.Join(ids, ".")
+}
+
+func berRead(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errors.New("truncated")
+	}
+
+	tag := data[0]
+	length := int(data[1])
+	offset := 2
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 2 || len(data) < 2+size {
+			return 0, nil, nil, errors.New("invalid length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+size] {
+			length = length<<8 | int(b)
+		}
+		offset += size
+	}
+
+	if len(data) < offset+length {
+		return 0, nil, nil, errors.New("truncated")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
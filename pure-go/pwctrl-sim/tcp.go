@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Telnet commands and the COM-PORT-OPTION of RFC 2217
+const (
+	TELNET_SE   = 240
+	TELNET_SB   = 250
+	TELNET_WILL = 251
+	TELNET_WONT = 252
+	TELNET_DO   = 253
+	TELNET_DONT = 254
+	TELNET_IAC  = 255
+
+	TELNET_BINARY   = 0
+	TELNET_SGA      = 3
+	TELNET_COM_PORT = 44
+
+	COM_PORT_SERVER_OFFSET = 100
+)
+
+// listenTcp emulates a terminal server (ser2net) in front of the MCU.
+// Connections are served one after another, like a serial line.
+func (sim *McuSim) listenTcp(address string, rfc2217 bool) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("- Connected : ", conn.RemoteAddr())
+
+		var port io.ReadWriter = conn
+		if rfc2217 {
+			port = &TelnetServer{conn: conn}
+		}
+		err = sim.run(port)
+		conn.Close()
+
+		fmt.Println("- Disconnected : ", conn.RemoteAddr(), err)
+	}
+}
+
+const (
+	telnetData = iota
+	telnetIac
+	telnetOption
+	telnetSub
+	telnetSubIac
+)
+
+// TelnetServer is the access-server side of RFC 2217.
+// It agrees COM-PORT-OPTION, acks every setting and passes the data through.
+type TelnetServer struct {
+	conn    net.Conn
+	state   int
+	command byte
+	sub     []byte
+}
+
+func (t *TelnetServer) Read(buff []byte) (int, error) {
+	for {
+		raw := make([]byte, len(buff))
+		n, err := t.conn.Read(raw)
+
+		data := 0
+		for _, b := range raw[:n] {
+			switch t.state {
+			case telnetData:
+				if b == TELNET_IAC {
+					t.state = telnetIac
+				} else {
+					buff[data] = b
+					data++
+				}
+			case telnetIac:
+				switch b {
+				case TELNET_IAC:
+					buff[data] = b
+					data++
+					t.state = telnetData
+				case TELNET_WILL, TELNET_WONT, TELNET_DO, TELNET_DONT:
+					t.command = b
+					t.state = telnetOption
+				case TELNET_SB:
+					t.sub = t.sub[:0]
+					t.state = telnetSub
+				default:
+					t.state = telnetData
+				}
+			case telnetOption:
+				t.negotiated(t.command, b)
+				t.state = telnetData
+			case telnetSub:
+				if b == TELNET_IAC {
+					t.state = telnetSubIac
+				} else {
+					t.sub = append(t.sub, b)
+				}
+			case telnetSubIac:
+				if b == TELNET_SE {
+					t.subnegotiated(t.sub)
+					t.state = telnetData
+				} else {
+					t.sub = append(t.sub, b)
+					t.state = telnetSub
+				}
+			}
+		}
+
+		// NOTE : serve treats (0, nil) as no data, keep reading instead
+		if err != nil || data > 0 {
+			return data, err
+		}
+	}
+}
+
+func (t *TelnetServer) Write(data []byte) (int, error) {
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		escaped = append(escaped, b)
+		if b == TELNET_IAC {
+			escaped = append(escaped, TELNET_IAC)
+		}
+	}
+
+	_, err := t.conn.Write(escaped)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (t *TelnetServer) negotiated(command byte, option byte) {
+	supported := option == TELNET_COM_PORT || option == TELNET_BINARY || option == TELNET_SGA
+
+	var answer byte
+	switch command {
+	case TELNET_WILL:
+		answer = TELNET_DONT
+		if supported {
+			answer = TELNET_DO
+		}
+	case TELNET_DO:
+		answer = TELNET_WONT
+		if supported && option != TELNET_COM_PORT {
+			answer = TELNET_WILL
+		}
+	default:
+		return
+	}
+
+	fmt.Printf("- Telnet : %v %v -> %v\n", command, option, answer)
+	t.conn.Write([]byte{TELNET_IAC, answer, option})
+}
+
+// subnegotiated acks a COM-PORT-OPTION command with the command + 100.
+// The line setting itself is ignored, the pty has none.
+func (t *TelnetServer) subnegotiated(sub []byte) {
+	if len(sub) < 2 || sub[0] != TELNET_COM_PORT {
+		return
+	}
+
+	fmt.Printf("- COM-PORT : %v %v\n", sub[1], sub[2:])
+
+	ack := []byte{TELNET_IAC, TELNET_SB, TELNET_COM_PORT, sub[1] + COM_PORT_SERVER_OFFSET}
+	for _, b := range sub[2:] {
+		ack = append(ack, b)
+		if b == TELNET_IAC {
+			ack = append(ack, TELNET_IAC)
+		}
+	}
+	ack = append(ack, TELNET_IAC, TELNET_SE)
+	t.conn.Write(ack)
+}
@@ -2,8 +2,15 @@ module grida/pwctrltest
 
 go 1.22.4
 
+require (
+	go.bug.st/serial v1.6.2
+	grida/pwctrlbe v0.0.0
+)
+
 require (
 	github.com/creack/goselect v0.1.2 // indirect
-	go.bug.st/serial v1.6.2 // indirect
-	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
+
+// NOTE : The port lock is shared with the backend
+replace grida/pwctrlbe => ../pw-ctrl-be
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"grida/pwctrlbe/portlock"
 	"os"
 	"strconv"
 	"time"
@@ -13,6 +14,7 @@ import (
 var portPrefix_ string
 var portName_ string
 var serialPort_ serial.Port
+var portLock_ *portlock.Lock
 var readTimeOut_ int
 var readMinByte_ int
 
@@ -94,12 +96,21 @@ func main() {
 	}
 
 	serialPort_.Close()
+	portLock_.Unlock()
 }
 
 func initializePort() error {
 	if serialPort_ != nil {
 		serialPort_.Close()
 	}
+	portLock_.Unlock()
+
+	// NOTE : Lock the port as the backend does, not to interleave commands with it
+	var err error
+	portLock_, err = portlock.Acquire(portName_)
+	if err != nil {
+		return err
+	}
 
 	mode := &serial.Mode{
 		BaudRate: 9600,
@@ -108,9 +119,9 @@ func initializePort() error {
 		StopBits: serial.OneStopBit,
 	}
 
-	var err error
 	serialPort_, err = serial.Open(portName_, mode)
 	if err != nil {
+		portLock_.Unlock()
 		return err
 	}
 
@@ -140,7 +151,7 @@ func findSerialPort() error {
 	portList := make([]string, 0)
 
 	for _, port := range ports {
-		if port[:len(portPrefix_)] == portPrefix_ {
+		if len(port) >= len(portPrefix_) && port[:len(portPrefix_)] == portPrefix_ {
 			portList = append(portList, port)
 		}
 	}